@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"azdoexporter/azdo"
+)
+
+const apiServersPath = "/api/v1/servers"
+
+// The jobs which finished on a pool are kept, newest first, until this many more have finished
+const maxRecentJobs = 25
+
+// poolSnapshot is what the last scrape of a server's agents retrieved for a pool
+type poolSnapshot struct {
+	pool         azdo.Pool
+	agents       []azdo.Agent
+	currentJobs  []azdo.Job
+	finishedJobs []azdo.Job // Finished since the scrape before
+	recentJobs   []azdo.Job // Finished over this and earlier scrapes, newest first
+}
+
+// recordSnapshot keeps what a scrape which succeeded retrieved, which is otherwise thrown away once the metrics are calculated
+func (azc *azDoCollector) recordSnapshot(contexts []metricsContext) {
+	azc.statusMu.Lock()
+	defer azc.statusMu.Unlock()
+
+	previous := make(map[int][]azdo.Job, len(azc.snapshot))
+	for _, p := range azc.snapshot {
+		previous[p.pool.ID] = p.recentJobs
+	}
+
+	snapshot := make([]poolSnapshot, 0, len(contexts))
+	for _, c := range contexts {
+		recent := append([]azdo.Job{}, c.finishedJobs...)
+		sort.Slice(recent, func(i, j int) bool { return recent[i].FinishTime.After(recent[j].FinishTime) })
+		recent = append(recent, previous[c.pool.ID]...)
+		if len(recent) > maxRecentJobs {
+			recent = recent[:maxRecentJobs]
+		}
+
+		snapshot = append(snapshot, poolSnapshot{pool: c.pool, agents: c.agents, currentJobs: c.currentJobs, finishedJobs: c.finishedJobs, recentJobs: recent})
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].pool.ID < snapshot[j].pool.ID })
+
+	azc.snapshot = snapshot
+	azc.snapshotTime = time.Now()
+}
+
+func (azc *azDoCollector) lastSnapshot() ([]poolSnapshot, time.Time) {
+	azc.statusMu.Lock()
+	defer azc.statusMu.Unlock()
+	return azc.snapshot, azc.snapshotTime
+}
+
+// agentsCollector returns the collector of a server's agents
+func (sm *serverManager) agentsCollector(name string) (*azDoCollector, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	s, ok := sm.servers[name]
+	if !ok {
+		return nil, false
+	}
+	return s.agents, true
+}
+
+// apiResponse is the envelope of every response, the same shape as Azure DevOps' own
+type apiResponse struct {
+	Count        int         `json:"count"`
+	SnapshotTime *time.Time  `json:"snapshotTime,omitempty"` // When the scrape the value is from finished
+	Value        interface{} `json:"value"`
+}
+
+type apiServer struct {
+	Name         string       `json:"name"`
+	Address      string       `json:"address"`
+	Status       scrapeStatus `json:"status"`
+	SnapshotTime *time.Time   `json:"snapshotTime,omitempty"`
+}
+
+type apiPool struct {
+	azdo.Pool
+	AgentCount   int `json:"agentCount"`
+	OnlineAgents int `json:"onlineAgents"`
+	QueuedJobs   int `json:"queuedJobs"`
+	RunningJobs  int `json:"runningJobs"`
+}
+
+type apiJob struct {
+	azdo.Job
+	State string `json:"state"` // queued, running or finished
+}
+
+// apiHandler serves the most recent snapshot of each server's pools, agents and jobs as JSON:
+//
+//	/api/v1/servers
+//	/api/v1/servers/<name>/pools?name=&hosted=
+//	/api/v1/servers/<name>/pools/<id>/agents?name=&status=&enabled=
+//	/api/v1/servers/<name>/pools/<id>/jobs?state=&definition=&result=
+type apiHandler struct {
+	servers *serverManager
+}
+
+func (h apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiServersPath), "/"), "/")
+	if len(parts) == 1 && parts[0] == "" {
+		h.serveServers(w)
+		return
+	}
+
+	if len(parts) != 2 && len(parts) != 4 || parts[1] != "pools" {
+		http.NotFound(w, r)
+		return
+	}
+
+	collector, ok := h.servers.agentsCollector(parts[0])
+	if !ok {
+		http.Error(w, "Unknown server "+parts[0], http.StatusNotFound)
+		return
+	}
+	snapshot, snapshotTime := collector.lastSnapshot()
+	if snapshotTime.IsZero() {
+		http.Error(w, "Server "+parts[0]+" has not been scraped yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	if len(parts) == 2 {
+		pools, err := filterPools(snapshot, query.Get("name"), query.Get("hosted"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeAPIResponse(w, len(pools), pools, snapshotTime)
+		return
+	}
+
+	var pool *poolSnapshot
+	for i := range snapshot {
+		if strconv.Itoa(snapshot[i].pool.ID) == parts[2] {
+			pool = &snapshot[i]
+		}
+	}
+	if pool == nil {
+		http.Error(w, "Unknown pool "+parts[2], http.StatusNotFound)
+		return
+	}
+
+	switch parts[3] {
+	case "agents":
+		agents, err := filterAgents(pool.agents, query.Get("name"), query.Get("status"), query.Get("enabled"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeAPIResponse(w, len(agents), agents, snapshotTime)
+
+	case "jobs":
+		jobs := filterJobs(*pool, query.Get("state"), query.Get("definition"), query.Get("result"))
+		writeAPIResponse(w, len(jobs), jobs, snapshotTime)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h apiHandler) serveServers(w http.ResponseWriter) {
+	h.servers.mu.RLock()
+	servers := make([]apiServer, 0, len(h.servers.servers))
+	for name, s := range h.servers.servers {
+		server := apiServer{Name: name, Address: s.settings.Address, Status: s.agents.scrapeStatus()}
+		if _, snapshotTime := s.agents.lastSnapshot(); !snapshotTime.IsZero() {
+			server.SnapshotTime = &snapshotTime
+		}
+		servers = append(servers, server)
+	}
+	h.servers.mu.RUnlock()
+
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Name < servers[j].Name })
+	writeAPIResponse(w, len(servers), servers, time.Time{})
+}
+
+func writeAPIResponse(w http.ResponseWriter, count int, value interface{}, snapshotTime time.Time) {
+	response := apiResponse{Count: count, Value: value}
+	if !snapshotTime.IsZero() {
+		response.SnapshotTime = &snapshotTime
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.WithField("error", err).Error("Failed to write API response")
+	}
+}
+
+// parseFilterBool parses an optional true or false filter
+func parseFilterBool(name string, value string) (*bool, error) {
+	if value == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, &filterError{name, value}
+	}
+	return &b, nil
+}
+
+type filterError struct {
+	name  string
+	value string
+}
+
+func (e *filterError) Error() string {
+	return "invalid value " + strconv.Quote(e.value) + " for filter " + e.name + ". Must be true or false"
+}
+
+func filterPools(snapshot []poolSnapshot, name string, hosted string) ([]apiPool, error) {
+	isHosted, err := parseFilterBool("hosted", hosted)
+	if err != nil {
+		return nil, err
+	}
+
+	pools := []apiPool{}
+	for _, p := range snapshot {
+		if name != "" && !strings.EqualFold(p.pool.Name, name) || isHosted != nil && p.pool.IsHosted != *isHosted {
+			continue
+		}
+
+		pool := apiPool{Pool: p.pool, AgentCount: len(p.agents)}
+		for _, agent := range p.agents {
+			if strings.EqualFold(agent.Status, "online") {
+				pool.OnlineAgents++
+			}
+		}
+		// The same as the tfs_pool_queued_jobs and tfs_pool_running_jobs metrics
+		for _, job := range p.currentJobs {
+			if job.AssignTime.IsZero() {
+				pool.QueuedJobs++
+			} else {
+				pool.RunningJobs++
+			}
+		}
+		pools = append(pools, pool)
+	}
+	return pools, nil
+}
+
+func filterAgents(agents []azdo.Agent, name string, status string, enabled string) ([]azdo.Agent, error) {
+	isEnabled, err := parseFilterBool("enabled", enabled)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := []azdo.Agent{}
+	for _, agent := range agents {
+		if name != "" && !strings.EqualFold(agent.Name, name) || status != "" && !strings.EqualFold(agent.Status, status) || isEnabled != nil && agent.Enabled != *isEnabled {
+			continue
+		}
+		filtered = append(filtered, agent)
+	}
+	return filtered, nil
+}
+
+// filterJobs returns the pool's queued and running jobs, and those which finished since the scrape before
+func filterJobs(pool poolSnapshot, state string, definition string, result string) []apiJob {
+	jobs := []apiJob{}
+	add := func(job azdo.Job, jobState string) {
+		if state != "" && !strings.EqualFold(jobState, state) || definition != "" && !strings.EqualFold(job.Definition.Name, definition) || result != "" && !strings.EqualFold(job.Result, result) {
+			return
+		}
+		jobs = append(jobs, apiJob{Job: job, State: jobState})
+	}
+
+	for _, job := range pool.currentJobs {
+		if job.AssignTime.IsZero() {
+			add(job, "queued")
+		} else {
+			add(job, "running")
+		}
+	}
+	for _, job := range pool.finishedJobs {
+		add(job, "finished")
+	}
+	return jobs
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var upDesc = prometheus.NewDesc(
+	"tfs_up",
+	"Whether the last scrape of the server's agents succeeded",
+	[]string{},
+	nil,
+)
+
+// apiMetrics instruments the requests a server's AzDoClient makes to the Azure DevOps API, labelled by route template.
+// It's registered with the server's collectors so the metrics also have the server's name label.
+type apiMetrics struct {
+	requestDuration *prometheus.HistogramVec
+	responseSize    *prometheus.SummaryVec
+	requests        *prometheus.CounterVec
+	retries         *prometheus.CounterVec
+	callDuration    *prometheus.HistogramVec
+}
+
+func newAPIMetrics() *apiMetrics {
+	return &apiMetrics{
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "tfs_api_request_duration_seconds",
+			Help:    "Duration of each attempt at a request to the Azure DevOps API",
+			Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		}, []string{"route", "code"}),
+		responseSize: prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Name:       "tfs_api_response_size_bytes",
+			Help:       "Size of the successful responses from the Azure DevOps API",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		}, []string{"route"}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tfs_api_requests_total",
+			Help: "Total of attempts at requests to the Azure DevOps API by status code. The code is 0 when no response was received",
+		}, []string{"route", "code"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tfs_api_request_retries_total",
+			Help: "Total of retries of failed requests to the Azure DevOps API",
+		}, []string{"route"}),
+		callDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "tfs_api_call_duration_seconds",
+			Help:    "Duration of requests to the Azure DevOps API including retries, by whether they eventually succeeded",
+			Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"route", "outcome"}),
+	}
+}
+
+func (m *apiMetrics) ObserveRequest(route string, statusCode int, duration time.Duration, size int) {
+	code := strconv.Itoa(statusCode)
+	m.requestDuration.WithLabelValues(route, code).Observe(duration.Seconds())
+	m.requests.WithLabelValues(route, code).Inc()
+	if statusCode >= 200 && statusCode <= 299 {
+		m.responseSize.WithLabelValues(route).Observe(float64(size))
+	}
+}
+
+func (m *apiMetrics) ObserveRetry(route string) {
+	m.retries.WithLabelValues(route).Inc()
+}
+
+func (m *apiMetrics) ObserveCall(route string, duration time.Duration, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	m.callDuration.WithLabelValues(route, outcome).Observe(duration.Seconds())
+}
+
+func (m *apiMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.requestDuration.Describe(ch)
+	m.responseSize.Describe(ch)
+	m.requests.Describe(ch)
+	m.retries.Describe(ch)
+	m.callDuration.Describe(ch)
+}
+
+func (m *apiMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.requestDuration.Collect(ch)
+	m.responseSize.Collect(ch)
+	m.requests.Collect(ch)
+	m.retries.Collect(ch)
+	m.callDuration.Collect(ch)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"azdoexporter/azdo"
+	"azdoexporter/config"
+)
+
+// snapshotServers has a server s1 which has been scraped, with pools Default and Hosted, and a server s2 which hasn't
+func snapshotServers(t *testing.T) *serverManager {
+	sm := newServerManager(t.Context(), prometheus.NewRegistry(), "")
+
+	now := time.Now()
+	agents := []azdo.Agent{
+		{ID: 1, Name: "agent-1", Status: "online", Enabled: true},
+		{ID: 2, Name: "agent-2", Status: "offline", Enabled: false},
+	}
+	queued := azdo.Job{RequestID: 1, Name: "Queued job", QueueTime: now.Add(-time.Minute), Definition: azdo.JobReference{Name: "pipeline"}}
+	running := azdo.Job{RequestID: 2, Name: "Running job", QueueTime: now.Add(-2 * time.Minute), AssignTime: now.Add(-time.Minute), ReceiveTime: now.Add(-time.Minute),
+		Definition: azdo.JobReference{Name: "pipeline"}, ReservedAgent: agents[0]}
+	finished := azdo.Job{RequestID: 3, Name: "Finished job", Result: "failed", QueueTime: now.Add(-3 * time.Minute), AssignTime: now.Add(-3 * time.Minute),
+		ReceiveTime: now.Add(-3 * time.Minute), FinishTime: now.Add(-2 * time.Minute), Definition: azdo.JobReference{Name: "other"}, ReservedAgent: agents[1]}
+
+	s1 := newAzDoCollector(azdo.AzDoClient{Name: "s1"}, true)
+	s1.recordSnapshot([]metricsContext{
+		{pool: azdo.Pool{ID: 1, Name: "Default"}, agents: agents, currentJobs: []azdo.Job{queued, running}, finishedJobs: []azdo.Job{finished}},
+		{pool: azdo.Pool{ID: 2, Name: "Hosted", IsHosted: true}},
+	})
+	s1.recordScrape(now, 2, nil)
+
+	s2 := newAzDoCollector(azdo.AzDoClient{Name: "s2"}, true)
+	s2.recordScrape(now, 0, errors.New("could not retrieve pools"))
+
+	sm.servers["s1"] = &server{settings: serverSettings{Server: config.Server{AzDoClient: azdo.AzDoClient{Name: "s1", Address: "https://dev.azure.com/s1"}}}, agents: s1}
+	sm.servers["s2"] = &server{settings: serverSettings{Server: config.Server{AzDoClient: azdo.AzDoClient{Name: "s2", Address: "https://dev.azure.com/s2"}}}, agents: s2}
+	return sm
+}
+
+func TestAPIHandler(t *testing.T) {
+	handler := apiHandler{snapshotServers(t)}
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		wantCode  int
+		wantCount int
+	}{
+		{name: "servers", path: "/api/v1/servers", wantCode: http.StatusOK, wantCount: 2},
+		{name: "servers with a trailing slash", path: "/api/v1/servers/", wantCode: http.StatusOK, wantCount: 2},
+		{name: "pools", path: "/api/v1/servers/s1/pools", wantCode: http.StatusOK, wantCount: 2},
+		{name: "pools by name", path: "/api/v1/servers/s1/pools?name=default", wantCode: http.StatusOK, wantCount: 1},
+		{name: "hosted pools", path: "/api/v1/servers/s1/pools?hosted=true", wantCode: http.StatusOK, wantCount: 1},
+		{name: "pools with an invalid filter", path: "/api/v1/servers/s1/pools?hosted=maybe", wantCode: http.StatusBadRequest},
+		{name: "agents", path: "/api/v1/servers/s1/pools/1/agents", wantCode: http.StatusOK, wantCount: 2},
+		{name: "online agents", path: "/api/v1/servers/s1/pools/1/agents?status=Online", wantCode: http.StatusOK, wantCount: 1},
+		{name: "disabled agents", path: "/api/v1/servers/s1/pools/1/agents?enabled=false", wantCode: http.StatusOK, wantCount: 1},
+		{name: "agents with an invalid filter", path: "/api/v1/servers/s1/pools/1/agents?enabled=maybe", wantCode: http.StatusBadRequest},
+		{name: "jobs", path: "/api/v1/servers/s1/pools/1/jobs", wantCode: http.StatusOK, wantCount: 3},
+		{name: "queued jobs", path: "/api/v1/servers/s1/pools/1/jobs?state=queued", wantCode: http.StatusOK, wantCount: 1},
+		{name: "jobs by definition", path: "/api/v1/servers/s1/pools/1/jobs?definition=pipeline", wantCode: http.StatusOK, wantCount: 2},
+		{name: "jobs by result", path: "/api/v1/servers/s1/pools/1/jobs?result=failed", wantCode: http.StatusOK, wantCount: 1},
+		{name: "jobs of a pool without any", path: "/api/v1/servers/s1/pools/2/jobs", wantCode: http.StatusOK, wantCount: 0},
+		{name: "unknown server", path: "/api/v1/servers/missing/pools", wantCode: http.StatusNotFound},
+		{name: "server not scraped yet", path: "/api/v1/servers/s2/pools", wantCode: http.StatusServiceUnavailable},
+		{name: "unknown pool", path: "/api/v1/servers/s1/pools/99/agents", wantCode: http.StatusNotFound},
+		{name: "pool which isn't an ID", path: "/api/v1/servers/s1/pools/Default/agents", wantCode: http.StatusNotFound},
+		{name: "unknown pool resource", path: "/api/v1/servers/s1/pools/1/capabilities", wantCode: http.StatusNotFound},
+		{name: "unknown server resource", path: "/api/v1/servers/s1/agents", wantCode: http.StatusNotFound},
+		{name: "post", method: http.MethodPost, path: "/api/v1/servers", wantCode: http.StatusMethodNotAllowed},
+		{name: "delete", method: http.MethodDelete, path: "/api/v1/servers/s1/pools/1/jobs", wantCode: http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			method := test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(method, test.path, nil))
+
+			if w.Code != test.wantCode {
+				t.Fatalf("got status %v, want %v: %v", w.Code, test.wantCode, w.Body.String())
+			}
+			if w.Code == http.StatusMethodNotAllowed && w.Header().Get("Allow") != http.MethodGet {
+				t.Errorf("got Allow %q, want GET", w.Header().Get("Allow"))
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var response struct {
+				Count        int               `json:"count"`
+				SnapshotTime *time.Time        `json:"snapshotTime"`
+				Value        []json.RawMessage `json:"value"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Count != test.wantCount || len(response.Value) != test.wantCount {
+				t.Errorf("got count %v of %v values, want %v", response.Count, len(response.Value), test.wantCount)
+			}
+		})
+	}
+}
+
+func TestAPIPoolsCountAgentsAndJobs(t *testing.T) {
+	w := httptest.NewRecorder()
+	apiHandler{snapshotServers(t)}.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/servers/s1/pools?name=Default", nil))
+
+	var response struct {
+		SnapshotTime *time.Time `json:"snapshotTime"`
+		Value        []apiPool  `json:"value"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.SnapshotTime == nil {
+		t.Error("the snapshot time wasn't returned")
+	}
+	if len(response.Value) != 1 {
+		t.Fatalf("got %v pools, want Default", len(response.Value))
+	}
+	if p := response.Value[0]; p.AgentCount != 2 || p.OnlineAgents != 1 || p.QueuedJobs != 1 || p.RunningJobs != 1 {
+		t.Errorf("got %+v, want 2 agents with 1 online, and 1 queued and 1 running job", p)
+	}
+}
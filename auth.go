@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"azdoexporter/azdo"
+	"azdoexporter/config"
+)
+
+// newAuthenticator creates the authenticator for the auth method of a server.
+// Entra ID tokens are requested with tokenClient rather than the server's Client, as the server's TLS settings aren't for Entra ID.
+func newAuthenticator(server config.Server, tokenClient *http.Client) (azdo.Authenticator, error) {
+	var entraID *azdo.EntraIDAuthenticator
+
+	switch server.Auth.Method {
+	case "", config.AuthMethodPAT:
+		return azdo.PATAuthenticator{AccessToken: accessTokenProvider(server)}, nil
+	case config.AuthMethodClientSecret:
+		entraID = azdo.NewClientSecretAuthenticator(server.Auth.TenantID, server.Auth.ClientID, azdo.StaticSecret(server.Auth.ClientSecret))
+	case config.AuthMethodClientCertificate:
+		var err error
+		entraID, err = azdo.NewClientCertificateAuthenticator(server.Auth.TenantID, server.Auth.ClientID, server.Auth.CertificateFile)
+		if err != nil {
+			return nil, err
+		}
+	case config.AuthMethodWorkloadIdentity:
+		entraID = azdo.NewWorkloadIdentityAuthenticator(server.Auth.TenantID, server.Auth.ClientID, server.Auth.TokenFile)
+	case config.AuthMethodNTLM:
+		return azdo.NTLMAuthenticator{Username: server.Auth.Username, Password: server.Auth.Password}, nil
+	default:
+		return nil, fmt.Errorf("unknown auth method %v", server.Auth.Method)
+	}
+
+	entraID.AuthorityHost = server.Auth.AuthorityHost
+	entraID.HTTPClient = tokenClient
+	return entraID, nil
+}
+
+// accessTokenProvider returns where the PAT for a server comes from. Only one of these can be set in the config.
+func accessTokenProvider(server config.Server) azdo.SecretProvider {
+	switch {
+	case server.AccessTokenFile != "":
+		return azdo.NewFileSecret(server.AccessTokenFile)
+	case len(server.AccessTokenCommand) > 0:
+		return azdo.NewCommandSecret(server.AccessTokenCommand, server.AccessTokenCommandTTL.Duration)
+	default:
+		return azdo.StaticSecret(server.AccessToken)
+	}
+}
+
+// wrapTransport adds anything the auth method of a server needs to its transport
+func wrapTransport(auth config.Auth, rt http.RoundTripper) http.RoundTripper {
+	if auth.Method == config.AuthMethodNTLM {
+		return azdo.NTLMTransport(rt)
+	}
+	return rt
+}
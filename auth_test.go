@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"azdoexporter/azdo"
+	"azdoexporter/config"
+)
+
+func TestEntraIDTokensUseTheProxyButNotTheServersTLS(t *testing.T) {
+	// The proxy answers the token request itself, as a plain HTTP request to a proxy is for the absolute URL
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host != "login.example.com" || r.URL.Path != "/tenant/oauth2/v2.0/token" {
+			t.Errorf("unexpected request to %v through the proxy", r.URL)
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"token_type": "Bearer", "access_token": "token", "expires_in": 3600}`)
+	}))
+	defer proxy.Close()
+
+	settings := serverSettings{
+		Server: config.Server{
+			AzDoClient: azdo.AzDoClient{Name: "s1", Address: "https://azdo.internal"},
+			Auth:       config.Auth{Method: config.AuthMethodClientSecret, TenantID: "tenant", ClientID: "client", ClientSecret: "secret", AuthorityHost: "http://login.example.com/"},
+			TLS:        config.TLS{ServerName: "azdo.example.com"},
+		},
+		proxy: config.Proxy{URL: proxy.URL},
+	}
+	s, err := newServer(context.Background(), settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.cancel()
+
+	entraID, ok := s.client.Authenticator.(*azdo.EntraIDAuthenticator)
+	if !ok {
+		t.Fatalf("got a %T authenticator, want Entra ID", s.client.Authenticator)
+	}
+	if transport := entraID.HTTPClient.Transport.(*http.Transport); transport.TLSClientConfig != nil {
+		t.Errorf("got TLS config %+v for token requests, want the server's server name and certificates kept from Entra ID", transport.TLSClientConfig)
+	}
+	if transport := s.client.Client.Transport.(*http.Transport); transport.TLSClientConfig.ServerName != "azdo.example.com" {
+		t.Errorf("got server name %q for the server, want its TLS config", transport.TLSClientConfig.ServerName)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "https://azdo.internal/_apis/projects", nil)
+	if err := entraID.Authenticate(req); err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer token" {
+		t.Errorf("got Authorization %q, want the token requested through the proxy", got)
+	}
+}
+
+// ntlmChallenge is an NTLM challenge message with no target name and an empty target info
+func ntlmChallenge() []byte {
+	var m bytes.Buffer
+	m.WriteString("NTLMSSP\x00")
+	binary.Write(&m, binary.LittleEndian, uint32(2))          // Challenge
+	binary.Write(&m, binary.LittleEndian, [2]uint32{0, 48})   // Target name
+	binary.Write(&m, binary.LittleEndian, uint32(0x00888201)) // Unicode, NTLM, extended session security and target info
+	m.WriteString("01234567")                                 // Server challenge
+	m.Write(make([]byte, 8))
+	binary.Write(&m, binary.LittleEndian, [2]uint32{4 | 4<<16, 48}) // Target info
+	m.Write(make([]byte, 4))                                        // End of the target info
+	return m.Bytes()
+}
+
+func TestNTLMHandshakeThroughTheProxy(t *testing.T) {
+	var messages []byte
+
+	// The proxy answers as the server itself, as a plain HTTP request to a proxy is for the absolute URL
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host != "azdo.internal" {
+			t.Errorf("unexpected request to %v through the proxy", r.URL)
+		}
+
+		authorization := r.Header.Get("Authorization")
+		if !strings.HasPrefix(authorization, "NTLM ") {
+			if authorization != "" {
+				t.Errorf("got Authorization %q, want the credentials only sent with NTLM", authorization)
+			}
+			w.Header().Set("WWW-Authenticate", "NTLM")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		message, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(authorization, "NTLM "))
+		if err != nil || len(message) < 12 || string(message[:8]) != "NTLMSSP\x00" {
+			t.Errorf("got Authorization %q, want an NTLM message", authorization)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		messageType := message[8]
+		messages = append(messages, messageType)
+
+		switch messageType {
+		case 1: // Negotiate
+			w.Header().Set("WWW-Authenticate", "NTLM "+base64.StdEncoding.EncodeToString(ntlmChallenge()))
+			w.WriteHeader(http.StatusUnauthorized)
+		case 3: // Authenticate
+			if !bytes.Contains(message, []byte("u\x00s\x00e\x00r\x00")) {
+				t.Error("the authenticate message isn't for the configured user")
+			}
+			fmt.Fprint(w, `{"count": 0, "value": []}`)
+		}
+	}))
+	defer proxy.Close()
+
+	settings := serverSettings{
+		Server: config.Server{
+			AzDoClient: azdo.AzDoClient{Name: "s1", Address: "http://azdo.internal/tfs", DefaultCollection: "dc"},
+			Auth:       config.Auth{Method: config.AuthMethodNTLM, Username: `DOMAIN\user`, Password: "password"},
+		},
+		proxy: config.Proxy{URL: proxy.URL},
+	}
+	s, err := newServer(context.Background(), settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.cancel()
+
+	if _, err := s.client.Projects(); err != nil {
+		t.Fatalf("the request failed after the handshake - %v", err)
+	}
+	if !bytes.Equal(messages, []byte{1, 3}) {
+		t.Errorf("got NTLM messages %v, want negotiate then authenticate", messages)
+	}
+}
@@ -0,0 +1,313 @@
+package azdo
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-ntlmssp"
+)
+
+const (
+	// AzureDevOpsScope is the scope of the Azure DevOps resource in Entra ID
+	AzureDevOpsScope = "499b84ac-1321-427f-aa17-267ca6975798/.default"
+
+	// DefaultAuthorityHost is used when neither the config or AZURE_AUTHORITY_HOST sets one
+	DefaultAuthorityHost = "https://login.microsoftonline.com/"
+
+	clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+	// Tokens are refreshed this long before they expire so a request never goes out with an expired token
+	tokenRefreshMargin = 5 * time.Minute
+
+	// A token request which takes longer than this fails, so a hung authority doesn't hold up every request waiting for the token
+	tokenRequestTimeout = 30 * time.Second
+)
+
+// Authenticator adds credentials to requests made to Azure DevOps
+type Authenticator interface {
+	Authenticate(req *http.Request) error
+}
+
+// PATAuthenticator authenticates with a Personal Access Token
+type PATAuthenticator struct {
+	AccessToken SecretProvider
+}
+
+func (a PATAuthenticator) Authenticate(req *http.Request) error {
+	accessToken, err := a.AccessToken.Secret()
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("", accessToken)
+	return nil
+}
+
+// NTLMAuthenticator authenticates with Windows credentials against Azure DevOps Server.
+// The username can include the domain, e.g. DOMAIN\user. The client's transport must be wrapped with NTLMTransport
+// which turns the credentials into an NTLM handshake.
+type NTLMAuthenticator struct {
+	Username string
+	Password string
+}
+
+func (a NTLMAuthenticator) Authenticate(req *http.Request) error {
+	req.SetBasicAuth(a.Username, a.Password)
+	return nil
+}
+
+// NTLMTransport negotiates NTLM on each connection of the transport given when the server asks for it.
+// The transport can use a proxy as the handshake happens with the server through the proxy.
+func NTLMTransport(rt http.RoundTripper) http.RoundTripper {
+	return ntlmssp.Negotiator{RoundTripper: rt}
+}
+
+// EntraIDAuthenticator authenticates as a service principal or managed identity using the OAuth client credentials flow.
+// Tokens are cached and only requested again when they are close to expiring.
+type EntraIDAuthenticator struct {
+	TenantID      string
+	ClientID      string
+	AuthorityHost string
+	HTTPClient    *http.Client // Used to request tokens. Uses the same proxy as the AzDoClient's client but not its TLS settings
+
+	// credentials adds the client_secret or client_assertion to a token request
+	credentials func(tokenURL string) (url.Values, error)
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// NewClientSecretAuthenticator authenticates as a service principal with a client secret
+func NewClientSecretAuthenticator(tenantID, clientID string, clientSecret SecretProvider) *EntraIDAuthenticator {
+	return &EntraIDAuthenticator{
+		TenantID: tenantID,
+		ClientID: clientID,
+		credentials: func(string) (url.Values, error) {
+			secret, err := clientSecret.Secret()
+			if err != nil {
+				return nil, err
+			}
+			return url.Values{"client_secret": {secret}}, nil
+		},
+	}
+}
+
+// NewClientCertificateAuthenticator authenticates as a service principal with a certificate.
+// The file must be PEM encoded and contain both the certificate and its unencrypted RSA private key.
+func NewClientCertificateAuthenticator(tenantID, clientID, certificateFile string) (*EntraIDAuthenticator, error) {
+	cert, key, err := loadCertificate(certificateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// x5t is how Entra ID finds which of the service principal's certificates signed the assertion
+	thumbprint := sha1.Sum(cert.Raw)
+	x5t := base64.RawURLEncoding.EncodeToString(thumbprint[:])
+
+	return &EntraIDAuthenticator{
+		TenantID: tenantID,
+		ClientID: clientID,
+		credentials: func(tokenURL string) (url.Values, error) {
+			assertion, err := signedAssertion(clientID, tokenURL, x5t, key)
+			if err != nil {
+				return nil, err
+			}
+			return url.Values{"client_assertion_type": {clientAssertionType}, "client_assertion": {assertion}}, nil
+		},
+	}, nil
+}
+
+// NewWorkloadIdentityAuthenticator authenticates with a federated token, such as one projected into a Kubernetes pod by Azure Workload Identity.
+// The token file is read again each time a token is requested as it's rotated.
+func NewWorkloadIdentityAuthenticator(tenantID, clientID, tokenFile string) *EntraIDAuthenticator {
+	return &EntraIDAuthenticator{
+		TenantID: tenantID,
+		ClientID: clientID,
+		credentials: func(string) (url.Values, error) {
+			assertion, err := ioutil.ReadFile(tokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("Could not read federated token file %v - %v", tokenFile, err)
+			}
+			return url.Values{"client_assertion_type": {clientAssertionType}, "client_assertion": {strings.TrimSpace(string(assertion))}}, nil
+		},
+	}
+}
+
+func (a *EntraIDAuthenticator) Authenticate(req *http.Request) error {
+	token, err := a.Token(req.Context())
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// Token returns the cached access token, requesting a new one if it has expired or is about to.
+// Cancelling ctx, e.g. when the exporter shuts down, cancels the request for a new token.
+func (a *EntraIDAuthenticator) Token(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token != "" && time.Now().Add(tokenRefreshMargin).Before(a.expiry) {
+		return a.token, nil
+	}
+
+	token, expiry, err := a.requestToken(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	a.token = token
+	a.expiry = expiry
+	return a.token, nil
+}
+
+func (a *EntraIDAuthenticator) requestToken(ctx context.Context) (string, time.Time, error) {
+	authorityHost := a.AuthorityHost
+	if authorityHost == "" {
+		authorityHost = DefaultAuthorityHost
+	}
+	tokenURL := strings.TrimSuffix(authorityHost, "/") + "/" + url.PathEscape(a.TenantID) + "/oauth2/v2.0/token"
+
+	form, err := a.credentials(tokenURL)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", a.ClientID)
+	form.Set("scope", AzureDevOpsScope)
+
+	client := a.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, tokenRequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Could not generate request for token from %v - %v", tokenURL, err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	requested := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Call to %v failed: %v", tokenURL, err)
+	}
+	defer resp.Body.Close()
+
+	responseData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Failed to read body %v", err)
+	}
+
+	var tr struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(responseData, &tr); err != nil {
+		return "", time.Time{}, fmt.Errorf("Failed to convert to JSON - %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK || tr.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("Could not get token for client %v from %v - %v %v", a.ClientID, tokenURL, tr.Error, tr.ErrorDescription)
+	}
+
+	return tr.AccessToken, requested.Add(time.Duration(tr.ExpiresIn) * time.Second), nil
+}
+
+// signedAssertion creates the JWT which proves the service principal holds the certificate's private key
+func signedAssertion(clientID, audience, x5t string, key *rsa.PrivateKey) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "x5t": x5t})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": audience,
+		"iss": clientID,
+		"sub": clientID,
+		"jti": hex.EncodeToString(jti),
+		"nbf": now.Unix(),
+		"iat": now.Unix(),
+		"exp": now.Add(10 * time.Minute).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("Could not sign client assertion - %v", err)
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func loadCertificate(certificateFile string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(certificateFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not read certificate file %v - %v", certificateFile, err)
+	}
+
+	var (
+		cert *x509.Certificate
+		key  *rsa.PrivateKey
+	)
+
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case "CERTIFICATE":
+			if cert == nil { // The first certificate is the leaf, any others are the chain
+				cert, err = x509.ParseCertificate(block.Bytes)
+			}
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			var k interface{}
+			k, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+			if rsaKey, ok := k.(*rsa.PrivateKey); ok {
+				key = rsaKey
+			} else if err == nil {
+				err = fmt.Errorf("private key is not an RSA key")
+			}
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not parse certificate file %v - %v", certificateFile, err)
+		}
+	}
+
+	if cert == nil || key == nil {
+		return nil, nil, fmt.Errorf("Certificate file %v must contain a PEM encoded certificate and RSA private key", certificateFile)
+	}
+
+	return cert, key, nil
+}
@@ -0,0 +1,237 @@
+package azdo
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tokenServer is an Entra ID token endpoint which passes on the form of each token request
+func tokenServer(t *testing.T, expiresIn int) (*httptest.Server, <-chan url.Values) {
+	requests := make(chan url.Values, 10)
+	var mu sync.Mutex
+	issued := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/tenant/oauth2/v2.0/token" {
+			t.Errorf("token requested from %v", r.URL)
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		requests <- r.PostForm
+
+		if r.PostForm.Get("client_id") == "unknown" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "unauthorized_client", "error_description": "AADSTS700016: Application not found"}`)
+			return
+		}
+
+		mu.Lock()
+		issued++
+		token := fmt.Sprintf("token%d", issued)
+		mu.Unlock()
+		fmt.Fprintf(w, `{"token_type": "Bearer", "access_token": %q, "expires_in": %d}`, token, expiresIn)
+	}))
+	return server, requests
+}
+
+// writeCertificate writes a self-signed certificate and its private key to a PEM file
+func writeCertificate(t *testing.T) (string, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "azdo-exporter"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})...)
+	path := filepath.Join(t.TempDir(), "client.pem")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, cert
+}
+
+func decodeSegment(t *testing.T, segment string, v interface{}) {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientCertificateAssertion(t *testing.T) {
+	server, requests := tokenServer(t, 3600)
+	defer server.Close()
+	certificateFile, cert := writeCertificate(t)
+
+	a, err := NewClientCertificateAuthenticator("tenant", "client", certificateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.AuthorityHost = server.URL
+	if _, err := a.Token(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	form := <-requests
+	for key, want := range map[string]string{
+		"grant_type":            "client_credentials",
+		"client_id":             "client",
+		"scope":                 AzureDevOpsScope,
+		"client_assertion_type": clientAssertionType,
+	} {
+		if form.Get(key) != want {
+			t.Errorf("%v = %q, want %q", key, form.Get(key), want)
+		}
+	}
+
+	parts := strings.Split(form.Get("client_assertion"), ".")
+	if len(parts) != 3 {
+		t.Fatalf("the assertion has %v parts, want 3", len(parts))
+	}
+
+	var header map[string]string
+	decodeSegment(t, parts[0], &header)
+	thumbprint := sha1.Sum(cert.Raw)
+	if header["alg"] != "RS256" || header["typ"] != "JWT" || header["x5t"] != base64.RawURLEncoding.EncodeToString(thumbprint[:]) {
+		t.Errorf("got header %v, want RS256 with the certificate's thumbprint", header)
+	}
+
+	var claims struct {
+		Aud string `json:"aud"`
+		Iss string `json:"iss"`
+		Sub string `json:"sub"`
+		Jti string `json:"jti"`
+		Nbf int64  `json:"nbf"`
+		Exp int64  `json:"exp"`
+	}
+	decodeSegment(t, parts[1], &claims)
+	if claims.Aud != server.URL+"/tenant/oauth2/v2.0/token" || claims.Iss != "client" || claims.Sub != "client" || claims.Jti == "" {
+		t.Errorf("got claims %+v, want the token URL as the audience and the client as the issuer and subject", claims)
+	}
+	if lifetime := time.Duration(claims.Exp-claims.Nbf) * time.Second; lifetime != 10*time.Minute {
+		t.Errorf("the assertion is valid for %v, want 10m", lifetime)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(cert.PublicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], signature); err != nil {
+		t.Errorf("the assertion isn't signed by the certificate's key - %v", err)
+	}
+}
+
+func TestTokenIsCachedAndRefreshed(t *testing.T) {
+	server, requests := tokenServer(t, 3600)
+	defer server.Close()
+
+	a := NewClientSecretAuthenticator("tenant", "client", StaticSecret("secret"))
+	a.AuthorityHost = server.URL
+
+	req := httptest.NewRequest("GET", "https://dev.azure.com/org/_apis/projects", nil)
+	if err := a.Authenticate(req); err != nil {
+		t.Fatal(err)
+	}
+	if auth := req.Header.Get("Authorization"); auth != "Bearer token1" {
+		t.Errorf("Authorization header = %q, want the token", auth)
+	}
+	if form := <-requests; form.Get("client_secret") != "secret" {
+		t.Errorf("client_secret = %q, want the secret", form.Get("client_secret"))
+	}
+
+	// The token is reused while it's valid for longer than the refresh margin
+	if token, err := a.Token(context.Background()); err != nil || token != "token1" {
+		t.Errorf("got %q %v, want the cached token", token, err)
+	}
+	if len(requests) != 0 {
+		t.Error("a token was requested while the cached one was still valid")
+	}
+
+	a.mu.Lock()
+	a.expiry = time.Now().Add(tokenRefreshMargin - time.Second)
+	a.mu.Unlock()
+
+	if token, err := a.Token(context.Background()); err != nil || token != "token2" {
+		t.Errorf("got %q %v, want a new token once the cached one was about to expire", token, err)
+	}
+	if len(requests) != 1 {
+		t.Errorf("%v tokens were requested, want 1", len(requests))
+	}
+}
+
+func TestTokenRequestFails(t *testing.T) {
+	server, _ := tokenServer(t, 3600)
+	defer server.Close()
+
+	a := NewClientSecretAuthenticator("tenant", "unknown", StaticSecret("secret"))
+	a.AuthorityHost = server.URL
+
+	_, err := a.Token(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "Application not found") {
+		t.Errorf("got %v, want Entra ID's error", err)
+	}
+}
+
+func TestTokenRequestIsCancelled(t *testing.T) {
+	blocked := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The connection is only watched for the client going away once the body is read
+		r.ParseForm()
+		<-r.Context().Done()
+		close(blocked)
+	}))
+	defer server.Close()
+
+	a := NewClientSecretAuthenticator("tenant", "client", StaticSecret("secret"))
+	a.AuthorityHost = server.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := a.Token(ctx); err == nil {
+		t.Error("the token request succeeded, want it cancelled")
+	}
+	if waited := time.Since(start); waited > 5*time.Second {
+		t.Errorf("the token request took %v to be cancelled", waited)
+	}
+	<-blocked
+}
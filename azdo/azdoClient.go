@@ -1,10 +1,14 @@
 package azdo
 
 import (
+	"context"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	neturl "net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -15,11 +19,15 @@ import (
 )
 
 type AzDoClient struct {
-	Client            *http.Client
+	Client            *http.Client `json:"-"`
 	Name              string
 	Address           string
 	DefaultCollection string
 	AccessToken       string
+	ReleaseAddress    string          // Optional. Derived from Address when not set
+	Authenticator     Authenticator   `json:"-"` // Optional. AccessToken is used as a PAT when not set
+	Observer          RequestObserver `json:"-"` // Optional. Told about every request for self-instrumentation
+	Context           context.Context `json:"-"` // Optional. Cancelling it cancels in-flight requests and their retries
 }
 
 func (az *AzDoClient) Agents(poolID int) ([]Agent, error) {
@@ -31,7 +39,6 @@ func (az *AzDoClient) Agents(poolID int) ([]Agent, error) {
 	if err != nil {
 		return []Agent{}, fmt.Errorf("Could not generate request to find all agents in poolID %v - %v", poolID, err)
 	}
-	req.SetBasicAuth("", az.AccessToken)
 
 	// Make request
 	responseData, err := az.makeRequest(req)
@@ -65,7 +72,6 @@ func (az *AzDoClient) Pools(ignoreHosted bool) ([]Pool, error) {
 	if err != nil {
 		return []Pool{}, fmt.Errorf("Could not generate request to find all agent pools %v", err)
 	}
-	req.SetBasicAuth("", az.AccessToken)
 
 	//Make request
 	responseData, err := az.makeRequest(req)
@@ -102,7 +108,6 @@ func (az *AzDoClient) CurrentJobs(poolID int) ([]Job, error) {
 	if err != nil {
 		return []Job{}, fmt.Errorf("Could not generate request to find all queued jobs %v", err)
 	}
-	req.SetBasicAuth("", az.AccessToken)
 
 	// Make request
 	responseData, err := az.makeRequest(req)
@@ -129,7 +134,6 @@ func (az *AzDoClient) JobsAfter(poolID int, after time.Time) (finishedJobs, curr
 	if err != nil {
 		return []Job{}, []Job{}, fmt.Errorf("Could not generate request to find all queued jobs %v", err)
 	}
-	req.SetBasicAuth("", az.AccessToken)
 
 	// Make request
 	responseData, err := az.makeRequest(req)
@@ -150,68 +154,463 @@ func (az *AzDoClient) JobsAfter(poolID int, after time.Time) (finishedJobs, curr
 			continue
 		}
 
-		if !after.IsZero() {
-			if job.FinishTime.After(after) {
-				finishedJobs = append(finishedJobs, job)
-			}
+		if finishedAfter(job.FinishTime, after) {
+			finishedJobs = append(finishedJobs, job)
 		}
 	}
 
 	return finishedJobs, currentJobs, nil
 }
 
+// ConnectionData returns who the client is authenticated as. Used to check the server can be reached and the credentials are accepted
+func (az *AzDoClient) ConnectionData() (ConnectionData, error) {
+
+	// Build request
+	var url = az.buildURL("/_apis/connectionData")
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return ConnectionData{}, fmt.Errorf("Could not generate request for connection data %v", err)
+	}
+
+	// Make request
+	responseData, err := az.makeRequest(req)
+	if err != nil {
+		return ConnectionData{}, err
+	}
+
+	// Turn response into type from JSON
+	cd := ConnectionData{}
+	err = json.Unmarshal(responseData, &cd)
+	if err != nil {
+		return ConnectionData{}, fmt.Errorf("Failed to convert to JSON - %v", err)
+	}
+
+	return cd, nil
+}
+
+// Projects returns every project, in pages of up to 1000
+func (az *AzDoClient) Projects() ([]Project, error) {
+
+	var projects []Project
+	url := az.buildURL("/_apis/projects?stateFilter=wellFormed&$top=1000")
+	err := az.makePagedRequest(url, "all projects", func(responseData []byte) error {
+		pre := projectResponseEnvelope{}
+		if err := json.Unmarshal(responseData, &pre); err != nil {
+			return fmt.Errorf("Failed to convert to JSON - %v", err)
+		}
+		projects = append(projects, pre.Projects...)
+		return nil
+	})
+	if err != nil {
+		return []Project{}, err
+	}
+
+	return projects, nil
+}
+
+// ActiveBuilds returns the builds in a project which have been queued but not yet completed.
+// This includes builds waiting on approvals and checks which never show up as job requests in a pool.
+func (az *AzDoClient) ActiveBuilds(projectID string) ([]Build, error) {
+
+	var activeBuilds []Build
+	url := az.buildURL("/" + projectID + "/_apis/build/builds?statusFilter=notStarted,inProgress&$top=1000&api-version=6.0")
+	err := az.makePagedRequest(url, "active builds in project "+projectID, func(responseData []byte) error {
+		bre := buildResponseEnvelope{}
+		if err := json.Unmarshal(responseData, &bre); err != nil {
+			return fmt.Errorf("Failed to convert to JSON - %v", err)
+		}
+		activeBuilds = append(activeBuilds, bre.Builds...)
+		return nil
+	})
+	if err != nil {
+		return []Build{}, err
+	}
+
+	return activeBuilds, nil
+}
+
+// DeploymentsAfter returns the classic release deployments in a project which are in progress,
+// along with those which completed after the time given
+func (az *AzDoClient) DeploymentsAfter(projectID string, after time.Time) (finishedDeployments, currentDeployments []Deployment, err error) {
+
+	currentDeployments, err = az.deployments(projectID, "deploymentStatus=inProgress")
+	if err != nil {
+		return []Deployment{}, []Deployment{}, err
+	}
+
+	// Nothing can have finished since the last scrape if this is the first
+	if after.IsZero() {
+		return []Deployment{}, currentDeployments, nil
+	}
+
+	recentDeployments, err := az.deployments(projectID, "deploymentStatus=all&queryOrder=descending&minModifiedTime="+neturl.QueryEscape(after.UTC().Format(time.RFC3339)))
+	if err != nil {
+		return []Deployment{}, []Deployment{}, err
+	}
+
+	for _, deployment := range recentDeployments {
+		if finishedAfter(deployment.CompletedOn, after) {
+			finishedDeployments = append(finishedDeployments, deployment)
+		}
+	}
+
+	return finishedDeployments, currentDeployments, nil
+}
+
+func (az *AzDoClient) deployments(projectID string, query string) ([]Deployment, error) {
+
+	var deployments []Deployment
+	url := az.buildReleaseURL("/" + projectID + "/_apis/release/deployments?" + query + "&$top=100")
+	err := az.makePagedRequest(url, "deployments in project "+projectID, func(responseData []byte) error {
+		dre := deploymentResponseEnvelope{}
+		if err := json.Unmarshal(responseData, &dre); err != nil {
+			return fmt.Errorf("Failed to convert to JSON - %v", err)
+		}
+		deployments = append(deployments, dre.Deployments...)
+		return nil
+	})
+	if err != nil {
+		return []Deployment{}, err
+	}
+
+	return deployments, nil
+}
+
+// PendingApprovals returns the classic release approvals in a project which are waiting on an approver
+func (az *AzDoClient) PendingApprovals(projectID string) ([]Approval, error) {
+
+	var approvals []Approval
+	url := az.buildReleaseURL("/" + projectID + "/_apis/release/approvals?statusFilter=pending&$top=100")
+	err := az.makePagedRequest(url, "pending approvals in project "+projectID, func(responseData []byte) error {
+		are := approvalResponseEnvelope{}
+		if err := json.Unmarshal(responseData, &are); err != nil {
+			return fmt.Errorf("Failed to convert to JSON - %v", err)
+		}
+		approvals = append(approvals, are.Approvals...)
+		return nil
+	})
+	if err != nil {
+		return []Approval{}, err
+	}
+
+	return approvals, nil
+}
+
+// Pipelines returns the YAML pipelines in a project
+func (az *AzDoClient) Pipelines(projectID string) ([]Pipeline, error) {
+
+	var pipelines []Pipeline
+	url := az.buildURL("/" + projectID + "/_apis/pipelines?$top=1000&api-version=6.0-preview.1")
+	err := az.makePagedRequest(url, "pipelines in project "+projectID, func(responseData []byte) error {
+		pre := pipelineResponseEnvelope{}
+		if err := json.Unmarshal(responseData, &pre); err != nil {
+			return fmt.Errorf("Failed to convert to JSON - %v", err)
+		}
+		pipelines = append(pipelines, pre.Pipelines...)
+		return nil
+	})
+	if err != nil {
+		return []Pipeline{}, err
+	}
+
+	return pipelines, nil
+}
+
+// FinishedRunsAfter returns the runs of a pipeline which finished after the time given.
+// The runs API can't be filtered, it returns the pipeline's latest runs, so those which haven't finished since are filtered out here.
+func (az *AzDoClient) FinishedRunsAfter(projectID string, pipelineID int, after time.Time) ([]Run, error) {
+
+	// Nothing can have finished since the last scrape if this is the first
+	if after.IsZero() {
+		return []Run{}, nil
+	}
+
+	// Build request
+	var url = az.buildURL("/" + projectID + "/_apis/pipelines/" + strconv.Itoa(pipelineID) + "/runs?api-version=6.0-preview.1")
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return []Run{}, fmt.Errorf("Could not generate request to find runs of pipeline %v - %v", pipelineID, err)
+	}
+
+	// Make request
+	responseData, err := az.makeRequest(req)
+	if err != nil {
+		return []Run{}, err
+	}
+
+	// Turn response into type from JSON
+	rre := runResponseEnvelope{}
+	if err := json.Unmarshal(responseData, &rre); err != nil {
+		return []Run{}, fmt.Errorf("Failed to convert to JSON - %v", err)
+	}
+
+	var finishedRuns []Run
+	for _, run := range rre.Runs {
+		if run.State == "completed" && finishedAfter(run.FinishedDate, after) {
+			finishedRuns = append(finishedRuns, run)
+		}
+	}
+
+	return finishedRuns, nil
+}
+
+// Timeline returns the stages, jobs and checkpoints of a run.
+// The pipelines API has no timelines, but runs of YAML pipelines are builds with the same ID, so the timeline comes from the build API.
+func (az *AzDoClient) Timeline(projectID string, runID int) ([]TimelineRecord, error) {
+
+	// Build request
+	var url = az.buildURL("/" + projectID + "/_apis/build/builds/" + strconv.Itoa(runID) + "/timeline")
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return []TimelineRecord{}, fmt.Errorf("Could not generate request to find timeline of run %v - %v", runID, err)
+	}
+
+	// Make request
+	responseData, err := az.makeRequest(req)
+	if err != nil {
+		return []TimelineRecord{}, err
+	}
+
+	// Turn response into type from JSON
+	timeline := Timeline{}
+	err = json.Unmarshal(responseData, &timeline)
+	if err != nil {
+		return []TimelineRecord{}, fmt.Errorf("Failed to convert to JSON - %v", err)
+	}
+
+	return timeline.Records, nil
+}
+
+// finishedAfter is used to only return what has finished since the last scrape so it's only observed once.
+// Nothing is returned on the first scrape (after is zero) as there is no previous scrape to measure from.
+func finishedAfter(finish time.Time, after time.Time) bool {
+	if after.IsZero() || finish.IsZero() {
+		return false
+	}
+	return finish.After(after)
+}
+
+// makePagedRequest requests every page of a list, passing the body of each page to page.
+// Azure DevOps returns a continuation token while there are more, which is sent back to get the next page.
+func (az *AzDoClient) makePagedRequest(url string, description string, page func(responseData []byte) error) error {
+
+	var continuationToken string
+	for {
+		// Build request
+		pageURL := url
+		if continuationToken != "" {
+			pageURL += "&continuationToken=" + neturl.QueryEscape(continuationToken)
+		}
+
+		req, err := http.NewRequest("GET", pageURL, nil)
+		if err != nil {
+			return fmt.Errorf("Could not generate request to find %v - %v", description, err)
+		}
+
+		// Make request
+		responseData, header, err := az.makeRequestWithHeader(req)
+		if err != nil {
+			return err
+		}
+
+		if err := page(responseData); err != nil {
+			return err
+		}
+
+		continuationToken = header.Get("x-ms-continuationtoken")
+		if continuationToken == "" {
+			return nil
+		}
+	}
+}
+
 func (az *AzDoClient) makeRequest(req *http.Request) ([]byte, error) {
+	responseData, _, err := az.makeRequestWithHeader(req)
+	return responseData, err
+}
+
+// makeRequestWithHeader is makeRequest which also returns the headers of the response, e.g. for continuation tokens
+func (az *AzDoClient) makeRequestWithHeader(req *http.Request) ([]byte, http.Header, error) {
 
 	var (
 		responseData []byte
+		header       http.Header
 		err          error
 	)
 
-	b := backoff.NewExponentialBackOff()
-	b.MaxElapsedTime = 30 * time.Second
+	ctx := az.context()
+	req = req.WithContext(ctx)
+
+	eb := backoff.NewExponentialBackOff()
+	eb.MaxElapsedTime = 30 * time.Second
+	b := backoff.WithContext(eb, ctx)
+
+	route := RouteTemplate(req.URL)
 
 	notify := func(err error, ti time.Duration) {
 		log.WithFields(log.Fields{"serverName": az.Name, "URL": req.URL, "error": err}).Warning("Retrying HTTP request")
+		if az.Observer != nil {
+			az.Observer.ObserveRetry(route)
+		}
 	}
 
 	retry := func() error {
-		responseData, err = az.makeHTTPRequest(req)
+		responseData, header, err = az.makeHTTPRequest(req)
 		return err
 	}
 
+	start := time.Now()
 	e := backoff.RetryNotify(retry, b, notify)
+	if az.Observer != nil {
+		az.Observer.ObserveCall(route, time.Since(start), e)
+	}
 	if e != nil {
-		return []byte{}, e
+		return []byte{}, nil, e
 	}
 
-	return responseData, nil
+	return responseData, header, nil
 }
 
-func (az *AzDoClient) makeHTTPRequest(req *http.Request) ([]byte, error) {
+func (az *AzDoClient) makeHTTPRequest(req *http.Request) ([]byte, http.Header, error) {
+
+	// Authenticate on every attempt so a retry picks up a refreshed token
+	if err := az.authenticate(req); err != nil {
+		return []byte{}, nil, fmt.Errorf("Could not authenticate request to %v: %v", req.URL, err)
+	}
 
 	// Send request
+	start := time.Now()
 	resp, err := az.Client.Do(req)
 	if err != nil {
-		return []byte{}, fmt.Errorf("Call to %v failed: %v", req.URL, err)
+		az.observeRequest(req, 0, time.Since(start), 0)
+		if req.Context().Err() != nil {
+			// The exporter is shutting down or the server was removed from the config
+			return []byte{}, nil, backoff.Permanent(fmt.Errorf("Call to %v cancelled: %v", req.URL, req.Context().Err()))
+		}
+		if isCertificateError(err) {
+			// Retrying won't help, the CA or server name in the config needs changing
+			log.WithFields(log.Fields{"serverName": az.Name, "URL": req.URL, "error": err}).Error("TLS verification of the server's certificate failed. Check caFile and serverName in the tls config for this server")
+			return []byte{}, nil, backoff.Permanent(fmt.Errorf("Call to %v failed TLS verification: %v", req.URL, err))
+		}
+		return []byte{}, nil, fmt.Errorf("Call to %v failed: %v", req.URL, err)
 	}
 	defer resp.Body.Close()
 	log.WithFields(log.Fields{"serverName": az.Name, "URL": req.URL, "StatusCode": resp.StatusCode}).Trace("Made HTTP request")
 
+	// Azure DevOps responds with 203 and a sign in page when the credentials aren't accepted
+	if resp.StatusCode < 200 || resp.StatusCode > 299 || resp.StatusCode == http.StatusNonAuthoritativeInfo {
+		az.observeRequest(req, resp.StatusCode, time.Since(start), 0)
+		statusErr := &StatusError{URL: req.URL.String(), StatusCode: resp.StatusCode, Status: resp.Status}
+		if statusErr.Permanent() {
+			return []byte{}, nil, backoff.Permanent(statusErr)
+		}
+		return []byte{}, nil, statusErr
+	}
+
 	// Read body of response
 	responseData, err := ioutil.ReadAll(resp.Body)
+	az.observeRequest(req, resp.StatusCode, time.Since(start), len(responseData))
 	if err != nil {
-		return []byte{}, fmt.Errorf("Failed to read body %v", err)
+		return []byte{}, nil, fmt.Errorf("Failed to read body %v", err)
+	}
+
+	return responseData, resp.Header, nil
+}
+
+func (az *AzDoClient) observeRequest(req *http.Request, statusCode int, duration time.Duration, size int) {
+	if az.Observer != nil {
+		az.Observer.ObserveRequest(RouteTemplate(req.URL), statusCode, duration, size)
+	}
+}
+
+// StatusError is returned when Azure DevOps responds with anything other than a 2xx status code
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Call to %v returned %v", e.URL, e.Status)
+}
+
+// Unauthorised is true when the credentials weren't accepted or don't have the permissions (scopes) needed
+func (e *StatusError) Unauthorised() bool {
+	return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden || e.StatusCode == http.StatusNonAuthoritativeInfo
+}
+
+// Permanent is true when retrying the request will get the same response
+func (e *StatusError) Permanent() bool {
+	return e.StatusCode < 500 && e.StatusCode != http.StatusTooManyRequests && e.StatusCode != http.StatusRequestTimeout
+}
+
+func isCertificateError(err error) bool {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		invalid          x509.CertificateInvalidError
+		hostname         x509.HostnameError
+	)
+	return errors.As(err, &unknownAuthority) || errors.As(err, &invalid) || errors.As(err, &hostname)
+}
+
+func (az *AzDoClient) context() context.Context {
+	if az.Context != nil {
+		return az.Context
 	}
+	return context.Background()
+}
 
-	return responseData, nil
+func (az *AzDoClient) authenticate(req *http.Request) error {
+	if az.Authenticator != nil {
+		return az.Authenticator.Authenticate(req)
+	}
+	return PATAuthenticator{AccessToken: StaticSecret(az.AccessToken)}.Authenticate(req)
 }
 
 func (az *AzDoClient) buildURL(url string) string {
+	return joinURL(az.Address, az.DefaultCollection, url)
+}
+
+// buildReleaseURL builds a URL for the Release Management (vsrm) service
+func (az *AzDoClient) buildReleaseURL(url string) string {
+	return joinURL(az.releaseAddress(), az.DefaultCollection, url)
+}
+
+// releaseAddress returns the address of the Release Management service.
+// Azure DevOps serves it from a separate vsrm host whereas Azure DevOps Server serves it from the same address.
+func (az *AzDoClient) releaseAddress() string {
+	if az.ReleaseAddress != "" {
+		return az.ReleaseAddress
+	}
+
+	u, err := neturl.Parse(az.Address)
+	if err != nil {
+		return az.Address
+	}
+
+	host := strings.ToLower(u.Hostname())
+	switch {
+	case host == "dev.azure.com":
+		// https://dev.azure.com/org -> https://vsrm.dev.azure.com/org
+		u.Host = strings.Replace(u.Host, u.Hostname(), "vsrm.dev.azure.com", 1)
+	case strings.HasSuffix(host, ".visualstudio.com") && !strings.HasSuffix(host, ".vsrm.visualstudio.com"):
+		// https://org.visualstudio.com -> https://org.vsrm.visualstudio.com
+		org := strings.TrimSuffix(host, ".visualstudio.com")
+		u.Host = strings.Replace(u.Host, u.Hostname(), org+".vsrm.visualstudio.com", 1)
+	}
+
+	return strings.TrimSuffix(u.String(), "/")
+}
+
+func joinURL(address string, collection string, url string) string {
 	var baseURL string
-	if az.DefaultCollection != "" {
-		baseURL = az.Address + "/" + az.DefaultCollection
+	if collection != "" {
+		baseURL = address + "/" + collection
 	} else {
-		baseURL = az.Address
+		baseURL = address
 	}
 
 	if !strings.HasPrefix(url, "/") {
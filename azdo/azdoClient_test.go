@@ -0,0 +1,171 @@
+package azdo
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// pagedServer serves a list in pages of one item, returning a continuation token while there are more
+func pagedServer(t *testing.T, path string, items []string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			t.Errorf("unexpected request to %v", r.URL)
+			http.NotFound(w, r)
+			return
+		}
+
+		page := 0
+		if token := r.URL.Query().Get("continuationToken"); token != "" {
+			fmt.Sscanf(token, "page%d", &page)
+		}
+		if page+1 < len(items) {
+			w.Header().Set("x-ms-continuationtoken", fmt.Sprintf("page%d", page+1))
+		}
+		fmt.Fprintf(w, `{"count": 1, "value": [%v]}`, items[page])
+	}))
+}
+
+func TestProjectsPages(t *testing.T) {
+	server := pagedServer(t, "/coll/_apis/projects", []string{`{"id": "1"}`, `{"id": "2"}`, `{"id": "3"}`})
+	defer server.Close()
+
+	az := AzDoClient{Client: server.Client(), Address: server.URL, DefaultCollection: "coll", AccessToken: "token"}
+	projects, err := az.Projects()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(projects) != 3 || projects[0].ID != "1" || projects[2].ID != "3" {
+		t.Errorf("got projects %+v, want every page's", projects)
+	}
+}
+
+func TestActiveBuildsPages(t *testing.T) {
+	server := pagedServer(t, "/coll/project/_apis/build/builds", []string{`{"id": 1}`, `{"id": 2}`, `{"id": 3}`})
+	defer server.Close()
+
+	az := AzDoClient{Client: server.Client(), Address: server.URL, DefaultCollection: "coll", AccessToken: "token"}
+	builds, err := az.ActiveBuilds("project")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(builds) != 3 || builds[0].ID != 1 || builds[2].ID != 3 {
+		t.Errorf("got builds %+v, want every page's", builds)
+	}
+}
+
+func TestPipelinesPages(t *testing.T) {
+	server := pagedServer(t, "/coll/project/_apis/pipelines", []string{`{"id": 1}`, `{"id": 2}`, `{"id": 3}`})
+	defer server.Close()
+
+	az := AzDoClient{Client: server.Client(), Address: server.URL, DefaultCollection: "coll", AccessToken: "token"}
+	pipelines, err := az.Pipelines("project")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pipelines) != 3 || pipelines[0].ID != 1 || pipelines[2].ID != 3 {
+		t.Errorf("got pipelines %+v, want every page's", pipelines)
+	}
+}
+
+func TestFinishedRunsAfter(t *testing.T) {
+	after := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/coll/project/_apis/pipelines/3/runs" {
+			t.Errorf("unexpected request to %v", r.URL)
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"count": 4, "value": [
+			{"id": 4, "state": "inProgress"},
+			{"id": 3, "state": "completed", "finishedDate": "2026-01-01T12:00:01Z"},
+			{"id": 2, "state": "completed", "finishedDate": "2026-01-01T12:00:00Z"},
+			{"id": 1, "state": "completed", "finishedDate": "2026-01-01T11:59:00Z"}]}`)
+	}))
+	defer server.Close()
+
+	az := AzDoClient{Client: server.Client(), Address: server.URL, DefaultCollection: "coll", AccessToken: "token"}
+	runs, err := az.FinishedRunsAfter("project", 3, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].ID != 3 {
+		t.Errorf("got runs %+v, want only run 3 which finished after %v", runs, after)
+	}
+
+	// The first scrape is only the baseline, so it makes no request
+	if runs, err := az.FinishedRunsAfter("project", 3, time.Time{}); err != nil || len(runs) != 0 {
+		t.Errorf("got runs %+v and error %v for the first scrape, want none", runs, err)
+	}
+}
+
+func TestDeploymentsAfterPages(t *testing.T) {
+	server := pagedServer(t, "/coll/project/_apis/release/deployments", []string{
+		`{"id": 1, "completedOn": "2026-01-01T12:00:00Z"}`,
+		`{"id": 2, "completedOn": "2026-01-01T10:00:00Z"}`,
+		`{"id": 3, "completedOn": "2026-01-01T13:00:00Z"}`,
+	})
+	defer server.Close()
+
+	az := AzDoClient{Client: server.Client(), Address: server.URL, ReleaseAddress: server.URL, DefaultCollection: "coll", AccessToken: "token"}
+	finished, current, err := az.DeploymentsAfter("project", time.Date(2026, 1, 1, 11, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(current) != 3 {
+		t.Errorf("got %v current deployments, want every page's", len(current))
+	}
+	if len(finished) != 2 || finished[0].ID != 1 || finished[1].ID != 3 {
+		t.Errorf("got finished deployments %+v, want those from every page which finished after the time given", finished)
+	}
+}
+
+func TestPendingApprovalsPages(t *testing.T) {
+	server := pagedServer(t, "/coll/project/_apis/release/approvals", []string{`{"id": 1}`, `{"id": 2}`})
+	defer server.Close()
+
+	az := AzDoClient{Client: server.Client(), Address: server.URL, ReleaseAddress: server.URL, DefaultCollection: "coll", AccessToken: "token"}
+	approvals, err := az.PendingApprovals("project")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(approvals) != 2 {
+		t.Errorf("got approvals %+v, want every page's", approvals)
+	}
+}
+
+func TestReleaseAddress(t *testing.T) {
+	tests := []struct {
+		name           string
+		address        string
+		releaseAddress string
+		want           string
+	}{
+		{name: "azure devops", address: "https://dev.azure.com/org", want: "https://vsrm.dev.azure.com/org"},
+		{name: "azure devops with a trailing slash", address: "https://dev.azure.com/org/", want: "https://vsrm.dev.azure.com/org"},
+		{name: "azure devops in upper case", address: "https://DEV.AZURE.COM/org", want: "https://vsrm.dev.azure.com/org"},
+		{name: "azure devops with a port", address: "https://dev.azure.com:443/org", want: "https://vsrm.dev.azure.com:443/org"},
+		{name: "visualstudio.com", address: "https://org.visualstudio.com", want: "https://org.vsrm.visualstudio.com"},
+		{name: "visualstudio.com with a collection path", address: "https://org.visualstudio.com/DefaultCollection", want: "https://org.vsrm.visualstudio.com/DefaultCollection"},
+		{name: "vsrm visualstudio.com is kept", address: "https://org.vsrm.visualstudio.com", want: "https://org.vsrm.visualstudio.com"},
+		{name: "azure devops server is the same address", address: "https://tfs.example.com/tfs", want: "https://tfs.example.com/tfs"},
+		{name: "set release address", address: "https://dev.azure.com/org", releaseAddress: "https://proxy.example.com/vsrm", want: "https://proxy.example.com/vsrm"},
+		{name: "address which can't be parsed", address: "://dev.azure.com", want: "://dev.azure.com"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			az := AzDoClient{Address: test.address, ReleaseAddress: test.releaseAddress}
+			if got := az.releaseAddress(); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
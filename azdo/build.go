@@ -0,0 +1,26 @@
+package azdo
+
+import "time"
+
+type buildResponseEnvelope struct {
+	Count  int     `json:"count"`
+	Builds []Build `json:"value"`
+}
+
+type Build struct {
+	ID          int             `json:"id"`
+	BuildNumber string          `json:"buildNumber"`
+	Status      string          `json:"status"`
+	Result      string          `json:"result"`
+	Reason      string          `json:"reason"`
+	QueueTime   time.Time       `json:"queueTime"`
+	StartTime   time.Time       `json:"startTime"`
+	FinishTime  time.Time       `json:"finishTime"`
+	Definition  BuildDefinition `json:"definition"`
+	Project     Project         `json:"project"`
+}
+
+type BuildDefinition struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
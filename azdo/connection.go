@@ -0,0 +1,12 @@
+package azdo
+
+type ConnectionData struct {
+	InstanceID        string   `json:"instanceId"`
+	DeploymentType    string   `json:"deploymentType"` // hosted for Azure DevOps, onPremises for Azure DevOps Server
+	AuthenticatedUser Identity `json:"authenticatedUser"`
+}
+
+type Identity struct {
+	ID                  string `json:"id"`
+	ProviderDisplayName string `json:"providerDisplayName"`
+}
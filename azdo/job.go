@@ -8,13 +8,22 @@ type jobResponseEnvelope struct {
 }
 
 type Job struct {
-	RequestID   int       `json:"requestId"`
-	Name        string    `json:"name"`
-	QueueTime   time.Time `json:"queueTime"`
-	AssignTime  time.Time `json:"assignTime"`
-	ReceiveTime time.Time `json:"receiveTime"`
-	FinishTime  time.Time `json:"finishTime"`
-	Result      string    `json:"result"`
-	JobID       string    `json:"jobId"`
-	PlanType    string    `json:"planType"`
+	RequestID     int          `json:"requestId"`
+	Name          string       `json:"name"`
+	QueueTime     time.Time    `json:"queueTime"`
+	AssignTime    time.Time    `json:"assignTime"`
+	ReceiveTime   time.Time    `json:"receiveTime"`
+	FinishTime    time.Time    `json:"finishTime"`
+	Result        string       `json:"result"`
+	JobID         string       `json:"jobId"`
+	PlanType      string       `json:"planType"`
+	Definition    JobReference `json:"definition"`
+	Owner         JobReference `json:"owner"`
+	ReservedAgent Agent        `json:"reservedAgent"` // The agent the job was assigned to. Empty while it's queued
+}
+
+// JobReference is the definition or owner (build or release) that queued a job request
+type JobReference struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
 }
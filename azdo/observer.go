@@ -0,0 +1,46 @@
+package azdo
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// RequestObserver is told about the requests an AzDoClient makes, e.g. to record metrics about the exporter itself.
+// route is the API route template, such as /_apis/distributedtask/pools/{id}/agents, so it can be used as a label.
+type RequestObserver interface {
+	// ObserveRequest is called for each attempt at a request. statusCode is 0 if no response was received
+	ObserveRequest(route string, statusCode int, duration time.Duration, size int)
+	// ObserveRetry is called each time a failed request is retried
+	ObserveRetry(route string)
+	// ObserveCall is called once a request has succeeded or failed, including all its retries
+	ObserveCall(route string, duration time.Duration, err error)
+}
+
+var guidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// RouteTemplate turns the URL of a request into the template of its API route.
+// The address and collection are removed along with the query, the project ID before _apis becomes {project} and the IDs after it {id}.
+func RouteTemplate(u *url.URL) string {
+	path := u.Path
+	project := ""
+
+	if i := strings.Index(path, "/_apis/"); i >= 0 {
+		// A project ID is the segment before _apis, the rest of the prefix is the address and collection
+		before := strings.Split(strings.TrimSuffix(path[:i], "/"), "/")
+		if guidPattern.MatchString(before[len(before)-1]) {
+			project = "/{project}"
+		}
+		path = path[i:]
+	}
+
+	segments := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	for i, segment := range segments {
+		if guidPattern.MatchString(segment) || segment != "" && strings.Trim(segment, "0123456789") == "" {
+			segments[i] = "{id}"
+		}
+	}
+
+	return project + strings.Join(segments, "/")
+}
@@ -0,0 +1,72 @@
+package azdo
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestRouteTemplate(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{
+			name: "address and collection are removed",
+			url:  "https://tfs.example.com/tfs/DefaultCollection/_apis/distributedtask/pools",
+			want: "/_apis/distributedtask/pools",
+		},
+		{
+			name: "numeric IDs",
+			url:  "https://dev.azure.com/org/_apis/distributedtask/pools/12/agents",
+			want: "/_apis/distributedtask/pools/{id}/agents",
+		},
+		{
+			name: "project ID before _apis",
+			url:  "https://dev.azure.com/org/3f2a1b4c-5d6e-4f70-8a9b-0c1d2e3f4a5b/_apis/build/builds/345/timeline",
+			want: "/{project}/_apis/build/builds/{id}/timeline",
+		},
+		{
+			name: "project name before _apis is removed",
+			url:  "https://dev.azure.com/org/My%20Project/_apis/build/builds",
+			want: "/_apis/build/builds",
+		},
+		{
+			name: "GUID after _apis",
+			url:  "https://dev.azure.com/org/_apis/projects/3F2A1B4C-5D6E-4F70-8A9B-0C1D2E3F4A5B",
+			want: "/_apis/projects/{id}",
+		},
+		{
+			name: "project ID before _apis and GUID after",
+			url:  "https://dev.azure.com/org/3f2a1b4c-5d6e-4f70-8a9b-0c1d2e3f4a5b/_apis/build/builds/345/timeline/9a8b7c6d-5e4f-4a3b-2c1d-0e9f8a7b6c5d",
+			want: "/{project}/_apis/build/builds/{id}/timeline/{id}",
+		},
+		{
+			name: "query is removed",
+			url:  "https://dev.azure.com/org/_apis/build/builds?statusFilter=completed&$top=1000&continuationToken=42",
+			want: "/_apis/build/builds",
+		},
+		{
+			name: "trailing slash",
+			url:  "https://dev.azure.com/org/_apis/projects/",
+			want: "/_apis/projects",
+		},
+		{
+			name: "names which contain numbers are kept",
+			url:  "https://vsrm.dev.azure.com/org/_apis/release/v2/deployments",
+			want: "/_apis/release/v2/deployments",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			u, err := url.Parse(test.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := RouteTemplate(u); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
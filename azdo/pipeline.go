@@ -0,0 +1,31 @@
+package azdo
+
+import "time"
+
+type pipelineResponseEnvelope struct {
+	Count     int        `json:"count"`
+	Pipelines []Pipeline `json:"value"`
+}
+
+type runResponseEnvelope struct {
+	Count int   `json:"count"`
+	Runs  []Run `json:"value"`
+}
+
+// Pipeline is a YAML pipeline, from the pipelines API or a run-state-changed event
+type Pipeline struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Folder string `json:"folder"`
+}
+
+// Run is a run of a YAML pipeline, from the runs API or a run-state-changed event
+type Run struct {
+	ID           int       `json:"id"`
+	Name         string    `json:"name"`
+	State        string    `json:"state"`
+	Result       string    `json:"result"`
+	CreatedDate  time.Time `json:"createdDate"`
+	FinishedDate time.Time `json:"finishedDate"`
+	Pipeline     Pipeline  `json:"pipeline"`
+}
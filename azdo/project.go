@@ -0,0 +1,12 @@
+package azdo
+
+type projectResponseEnvelope struct {
+	Count    int       `json:"count"`
+	Projects []Project `json:"value"`
+}
+
+type Project struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	State string `json:"state"`
+}
@@ -0,0 +1,42 @@
+package azdo
+
+import "time"
+
+type deploymentResponseEnvelope struct {
+	Count       int          `json:"count"`
+	Deployments []Deployment `json:"value"`
+}
+
+type approvalResponseEnvelope struct {
+	Count     int        `json:"count"`
+	Approvals []Approval `json:"value"`
+}
+
+type Deployment struct {
+	ID                 int              `json:"id"`
+	DeploymentStatus   string           `json:"deploymentStatus"`
+	OperationStatus    string           `json:"operationStatus"`
+	QueuedOn           time.Time        `json:"queuedOn"`
+	StartedOn          time.Time        `json:"startedOn"`
+	CompletedOn        time.Time        `json:"completedOn"`
+	LastModifiedOn     time.Time        `json:"lastModifiedOn"`
+	Release            ReleaseReference `json:"release"`
+	ReleaseDefinition  ReleaseReference `json:"releaseDefinition"`
+	ReleaseEnvironment ReleaseReference `json:"releaseEnvironment"`
+}
+
+type Approval struct {
+	ID                 int              `json:"id"`
+	ApprovalType       string           `json:"approvalType"`
+	Status             string           `json:"status"`
+	CreatedOn          time.Time        `json:"createdOn"`
+	Release            ReleaseReference `json:"release"`
+	ReleaseDefinition  ReleaseReference `json:"releaseDefinition"`
+	ReleaseEnvironment ReleaseReference `json:"releaseEnvironment"`
+}
+
+// ReleaseReference is the shallow release, release definition or environment returned on deployments and approvals
+type ReleaseReference struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
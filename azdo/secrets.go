@@ -0,0 +1,211 @@
+package azdo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	commandSecretTimeout = 30 * time.Second
+
+	// After the command fails it isn't run again for this long, doubling with each failure in a row up to commandSecretMaxBackoff
+	commandSecretBackoff    = 5 * time.Second
+	commandSecretMaxBackoff = 5 * time.Minute
+
+	// While the command fails the cached secret is still used for this long after its TTL, then the command's error is returned
+	commandSecretMaxStale = time.Hour
+)
+
+// SecretProvider supplies a secret, such as an access token, which can change while the exporter is running
+type SecretProvider interface {
+	Secret() (string, error)
+}
+
+// StaticSecret is a secret which never changes, e.g. one from the config file or an environment variable
+type StaticSecret string
+
+func (s StaticSecret) Secret() (string, error) {
+	return string(s), nil
+}
+
+// FileSecret reads a secret from a file, such as a Kubernetes secret mounted as a volume.
+// The file is read again whenever its modification time changes so a rotated secret is used without a restart.
+type FileSecret struct {
+	Path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	secret  string
+}
+
+func NewFileSecret(path string) *FileSecret {
+	return &FileSecret{Path: path}
+}
+
+func (f *FileSecret) Secret() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Stat follows symlinks, which is how Kubernetes swaps in the new version of a secret
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return "", fmt.Errorf("Could not read secret file %v - %v", f.Path, err)
+	}
+
+	if f.secret != "" && info.ModTime().Equal(f.modTime) {
+		return f.secret, nil
+	}
+
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return "", fmt.Errorf("Could not read secret file %v - %v", f.Path, err)
+	}
+
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("Secret file %v is empty", f.Path)
+	}
+
+	if f.secret != "" {
+		log.WithField("path", f.Path).Info("Secret file changed, using new secret")
+	}
+	f.secret = secret
+	f.modTime = info.ModTime()
+	return f.secret, nil
+}
+
+// CommandSecret runs an external command, such as a vault CLI, and uses what it writes to stdout as the secret.
+// The secret is cached for TTL. If the command fails once the TTL has passed, it's run again with a backoff
+// and the cached secret is used until it succeeds, for up to commandSecretMaxStale.
+// The command runs once at a time, without holding the lock, so callers are given the cached secret while it runs rather than waiting for it.
+type CommandSecret struct {
+	Command []string
+	TTL     time.Duration
+
+	mu       sync.Mutex
+	fetched  time.Time
+	secret   string
+	failures int           // How many times in a row the command has failed
+	retryAt  time.Time     // When the command can be run again after failing
+	err      error         // Why the command last failed, returned until it can be run again
+	running  chan struct{} // Closed once the command which is running finishes. nil while it isn't running
+}
+
+func NewCommandSecret(command []string, ttl time.Duration) *CommandSecret {
+	return &CommandSecret{Command: command, TTL: ttl}
+}
+
+func (c *CommandSecret) Secret() (string, error) {
+	c.mu.Lock()
+	for {
+		now := time.Now()
+		if c.secret != "" && now.Sub(c.fetched) < c.TTL {
+			secret := c.secret
+			c.mu.Unlock()
+			return secret, nil
+		}
+		if now.Before(c.retryAt) {
+			secret, err := c.stale(now, c.err)
+			c.mu.Unlock()
+			return secret, err
+		}
+		if c.running == nil {
+			break
+		}
+
+		// Another caller is running the command. Only wait for it when there's no cached secret to use meanwhile
+		if secret, _ := c.stale(now, nil); secret != "" {
+			c.mu.Unlock()
+			return secret, nil
+		}
+		running := c.running
+		c.mu.Unlock()
+		<-running
+		c.mu.Lock()
+	}
+
+	running := make(chan struct{})
+	c.running = running
+	c.mu.Unlock()
+
+	secret, err := c.run()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running = nil
+	close(running)
+
+	now := time.Now()
+	if err != nil {
+		c.failures++
+		backoff := commandSecretBackoff
+		for i := 1; i < c.failures && backoff < commandSecretMaxBackoff; i++ {
+			backoff *= 2
+		}
+		if backoff > commandSecretMaxBackoff {
+			backoff = commandSecretMaxBackoff
+		}
+		c.retryAt = now.Add(backoff)
+		c.err = err
+
+		if c.secret == "" {
+			return "", err
+		}
+		logger := log.WithFields(log.Fields{"command": c.Command[0], "error": err, "retryIn": backoff})
+		if secret, staleErr := c.stale(now, err); staleErr == nil {
+			logger.Warning("Secret command failed, using cached secret")
+			return secret, nil
+		}
+		logger.Error("Secret command failed and the cached secret is too old to use")
+		return "", err
+	}
+
+	c.secret = secret
+	c.fetched = now
+	c.failures = 0
+	c.retryAt = time.Time{}
+	c.err = nil
+	return c.secret, nil
+}
+
+// stale returns the cached secret if it's within commandSecretMaxStale of its TTL, otherwise err
+func (c *CommandSecret) stale(now time.Time, err error) (string, error) {
+	if c.secret != "" && now.Sub(c.fetched) < c.TTL+commandSecretMaxStale {
+		return c.secret, nil
+	}
+	return "", err
+}
+
+func (c *CommandSecret) run() (string, error) {
+	if len(c.Command) == 0 {
+		return "", fmt.Errorf("Secret command is empty")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandSecretTimeout)
+	defer cancel()
+
+	// Stderr is discarded rather than put in the error, which is logged and shown on /status, as it can echo a token or where it's kept
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.Command[0], c.Command[1:]...)
+	cmd.Stdout = &stdout
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("Secret command %v failed: %v", c.Command[0], err)
+	}
+
+	secret := strings.TrimSpace(stdout.String())
+	if secret == "" {
+		return "", fmt.Errorf("Secret command %v did not write a secret to stdout", c.Command[0])
+	}
+
+	return secret, nil
+}
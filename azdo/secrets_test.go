@@ -0,0 +1,266 @@
+package azdo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeSecret(t *testing.T, path string, secret string, modTime time.Time) {
+	if err := ioutil.WriteFile(path, []byte(secret+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileSecretReloadsWhenModified(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	modTime := time.Now().Add(-time.Hour)
+	writeSecret(t, path, "one", modTime)
+
+	f := NewFileSecret(path)
+	if secret, err := f.Secret(); err != nil || secret != "one" {
+		t.Fatalf("got %q %v, want the file's secret", secret, err)
+	}
+
+	// The file is only read again once its modification time changes
+	writeSecret(t, path, "two", modTime)
+	if secret, err := f.Secret(); err != nil || secret != "one" {
+		t.Errorf("got %q %v, want the cached secret while the file is unmodified", secret, err)
+	}
+
+	writeSecret(t, path, "two", modTime.Add(time.Minute))
+	if secret, err := f.Secret(); err != nil || secret != "two" {
+		t.Errorf("got %q %v, want the new secret once the file is modified", secret, err)
+	}
+}
+
+func TestFileSecretErrors(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty")
+	writeSecret(t, empty, " ", time.Now())
+
+	for path, want := range map[string]string{
+		filepath.Join(dir, "missing"): "Could not read secret file",
+		empty:                         "is empty",
+	} {
+		if _, err := NewFileSecret(path).Secret(); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("got %v for %v, want an error containing %q", err, path, want)
+		}
+	}
+}
+
+func TestCommandSecretExpires(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	writeSecret(t, path, "one", time.Now())
+
+	c := NewCommandSecret([]string{"cat", path}, time.Hour)
+	if secret, err := c.Secret(); err != nil || secret != "one" {
+		t.Fatalf("got %q %v, want the command's output", secret, err)
+	}
+
+	writeSecret(t, path, "two", time.Now())
+	if secret, err := c.Secret(); err != nil || secret != "one" {
+		t.Errorf("got %q %v, want the cached secret within the TTL", secret, err)
+	}
+
+	c.mu.Lock()
+	c.fetched = time.Now().Add(-2 * time.Hour)
+	c.mu.Unlock()
+	if secret, err := c.Secret(); err != nil || secret != "two" {
+		t.Errorf("got %q %v, want the command run again once the TTL has passed", secret, err)
+	}
+
+	// Once the TTL has passed again the cached secret outlives the command failing
+	os.Remove(path)
+	c.mu.Lock()
+	c.fetched = time.Now().Add(-90 * time.Minute)
+	c.mu.Unlock()
+	if secret, err := c.Secret(); err != nil || secret != "two" {
+		t.Errorf("got %q %v, want the cached secret while the command fails", secret, err)
+	}
+}
+
+func TestCommandSecretErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		command []string
+		want    string
+	}{
+		{name: "no command", want: "Secret command is empty"},
+		{name: "command fails", command: []string{"sh", "-c", "echo vault is sealed >&2; exit 1"}, want: "Secret command sh failed: exit status 1"},
+		{name: "command not found", command: []string{filepath.Join(t.TempDir(), "missing")}, want: "Secret command"},
+		{name: "no output", command: []string{"true"}, want: "did not write a secret to stdout"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewCommandSecret(test.command, time.Hour).Secret()
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got %v, want an error containing %q", err, test.want)
+			}
+			// Stderr can hold a secret, so it's kept out of the error
+			if err != nil && strings.Contains(err.Error(), "sealed") {
+				t.Errorf("got %v, want the command's stderr left out", err)
+			}
+		})
+	}
+}
+
+func TestCommandSecretBacksOffAfterFailures(t *testing.T) {
+	runs := filepath.Join(t.TempDir(), "runs")
+	c := NewCommandSecret([]string{"sh", "-c", "echo >> " + runs + "; exit 1"}, time.Hour)
+	countRuns := func() int {
+		data, _ := ioutil.ReadFile(runs)
+		return strings.Count(string(data), "\n")
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.Secret(); err == nil || !strings.Contains(err.Error(), "Secret command sh failed") {
+			t.Errorf("got %v, want the command's error", err)
+		}
+	}
+	if got := countRuns(); got != 1 {
+		t.Fatalf("got %v runs, want the command not run again until the backoff has passed", got)
+	}
+
+	for failures, want := range []time.Duration{10 * time.Second, 20 * time.Second} {
+		c.mu.Lock()
+		c.retryAt = time.Now()
+		c.mu.Unlock()
+		start := time.Now()
+		c.Secret()
+
+		c.mu.Lock()
+		backoff := c.retryAt.Sub(start)
+		c.mu.Unlock()
+		if backoff < want || backoff > want+time.Second {
+			t.Errorf("got a backoff of %v after %v failures, want %v", backoff, failures+2, want)
+		}
+	}
+	if got := countRuns(); got != 3 {
+		t.Errorf("got %v runs, want the command run again each time the backoff passed", got)
+	}
+
+	c.mu.Lock()
+	c.failures = 100
+	c.retryAt = time.Now()
+	c.mu.Unlock()
+	c.Secret()
+	c.mu.Lock()
+	if backoff := time.Until(c.retryAt); backoff > commandSecretMaxBackoff {
+		t.Errorf("got a backoff of %v, want at most %v", backoff, commandSecretMaxBackoff)
+	}
+	c.mu.Unlock()
+}
+
+func TestCommandSecretStopsUsingAStaleSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	writeSecret(t, path, "one", time.Now())
+
+	c := NewCommandSecret([]string{"cat", path}, time.Hour)
+	if secret, err := c.Secret(); err != nil || secret != "one" {
+		t.Fatalf("got %q %v, want the command's output", secret, err)
+	}
+	os.Remove(path)
+
+	c.mu.Lock()
+	c.fetched = time.Now().Add(-time.Hour - commandSecretMaxStale/2)
+	c.mu.Unlock()
+	if secret, err := c.Secret(); err != nil || secret != "one" {
+		t.Errorf("got %q %v, want the cached secret while the command fails", secret, err)
+	}
+
+	// Also while waiting to run the command again
+	if secret, err := c.Secret(); err != nil || secret != "one" {
+		t.Errorf("got %q %v, want the cached secret during the backoff", secret, err)
+	}
+
+	c.mu.Lock()
+	c.fetched = time.Now().Add(-time.Hour - commandSecretMaxStale)
+	c.mu.Unlock()
+	if secret, err := c.Secret(); err == nil || secret != "" {
+		t.Errorf("got %q %v, want the command's error once the cached secret is too old", secret, err)
+	}
+
+	c.mu.Lock()
+	c.retryAt = time.Now()
+	c.mu.Unlock()
+	if secret, err := c.Secret(); err == nil || secret != "" {
+		t.Errorf("got %q %v, want the command's error when it fails again", secret, err)
+	}
+
+	writeSecret(t, path, "two", time.Now())
+	c.mu.Lock()
+	c.retryAt = time.Now()
+	c.mu.Unlock()
+	if secret, err := c.Secret(); err != nil || secret != "two" {
+		t.Errorf("got %q %v, want the new secret once the command succeeds", secret, err)
+	}
+	if c.failures != 0 || !c.retryAt.IsZero() {
+		t.Errorf("got %v failures with a retry at %v, want them reset", c.failures, c.retryAt)
+	}
+}
+
+func TestCommandSecretUsesTheCachedSecretWhileTheCommandRuns(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token")
+	runs := filepath.Join(dir, "runs")
+	release := filepath.Join(dir, "release")
+	writeSecret(t, path, "one", time.Now())
+
+	// The command waits until release exists, so it's still running while Secret is called again
+	c := NewCommandSecret([]string{"sh", "-c", "echo >> " + runs + "; while [ ! -e " + release + " ]; do sleep 0.01; done; cat " + path}, time.Hour)
+	c.secret = "cached"
+	c.fetched = time.Now().Add(-90 * time.Minute) // Past the TTL, but not too old to use
+
+	done := make(chan string)
+	go func() {
+		secret, _ := c.Secret()
+		done <- secret
+	}()
+	for {
+		if data, _ := ioutil.ReadFile(runs); len(data) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if secret, err := c.Secret(); err != nil || secret != "cached" {
+		t.Errorf("got %q %v, want the cached secret while the command runs", secret, err)
+	}
+
+	writeSecret(t, release, "", time.Now())
+	if secret := <-done; secret != "one" {
+		t.Errorf("got %q, want the command's output", secret)
+	}
+	if data, _ := ioutil.ReadFile(runs); strings.Count(string(data), "\n") != 1 {
+		t.Errorf("the command ran %v times, want once", strings.Count(string(data), "\n"))
+	}
+}
+
+func TestCommandSecretWaitsForTheCommandWithoutACachedSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "runs")
+	c := NewCommandSecret([]string{"sh", "-c", "echo >> " + path + "; sleep 0.2; echo token"}, time.Hour)
+
+	secrets := make(chan string, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			secret, _ := c.Secret()
+			secrets <- secret
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		if secret := <-secrets; secret != "token" {
+			t.Errorf("got %q, want every caller given the command's output", secret)
+		}
+	}
+	if data, _ := ioutil.ReadFile(path); strings.Count(string(data), "\n") != 1 {
+		t.Errorf("the command ran %v times, want once for every caller", strings.Count(string(data), "\n"))
+	}
+}
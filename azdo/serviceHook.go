@@ -0,0 +1,34 @@
+package azdo
+
+import "time"
+
+// Events sent by Azure DevOps service hooks as YAML pipelines progress
+const (
+	JobStateChangedEvent = "ms.vss-pipelines.job-state-changed-event"
+	RunStateChangedEvent = "ms.vss-pipelines.run-state-changed-event"
+)
+
+// ServiceHookEvent is the payload of a service hook (Web Hooks) subscription
+type ServiceHookEvent struct {
+	ID          string              `json:"id"`
+	EventType   string              `json:"eventType"`
+	CreatedDate time.Time           `json:"createdDate"`
+	Resource    ServiceHookResource `json:"resource"`
+}
+
+// ServiceHookResource contains the job for job-state-changed events and the run for run-state-changed events
+type ServiceHookResource struct {
+	Job      ServiceHookJob `json:"job"`
+	Run      Run            `json:"run"`
+	Pipeline Pipeline       `json:"pipeline"`
+	RunID    int            `json:"runId"`
+}
+
+type ServiceHookJob struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	State      string    `json:"state"` // waiting, running or completed
+	Result     string    `json:"result"`
+	StartTime  time.Time `json:"startTime"`
+	FinishTime time.Time `json:"finishTime"`
+}
@@ -0,0 +1,22 @@
+package azdo
+
+import "time"
+
+type Timeline struct {
+	ID      string           `json:"id"`
+	Records []TimelineRecord `json:"records"`
+}
+
+// TimelineRecord is a stage, job, task or checkpoint within a run.
+// Checkpoints are the approvals and checks a stage waits on before any of its jobs are queued.
+type TimelineRecord struct {
+	ID         string    `json:"id"`
+	ParentID   string    `json:"parentId"`
+	Type       string    `json:"type"`
+	Name       string    `json:"name"`
+	Identifier string    `json:"identifier"`
+	State      string    `json:"state"`
+	Result     string    `json:"result"`
+	StartTime  time.Time `json:"startTime"`
+	FinishTime time.Time `json:"finishTime"`
+}
@@ -1,30 +1,61 @@
 package main
 
 import (
+	"fmt"
 	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 
-	"./azdo"
+	"azdoexporter/azdo"
 )
 
 type azDoCollector struct {
 	AzDoClient        *azdo.AzDoClient
 	ignoreHostedPools bool
-	lastScrape        time.Time
+	tracer            trace.Tracer  // nil unless finished jobs are traced. Set before the collector is registered
+	jobObservers      []jobObserver // Also set before the collector is registered
+	jobStore          *jobStore     // nil unless jobs are stored. Also set before the collector is registered
+
+	collectMu sync.Mutex             // Scrapes one at a time, e.g. the warm up and Prometheus, so each picks up the jobs finished since the one before
+	windows   map[int]finishedWindow // What the last scrape which succeeded saw of each pool, keyed by pool ID
+	durations *finishedHistograms    // The lengths of the jobs observed, which are registered apart from the collector
+
+	statusMu     sync.Mutex
+	status       scrapeStatus
+	snapshot     []poolSnapshot // What the last scrape retrieved, for the API
+	snapshotTime time.Time
+}
+
+// jobObserver is given the jobs which finished on a pool since the last scrape which succeeded
+type jobObserver interface {
+	observeJobs(server string, pool azdo.Pool, jobs []azdo.Job)
 }
 
 func newAzDoCollector(az azdo.AzDoClient, ignoreHostedPools bool) *azDoCollector {
-	return &azDoCollector{AzDoClient: &az, ignoreHostedPools: ignoreHostedPools}
+	return &azDoCollector{AzDoClient: &az, ignoreHostedPools: ignoreHostedPools, windows: make(map[int]finishedWindow), durations: newJobHistograms()}
+}
+
+// waitForScrape returns once a scrape in progress has finished
+func (azc *azDoCollector) waitForScrape() {
+	azc.collectMu.Lock()
+	azc.collectMu.Unlock()
 }
 
 func (azc *azDoCollector) Describe(ch chan<- *prometheus.Desc) {
-	prometheus.DescribeByCollect(azc, ch)
+	ch <- installedBuildAgentsDesc
+	ch <- installedBuildAgentsDurationDesc
+	ch <- totalJobsDesc
+	ch <- queuedJobsDesc
+	ch <- runningJobsDesc
+	ch <- upDesc
 }
 
 func (azc *azDoCollector) Collect(publishMetrics chan<- prometheus.Metric) {
+	azc.collectMu.Lock()
+	defer azc.collectMu.Unlock()
 
 	start := time.Now()
 
@@ -32,6 +63,8 @@ func (azc *azDoCollector) Collect(publishMetrics chan<- prometheus.Metric) {
 	pools, err := azc.AzDoClient.Pools(azc.ignoreHostedPools)
 	if err != nil {
 		log.WithFields(log.Fields{"serverName": azc.AzDoClient.Name, "error": err}).Error(" Scrape Failed. Could not retrive pools.")
+		azc.recordScrape(start, 0, err)
+		publishMetrics <- prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, 0)
 		return
 	}
 	log.WithFields(log.Fields{"serverName": azc.AzDoClient.Name, "poolCount": len(pools)}).Debug("Retrieved pools")
@@ -40,11 +73,13 @@ func (azc *azDoCollector) Collect(publishMetrics chan<- prometheus.Metric) {
 	// Each returns a channel which the next step consumes.
 	// scrapeAgents returns a channel of metricContexts which contains the agents for a pool.
 	// scrapeJobs then consumes this channel and augments the metricContexts with information about the Jobs
+	// Each step records its errors in errs, which is only read once the step has finished.
 
-	chanAgents, errOccurred := azc.scrapeAgents(pools)
-	chanJobs := azc.scrapeJobs(chanAgents)
-	chanCalculatedMetrics := azc.calculateMetrics(chanJobs)
-	chanBufferedMetrics := azc.bufferMetrics(chanCalculatedMetrics, errOccurred) //Buffers and blocks until the in chan is closed. ErrOccured must be false to write anything to out chan
+	errs := &scrapeErrors{}
+	chanAgents := azc.scrapeAgents(pools, errs)
+	chanJobs := azc.scrapeJobs(chanAgents, errs, start)
+	chanCalculatedMetrics, chanContexts := azc.calculateMetrics(chanJobs)
+	chanBufferedMetrics := azc.bufferMetrics(chanCalculatedMetrics, errs) //Buffers and blocks until the in chan is closed. No error must have occurred to write anything to out chan
 
 	// Publish the buffered metrics
 	for metric := range chanBufferedMetrics {
@@ -60,21 +95,42 @@ func (azc *azDoCollector) Collect(publishMetrics chan<- prometheus.Metric) {
 		time.Since(start).Seconds(),
 	)
 
-	azc.lastScrape = time.Now()
+	// The buffered metrics channel is only closed once every step has finished
+	if err := errs.first(); err != nil {
+		publishMetrics <- prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, 0)
+		azc.recordScrape(start, len(pools), err)
+		return
+	}
+
+	// The API and dashboard keep showing the last scrape which succeeded rather than part of this one.
+	// The windows are only moved on along with the snapshot, so the jobs which finished are handed on by the same scrape that shows them,
+	// and a failed scrape leaves them to the next.
+	contexts := <-chanContexts
+	windows := make(map[int]finishedWindow, len(contexts))
+	for _, metricsContext := range contexts {
+		windows[metricsContext.pool.ID] = metricsContext.window
+		azc.observeJobs(metricsContext)
+	}
+	azc.windows = windows
+	azc.recordSnapshot(contexts)
+	publishMetrics <- prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, 1)
+	azc.recordScrape(start, len(pools), nil)
 }
 
-func (azc *azDoCollector) scrapeAgents(pools []azdo.Pool) (<-chan metricsContext, bool) {
-	errOccurred := false
+func (azc *azDoCollector) scrapeAgents(pools []azdo.Pool, errs *scrapeErrors) <-chan metricsContext {
 	metricsContextChanOut := make(chan metricsContext) //Channel to pass metricsContext along to for next part of the pipeline
 	var wg sync.WaitGroup
+	requests := make(chan struct{}, maxConcurrentRequests) // Only up to maxConcurrentRequests pools' agents are requested at once
 
 	// For each pool, spin up a go routine, retrive the agents for that pool and pass both the pool and agents along into the channel for the next step
 	for _, pool := range pools {
 		wg.Add(1)
 		go func(p azdo.Pool) {
+			requests <- struct{}{}
 			agents, err := azc.AzDoClient.Agents(p.ID) //Get all Agents for pool
+			<-requests
 			if err != nil {
-				errOccurred = true
+				errs.add(fmt.Errorf("could not retrieve agents for pool %v - %v", p.ID, err))
 				log.WithFields(log.Fields{"serverName": azc.AzDoClient.Name, "poolId": p.ID, "err": err}).Error("Failed to retrieve agents for pool")
 			}
 			log.WithFields(log.Fields{"serverName": azc.AzDoClient.Name, "poolId": p.ID, "agentsInPoolCount": len(agents)}).Debug("Retrieved agents for pool")
@@ -88,21 +144,41 @@ func (azc *azDoCollector) scrapeAgents(pools []azdo.Pool) (<-chan metricsContext
 		close(metricsContextChanOut)
 	}()
 
-	return metricsContextChanOut, errOccurred
+	return metricsContextChanOut
 }
 
-func (azc *azDoCollector) scrapeJobs(metricsContextChanIn <-chan metricsContext) <-chan metricsContext {
+// scrapeJobs retrieves the jobs of each pool, with those which finished since the pool's last scrape which succeeded.
+// Each context holds the window the pool moves on to once the scrape succeeds. Pools which are gone are forgotten then.
+func (azc *azDoCollector) scrapeJobs(metricsContextChanIn <-chan metricsContext, errs *scrapeErrors, start time.Time) <-chan metricsContext {
 	metricsContextChanOut := make(chan metricsContext)
 
 	go func() {
 		for metricsContext := range metricsContextChanIn {
+			window := azc.windows[metricsContext.pool.ID]
 
-			finishedJobs, currentJobs, err := azc.AzDoClient.JobsAfter(metricsContext.pool.ID, azc.lastScrape)
+			finishedJobs, currentJobs, err := azc.AzDoClient.JobsAfter(metricsContext.pool.ID, window.start)
 			if err != nil {
+				errs.add(fmt.Errorf("could not retrieve jobs for pool %v - %v", metricsContext.pool.ID, err))
 				log.WithFields(log.Fields{"serverName": azc.AzDoClient.Name, "poolId": metricsContext.pool.ID, "err": err}).Error("Failed to retrieve queued jobs for pool")
 			}
 			log.WithFields(log.Fields{"serverName": azc.AzDoClient.Name, "poolId": metricsContext.pool.ID, "currentJobsInPoolCount": len(currentJobs)}).Debug("Retrieved current jobs for pools")
 
+			finished := make(map[int]time.Time, len(finishedJobs))
+			unseenJobs := finishedJobs[:0]
+			for _, job := range finishedJobs {
+				finished[job.RequestID] = job.FinishTime
+				if window.unseen(job.RequestID) {
+					unseenJobs = append(unseenJobs, job)
+				}
+			}
+			finishedJobs = unseenJobs
+
+			// The window isn't moved on when the jobs couldn't be retrieved, so the jobs which finished are picked up by the next scrape
+			metricsContext.window = window
+			if err == nil {
+				metricsContext.window = window.next(start, finished)
+			}
+
 			metricsContext.currentJobs = currentJobs   // Augment the metrics context with the current jobs for this pool
 			metricsContext.finishedJobs = finishedJobs // Augment the metrics context with the finished jobs for this pool(since the last scrape)
 
@@ -114,11 +190,33 @@ func (azc *azDoCollector) scrapeJobs(metricsContextChanIn <-chan metricsContext)
 	return metricsContextChanOut
 }
 
-func (azc *azDoCollector) calculateMetrics(metricsContextChanIn <-chan metricsContext) <-chan prometheus.Metric {
+// observeJobs hands on the jobs which finished on a pool since the last scrape which succeeded, once this one has
+func (azc *azDoCollector) observeJobs(metricsContext metricsContext) {
+	observeJobHistograms(azc.durations, metricsContext)
+	if azc.tracer != nil {
+		traceJobs(azc.tracer, metricsContext.pool, metricsContext.finishedJobs)
+	}
+	for _, observer := range azc.jobObservers {
+		observer.observeJobs(azc.AzDoClient.Name, metricsContext.pool, metricsContext.finishedJobs)
+	}
+	if azc.jobStore != nil {
+		azc.jobStore.record(azc.AzDoClient.Name, metricsContext.pool, metricsContext.currentJobs, metricsContext.finishedJobs)
+	}
+}
+
+func (azc *azDoCollector) finishedHistograms() *finishedHistograms {
+	return azc.durations
+}
+
+// calculateMetrics also sends every metricsContext it consumed on the second channel, once it has consumed them all
+func (azc *azDoCollector) calculateMetrics(metricsContextChanIn <-chan metricsContext) (<-chan prometheus.Metric, <-chan []metricsContext) {
 	metrics := make(chan prometheus.Metric)
+	contextsOut := make(chan []metricsContext, 1)
 
 	go func() {
+		var contexts []metricsContext
 		for metricsContext := range metricsContextChanIn {
+			contexts = append(contexts, metricsContext)
 
 			agentMetrics := calculateAgentMetrics(metricsContext)
 			for _, agentMetric := range agentMetrics {
@@ -131,13 +229,14 @@ func (azc *azDoCollector) calculateMetrics(metricsContextChanIn <-chan metricsCo
 			}
 
 		}
+		contextsOut <- contexts
 		close(metrics)
 
 	}()
-	return metrics
+	return metrics, contextsOut
 }
 
-func (azc *azDoCollector) bufferMetrics(metricsIn <-chan prometheus.Metric, errOccurred bool) <-chan prometheus.Metric {
+func (azc *azDoCollector) bufferMetrics(metricsIn <-chan prometheus.Metric, errs *scrapeErrors) <-chan prometheus.Metric {
 	metricsOut := make(chan prometheus.Metric)
 
 	go func() {
@@ -149,7 +248,7 @@ func (azc *azDoCollector) bufferMetrics(metricsIn <-chan prometheus.Metric, errO
 			bufferedMetrics = append(bufferedMetrics, metric)
 		}
 
-		if errOccurred {
+		if errs.first() != nil {
 			log.WithFields(log.Fields{"serverName": azc.AzDoClient.Name}).Error("Metrics not exposed due to previous error")
 			close(metricsOut)
 			return
@@ -166,10 +265,32 @@ func (azc *azDoCollector) bufferMetrics(metricsIn <-chan prometheus.Metric, errO
 	return metricsOut
 }
 
+// scrapeErrors keeps the first error of the steps of a scrape, which run concurrently
+type scrapeErrors struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (e *scrapeErrors) add(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err == nil {
+		e.err = err
+	}
+}
+
+// first returns the first error which occurred, or nil if none did
+func (e *scrapeErrors) first() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
+}
+
 // Contains all the information needed to calculate the metrics
 type metricsContext struct {
 	pool         azdo.Pool
 	agents       []azdo.Agent
 	currentJobs  []azdo.Job
 	finishedJobs []azdo.Job
+	window       finishedWindow // The pool's window once the scrape succeeds
 }
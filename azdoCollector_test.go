@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"azdoexporter/azdo"
+)
+
+// agentsServer has a pool Default with an agent, and fails to return the agent while failAgents is set.
+// Once finished is set, in Unix nanoseconds, the pool has a job which finished then.
+func agentsServer(t *testing.T, failAgents *atomic.Bool, finished *atomic.Int64) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_apis/distributedtask/pools":
+			fmt.Fprint(w, `{"count": 1, "value": [{"id": 1, "name": "Default"}]}`)
+		case "/_apis/distributedtask/pools/1/agents":
+			if failAgents.Load() {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, `{"count": 1, "value": [{"id": 1, "name": "agent-1", "status": "online", "enabled": true}]}`)
+		case "/_apis/distributedtask/pools/1/jobrequests/":
+			if finished.Load() == 0 {
+				fmt.Fprint(w, `{"count": 0, "value": []}`)
+				return
+			}
+			finish := time.Unix(0, finished.Load()).UTC()
+			queued := finish.Add(-time.Minute).Format(time.RFC3339Nano)
+			fmt.Fprintf(w, `{"count": 1, "value": [{"requestId": 1, "queueTime": %q, "receiveTime": %q, "finishTime": %q}]}`, queued, queued, finish.Format(time.RFC3339Nano))
+		default:
+			t.Errorf("unexpected request to %v", r.URL)
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// scrapedGatherer gathers a collector and then the histograms Prometheus is given of what it observed finished, the same as the server manager's registries
+func scrapedGatherer(collector prometheus.Collector) prometheus.Gatherer {
+	reg, scraped := prometheus.NewRegistry(), prometheus.NewRegistry()
+	reg.MustRegister(collector)
+	scraped.MustRegister(collector.(histogramObserver).finishedHistograms().scrapedHistograms())
+	return prometheus.Gatherers{reg, scraped}
+}
+
+func TestAzDoCollectorKeepsTheSnapshotOfTheLastScrapeWhichSucceeded(t *testing.T) {
+	var failAgents atomic.Bool
+	server := agentsServer(t, &failAgents, &atomic.Int64{})
+
+	azc := newAzDoCollector(azdo.AzDoClient{Client: server.Client(), Name: "s1", Address: server.URL, AccessToken: "token"}, true)
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(azc)
+
+	if up := gatherMetrics(t, reg)["tfs_up"]; len(up) != 1 || up[0].GetGauge().GetValue() != 1 {
+		t.Fatalf("got up %v, want 1", up)
+	}
+	snapshot, snapshotTime := azc.lastSnapshot()
+	if len(snapshot) != 1 || len(snapshot[0].agents) != 1 {
+		t.Fatalf("got %+v, want pool Default with its agent", snapshot)
+	}
+
+	failAgents.Store(true)
+	if up := gatherMetrics(t, reg)["tfs_up"]; len(up) != 1 || up[0].GetGauge().GetValue() != 0 {
+		t.Fatalf("got up %v, want 0 once the agents can't be retrieved", up)
+	}
+	if azc.scrapeStatus().Error == "" {
+		t.Error("the failed scrape wasn't recorded")
+	}
+	failed, failedTime := azc.lastSnapshot()
+	if !failedTime.Equal(snapshotTime) || len(failed) != 1 || len(failed[0].agents) != 1 {
+		t.Errorf("got %+v from %v, want the snapshot from %v with the agent", failed, failedTime, snapshotTime)
+	}
+}
+
+func TestAzDoCollectorObservesJobsWhichFinishDuringAScrapeOnce(t *testing.T) {
+	var (
+		requests atomic.Int32
+		finished atomic.Int64 // When the job finished, in Unix nanoseconds
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_apis/distributedtask/pools":
+			fmt.Fprint(w, `{"count": 1, "value": [{"id": 1, "name": "Default"}]}`)
+		case "/_apis/distributedtask/pools/1/agents":
+			fmt.Fprint(w, `{"count": 0, "value": []}`)
+		case "/_apis/distributedtask/pools/1/jobrequests/":
+			queued := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339Nano)
+			switch requests.Add(1) {
+			case 1:
+				fmt.Fprint(w, `{"count": 0, "value": []}`)
+			case 2:
+				// The job finishes once the second scrape has its jobs, so only the third is given it
+				finished.Store(time.Now().UnixNano())
+				fmt.Fprintf(w, `{"count": 1, "value": [{"requestId": 1, "queueTime": %q, "receiveTime": %q}]}`, queued, queued)
+			default:
+				fmt.Fprintf(w, `{"count": 1, "value": [{"requestId": 1, "queueTime": %q, "receiveTime": %q, "finishTime": %q}]}`,
+					queued, queued, time.Unix(0, finished.Load()).UTC().Format(time.RFC3339Nano))
+			}
+		default:
+			t.Errorf("unexpected request to %v", r.URL)
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	azc := newAzDoCollector(azdo.AzDoClient{Client: server.Client(), Name: "s1", Address: server.URL, AccessToken: "token"}, true)
+	reg := scrapedGatherer(azc)
+	cumulative := prometheus.NewRegistry()
+	cumulative.MustRegister(azc.durations.cumulativeHistograms())
+
+	// Prometheus is given the jobs which finished since its last scrape, and OTLP every job so far
+	for scrape, want := range []struct{ scraped, cumulative uint64 }{{0, 0}, {0, 0}, {1, 1}, {0, 1}} {
+		total := gatherMetrics(t, reg)["tfs_pool_job_total_length_secs"]
+		if len(total) != 1 || total[0].GetHistogram().GetSampleCount() != want.scraped {
+			t.Errorf("got %v after scrape %v, want %v jobs observed", total, scrape+1, want.scraped)
+		}
+		cumulativeTotal := gatherMetrics(t, cumulative)["tfs_pool_job_total_length_secs"]
+		if len(cumulativeTotal) != 1 || cumulativeTotal[0].GetHistogram().GetSampleCount() != want.cumulative {
+			t.Errorf("got %v cumulatively after scrape %v, want %v jobs observed", cumulativeTotal, scrape+1, want.cumulative)
+		}
+	}
+}
+
+func TestAzDoCollectorGivesTheJobsSeenByAFailedScrapeToTheNext(t *testing.T) {
+	var (
+		failAgents atomic.Bool
+		finished   atomic.Int64
+	)
+	server := agentsServer(t, &failAgents, &finished)
+
+	azc := newAzDoCollector(azdo.AzDoClient{Client: server.Client(), Name: "s1", Address: server.URL, AccessToken: "token"}, true)
+	reg := scrapedGatherer(azc)
+	gatherMetrics(t, reg)
+
+	// The job finishes, and is retrieved, during a scrape which fails
+	finished.Store(time.Now().UnixNano())
+	failAgents.Store(true)
+	if up := gatherMetrics(t, reg)["tfs_up"]; len(up) != 1 || up[0].GetGauge().GetValue() != 0 {
+		t.Fatalf("got up %v, want 0 once the agents can't be retrieved", up)
+	}
+
+	failAgents.Store(false)
+	total := gatherMetrics(t, reg)["tfs_pool_job_total_length_secs"]
+	if len(total) != 1 || total[0].GetHistogram().GetSampleCount() != 1 {
+		t.Errorf("got %v, want the job observed by the scrape which succeeded", total)
+	}
+	snapshot, _ := azc.lastSnapshot()
+	if len(snapshot) != 1 || len(snapshot[0].finishedJobs) != 1 || len(snapshot[0].recentJobs) != 1 {
+		t.Errorf("got %+v, want the job in the snapshot's finished and recent jobs", snapshot)
+	}
+}
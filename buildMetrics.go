@@ -0,0 +1,115 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"azdoexporter/azdo"
+)
+
+var (
+	activeBuildsDesc = prometheus.NewDesc(
+		"tfs_builds_active",
+		"Total of builds which have been queued but not completed",
+		[]string{"project", "definition", "status"},
+		nil,
+	)
+
+	waitingBuildsDesc = prometheus.NewDesc(
+		"tfs_builds_waiting",
+		"Total of active builds without a job request in any pool, such as those waiting on approvals or checks",
+		[]string{"project", "definition"},
+		nil,
+	)
+
+	waitingBuildsOldestDesc = prometheus.NewDesc(
+		"tfs_builds_waiting_oldest_age_secs",
+		"Age of the oldest active build without a job request in any pool",
+		[]string{"project", "definition"},
+		nil,
+	)
+
+	waitingBuildsAgeDesc = prometheus.NewDesc(
+		"tfs_builds_waiting_age_secs",
+		"Age of active builds without a job request in any pool",
+		[]string{"project", "definition"},
+		nil,
+	)
+
+	buildsScrapeDurationDesc = prometheus.NewDesc(
+		"tfs_builds_scrape_duration_seconds",
+		"Duration of time it took to scrape active builds",
+		[]string{},
+		nil,
+	)
+)
+
+func calculateBuildMetrics(builds []azdo.Build, ownersWithJobs map[int]bool, now time.Time) []prometheus.Metric {
+
+	type activeKey struct {
+		project    string
+		definition string
+		status     string
+	}
+
+	type waitingKey struct {
+		project    string
+		definition string
+	}
+
+	active := make(map[activeKey]float64)
+	waiting := make(map[waitingKey][]time.Duration) // ages of the waiting builds
+
+	for _, build := range builds {
+		active[activeKey{build.Project.Name, build.Definition.Name, build.Status}]++
+
+		if ownersWithJobs[build.ID] {
+			continue
+		}
+
+		key := waitingKey{build.Project.Name, build.Definition.Name}
+		waiting[key] = append(waiting[key], now.Sub(build.QueueTime))
+	}
+
+	promMetrics := []prometheus.Metric{}
+	for k, count := range active {
+		promMetrics = append(promMetrics, prometheus.MustNewConstMetric(
+			activeBuildsDesc,
+			prometheus.GaugeValue,
+			count,
+			k.project,
+			k.definition,
+			k.status,
+		))
+	}
+
+	for k, ages := range waiting {
+		var oldest time.Duration
+		for _, age := range ages {
+			if age > oldest {
+				oldest = age
+			}
+		}
+
+		promMetrics = append(promMetrics,
+			prometheus.MustNewConstMetric(
+				waitingBuildsDesc,
+				prometheus.GaugeValue,
+				float64(len(ages)),
+				k.project,
+				k.definition,
+			),
+			prometheus.MustNewConstMetric(
+				waitingBuildsOldestDesc,
+				prometheus.GaugeValue,
+				oldest.Seconds(),
+				k.project,
+				k.definition,
+			),
+			newDurationHistogram(waitingBuildsAgeDesc, calculateBuckets(), ages, k.project, k.definition),
+		)
+	}
+
+	return promMetrics
+}
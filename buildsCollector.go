@@ -0,0 +1,183 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"azdoexporter/azdo"
+)
+
+// maxConcurrentRequests is how many projects or pools a collector scrapes at once, so a server with many isn't sent a request for each at the same time
+const maxConcurrentRequests = 8
+
+// poolsTTL is how long the builds collector reuses the pools it retrieved. They rarely change, so they're only retrieved again about once a scrape interval
+const poolsTTL = time.Minute
+
+// buildsCollector reports builds which have been queued but not completed.
+// Builds waiting on approvals or checks never create a job request in a pool so they can't be seen by the azDoCollector.
+type buildsCollector struct {
+	AzDoClient *azdo.AzDoClient
+
+	collectMu    sync.Mutex // Held while scraping so shutdown can wait for a scrape in progress
+	pools        []azdo.Pool
+	poolsFetched time.Time
+}
+
+func newBuildsCollector(az azdo.AzDoClient) *buildsCollector {
+	return &buildsCollector{AzDoClient: &az}
+}
+
+// waitForScrape returns once a scrape in progress has finished
+func (bc *buildsCollector) waitForScrape() {
+	bc.collectMu.Lock()
+	bc.collectMu.Unlock()
+}
+
+func (bc *buildsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeBuildsDesc
+	ch <- waitingBuildsDesc
+	ch <- waitingBuildsOldestDesc
+	ch <- waitingBuildsAgeDesc
+	ch <- buildsScrapeDurationDesc
+}
+
+func (bc *buildsCollector) Collect(publishMetrics chan<- prometheus.Metric) {
+	bc.collectMu.Lock()
+	defer bc.collectMu.Unlock()
+
+	start := time.Now()
+
+	projects, err := bc.AzDoClient.Projects()
+	if err != nil {
+		log.WithFields(log.Fields{"serverName": bc.AzDoClient.Name, "error": err}).Error("Scrape Failed. Could not retrieve projects.")
+		return
+	}
+	log.WithFields(log.Fields{"serverName": bc.AzDoClient.Name, "projectCount": len(projects)}).Debug("Retrieved projects")
+
+	builds, failedProjects := scrapeActiveBuilds(bc.AzDoClient, projects)
+	if failedProjects > 0 {
+		log.WithFields(log.Fields{"serverName": bc.AzDoClient.Name, "failedProjectCount": failedProjects}).Error("Build metrics of projects which failed not exposed due to previous error")
+	}
+
+	// Builds which have a job request in a pool have reached an agent or are queued for one.
+	// Hosted pools are included as a build waiting on a hosted agent isn't waiting on approvals or checks.
+	pools, err := bc.allPools(start)
+	if err != nil {
+		log.WithFields(log.Fields{"serverName": bc.AzDoClient.Name, "error": err}).Error("Scrape Failed. Could not retrieve pools.")
+		return
+	}
+
+	// Without every pool's jobs a build with a job in the pool which failed would be counted as waiting
+	jobs, errOccurred := scrapeCurrentJobs(bc.AzDoClient, pools)
+	if errOccurred {
+		log.WithFields(log.Fields{"serverName": bc.AzDoClient.Name}).Error("Build metrics not exposed due to previous error")
+		return
+	}
+
+	owners := make(map[int]bool)
+	for _, job := range jobs {
+		if job.PlanType == "Build" {
+			owners[job.Owner.ID] = true
+		}
+	}
+
+	for _, metric := range calculateBuildMetrics(builds, owners, start) {
+		publishMetrics <- metric
+	}
+
+	log.WithFields(log.Fields{"serverName": bc.AzDoClient.Name, "activeBuildCount": len(builds)}).Info("Scraped builds")
+
+	// Time it has take to run this scrape
+	publishMetrics <- prometheus.MustNewConstMetric(
+		buildsScrapeDurationDesc,
+		prometheus.GaugeValue,
+		time.Since(start).Seconds(),
+	)
+}
+
+// allPools returns every pool, hosted or not, retrieving them again once they're older than poolsTTL
+func (bc *buildsCollector) allPools(now time.Time) ([]azdo.Pool, error) {
+	if !bc.poolsFetched.IsZero() && now.Sub(bc.poolsFetched) < poolsTTL {
+		return bc.pools, nil
+	}
+
+	pools, err := bc.AzDoClient.Pools(false)
+	if err != nil {
+		return nil, err
+	}
+	bc.pools, bc.poolsFetched = pools, now
+	return pools, nil
+}
+
+// scrapeActiveBuilds retrieves the active builds for every project, up to maxConcurrentRequests at once.
+// The builds of the projects which succeeded are returned along with how many projects failed.
+func scrapeActiveBuilds(az *azdo.AzDoClient, projects []azdo.Project) ([]azdo.Build, int) {
+	var (
+		builds         []azdo.Build
+		failedProjects int
+		mu             sync.Mutex
+		wg             sync.WaitGroup
+		requests       = make(chan struct{}, maxConcurrentRequests)
+	)
+
+	for _, project := range projects {
+		requests <- struct{}{}
+		wg.Add(1)
+		go func(p azdo.Project) {
+			defer wg.Done()
+			defer func() { <-requests }()
+
+			projectBuilds, err := az.ActiveBuilds(p.ID)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failedProjects++
+				log.WithFields(log.Fields{"serverName": az.Name, "project": p.Name, "err": err}).Error("Failed to retrieve active builds for project")
+				return
+			}
+			log.WithFields(log.Fields{"serverName": az.Name, "project": p.Name, "activeBuildCount": len(projectBuilds)}).Debug("Retrieved active builds for project")
+			builds = append(builds, projectBuilds...)
+		}(project)
+	}
+	wg.Wait()
+
+	return builds, failedProjects
+}
+
+// scrapeCurrentJobs retrieves the queued and running job requests for every pool, up to maxConcurrentRequests at once
+func scrapeCurrentJobs(az *azdo.AzDoClient, pools []azdo.Pool) ([]azdo.Job, bool) {
+	var (
+		jobs        []azdo.Job
+		errOccurred bool
+		mu          sync.Mutex
+		wg          sync.WaitGroup
+		requests    = make(chan struct{}, maxConcurrentRequests)
+	)
+
+	for _, pool := range pools {
+		requests <- struct{}{}
+		wg.Add(1)
+		go func(p azdo.Pool) {
+			defer wg.Done()
+			defer func() { <-requests }()
+
+			poolJobs, err := az.CurrentJobs(p.ID)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errOccurred = true
+				log.WithFields(log.Fields{"serverName": az.Name, "poolId": p.ID, "err": err}).Error("Failed to retrieve current jobs for pool")
+				return
+			}
+			jobs = append(jobs, poolJobs...)
+		}(pool)
+	}
+	wg.Wait()
+
+	return jobs, errOccurred
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"azdoexporter/azdo"
+)
+
+func gatherBuildMetrics(t *testing.T, builds []azdo.Build, ownersWithJobs map[int]bool, now time.Time) map[string]float64 {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.CollectorFunc(func(ch chan<- prometheus.Metric) {
+		for _, metric := range calculateBuildMetrics(builds, ownersWithJobs, now) {
+			ch <- metric
+		}
+	}))
+
+	values := make(map[string]float64)
+	for name, metrics := range gatherMetrics(t, reg) {
+		for _, metric := range metrics {
+			if h := metric.GetHistogram(); h != nil {
+				values[name] += float64(h.GetSampleCount())
+				continue
+			}
+			values[name] += metric.GetGauge().GetValue()
+		}
+	}
+	return values
+}
+
+func TestCalculateBuildMetrics(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	project := azdo.Project{ID: goodProjectID, Name: "project"}
+	builds := []azdo.Build{
+		{ID: 1, Status: "inProgress", QueueTime: now.Add(-10 * time.Minute), Project: project, Definition: azdo.BuildDefinition{Name: "pipeline"}},
+		{ID: 2, Status: "notStarted", QueueTime: now.Add(-5 * time.Minute), Project: project, Definition: azdo.BuildDefinition{Name: "pipeline"}},
+	}
+
+	tests := []struct {
+		name           string
+		ownersWithJobs map[int]bool
+		wantWaiting    float64
+		wantOldest     float64
+	}{
+		{name: "no builds with a job", wantWaiting: 2, wantOldest: 600},
+		{name: "oldest build with a job", ownersWithJobs: map[int]bool{1: true}, wantWaiting: 1, wantOldest: 300},
+		{name: "every build with a job", ownersWithJobs: map[int]bool{1: true, 2: true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values := gatherBuildMetrics(t, builds, test.ownersWithJobs, now)
+
+			if values["tfs_builds_active"] != 2 {
+				t.Errorf("got %v active builds, want both whether they have a job or not", values["tfs_builds_active"])
+			}
+			if values["tfs_builds_waiting"] != test.wantWaiting || values["tfs_builds_waiting_age_secs"] != test.wantWaiting {
+				t.Errorf("got %v waiting builds with %v ages, want %v", values["tfs_builds_waiting"], values["tfs_builds_waiting_age_secs"], test.wantWaiting)
+			}
+			if values["tfs_builds_waiting_oldest_age_secs"] != test.wantOldest {
+				t.Errorf("got oldest waiting build of %vs, want %vs", values["tfs_builds_waiting_oldest_age_secs"], test.wantOldest)
+			}
+		})
+	}
+}
+
+// buildsServer has two projects. The builds of one can't be read, the other has a build which is running on an agent
+// and one waiting on a check, which has no job request
+func buildsServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_apis/projects":
+			fmt.Fprintf(w, `{"count": 2, "value": [{"id": %q, "name": "good"}, {"id": %q, "name": "bad"}]}`, goodProjectID, badProjectID)
+		case "/" + badProjectID + "/_apis/build/builds":
+			http.Error(w, "forbidden", http.StatusForbidden)
+		case "/" + goodProjectID + "/_apis/build/builds":
+			queued := time.Now().UTC().Add(-time.Minute).Format(time.RFC3339Nano)
+			fmt.Fprintf(w, `{"count": 2, "value": [
+				{"id": 1, "status": "inProgress", "queueTime": %q, "project": {"name": "good"}, "definition": {"name": "pipeline"}},
+				{"id": 2, "status": "notStarted", "queueTime": %q, "project": {"name": "good"}, "definition": {"name": "pipeline"}}]}`, queued, queued)
+		case "/_apis/distributedtask/pools":
+			fmt.Fprint(w, `{"count": 1, "value": [{"id": 1, "name": "Default"}]}`)
+		case "/_apis/distributedtask/pools/1/jobrequests/":
+			// A release's job whose owner has the same ID as the waiting build mustn't count as the build's
+			fmt.Fprint(w, `{"count": 2, "value": [{"requestId": 1, "planType": "Build", "owner": {"id": 1}}, {"requestId": 2, "planType": "Release", "owner": {"id": 2}}]}`)
+		default:
+			t.Errorf("unexpected request to %v", r.URL)
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestBuildsCollectorKeepsScrapingProjectsWhichSucceed(t *testing.T) {
+	server := buildsServer(t)
+	defer server.Close()
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(newBuildsCollector(azdo.AzDoClient{Client: server.Client(), Name: "s1", Address: server.URL, AccessToken: "token"}))
+	scraped := gatherMetrics(t, reg)
+
+	if active := scraped["tfs_builds_active"]; len(active) != 2 {
+		t.Errorf("got %v active build series, want the good project's builds in progress and not started although the other project failed", len(active))
+	}
+	if waiting := scraped["tfs_builds_waiting"]; len(waiting) != 1 || waiting[0].GetGauge().GetValue() != 1 {
+		t.Errorf("got %v, want only the build without a job request waiting", waiting)
+	}
+	if len(scraped["tfs_builds_scrape_duration_seconds"]) != 1 {
+		t.Error("the scrape duration wasn't published")
+	}
+}
+
+func TestScrapeActiveBuildsLimitsConcurrentRequests(t *testing.T) {
+	var inFlight, most atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+		}
+		time.Sleep(10 * time.Millisecond)
+		fmt.Fprint(w, `{"count": 0, "value": []}`)
+	}))
+	defer server.Close()
+
+	var projects []azdo.Project
+	for i := 0; i < 3*maxConcurrentRequests; i++ {
+		projects = append(projects, azdo.Project{ID: fmt.Sprint(i), Name: fmt.Sprint("project", i)})
+	}
+	az := azdo.AzDoClient{Client: server.Client(), Name: "s1", Address: server.URL, AccessToken: "token"}
+	if _, failedProjects := scrapeActiveBuilds(&az, projects); failedProjects != 0 {
+		t.Fatalf("got %v failed projects, want none", failedProjects)
+	}
+
+	if most.Load() > maxConcurrentRequests {
+		t.Errorf("got %v requests at once, want at most %v", most.Load(), maxConcurrentRequests)
+	}
+}
+
+func TestBuildsCollectorReusesPools(t *testing.T) {
+	builds := buildsServer(t)
+	defer builds.Close()
+	var poolRequests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_apis/distributedtask/pools" {
+			poolRequests.Add(1)
+		}
+		builds.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	bc := newBuildsCollector(azdo.AzDoClient{Client: server.Client(), Name: "s1", Address: server.URL, AccessToken: "token"})
+	testutil.CollectAndCount(bc)
+	testutil.CollectAndCount(bc)
+	if n := poolRequests.Load(); n != 1 {
+		t.Errorf("got %v requests for the pools, want 1 as they're reused", n)
+	}
+
+	// Once they're older than poolsTTL they're retrieved again
+	bc.poolsFetched = bc.poolsFetched.Add(-poolsTTL)
+	testutil.CollectAndCount(bc)
+	if n := poolRequests.Load(); n != 2 {
+		t.Errorf("got %v requests for the pools, want 2 once they're older than %v", n, poolsTTL)
+	}
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	AuthMethodPAT               = "pat"
+	AuthMethodClientSecret      = "clientSecret"
+	AuthMethodClientCertificate = "clientCertificate"
+	AuthMethodWorkloadIdentity  = "workloadIdentity"
+	AuthMethodNTLM              = "ntlm"
+)
+
+// authFromEnvironment fills in the auth config of a server from environment variables. name is the name used in the TFSEX_ variables
+func authFromEnvironment(field string, name string, auth *Auth, configLogger *log.Entry) {
+	serverLogger := configLogger.WithFields(log.Fields{"serverName": field, "authMethod": auth.Method})
+
+	if auth.AuthorityHost == "" {
+		auth.AuthorityHost = os.Getenv("AZURE_AUTHORITY_HOST")
+	}
+
+	switch auth.Method {
+	case AuthMethodClientSecret:
+		envVar := strings.ToUpper(fmt.Sprintf("TFSEX_%v_CLIENTSECRET", name))
+		if clientSecret := os.Getenv(envVar); clientSecret != "" {
+			serverLogger.WithField("envVar", envVar).Info("Using ClientSecret from environment variable")
+			auth.ClientSecret = clientSecret
+		}
+
+	case AuthMethodWorkloadIdentity:
+		// Azure Workload Identity sets these in the pod
+		if auth.TenantID == "" {
+			auth.TenantID = os.Getenv("AZURE_TENANT_ID")
+		}
+		if auth.ClientID == "" {
+			auth.ClientID = os.Getenv("AZURE_CLIENT_ID")
+		}
+		if auth.TokenFile == "" {
+			auth.TokenFile = os.Getenv("AZURE_FEDERATED_TOKEN_FILE")
+		}
+
+	case AuthMethodNTLM:
+		// Windows credentials are only taken from environment variables
+		auth.Username = os.Getenv(strings.ToUpper(fmt.Sprintf("TFSEX_%v_USERNAME", name)))
+		auth.Password = os.Getenv(strings.ToUpper(fmt.Sprintf("TFSEX_%v_PASSWORD", name)))
+		if auth.Username != "" {
+			serverLogger.WithField("username", auth.Username).Info("Using Windows credentials from environment variables")
+		}
+	}
+}
+
+// validateAuth returns everything missing from the auth config of a server
+func validateAuth(field string, auth Auth) Errors {
+	var errs Errors
+
+	switch auth.Method {
+	case "", AuthMethodPAT:
+		// The access token is checked along with the rest of the server
+		return nil
+
+	case AuthMethodClientSecret:
+		if auth.ClientSecret == "" {
+			errs = append(errs, fieldError(field+".auth", "ClientSecret not found in config file or environment variable"))
+		}
+
+	case AuthMethodClientCertificate:
+		if auth.CertificateFile == "" {
+			errs = append(errs, fieldError(field+".auth", "CertificateFile has not been set"))
+		}
+
+	case AuthMethodWorkloadIdentity:
+		if auth.TokenFile == "" {
+			errs = append(errs, fieldError(field+".auth", "TokenFile not found in config file or AZURE_FEDERATED_TOKEN_FILE environment variable"))
+		}
+
+	case AuthMethodNTLM:
+		if auth.Username == "" || auth.Password == "" {
+			errs = append(errs, fieldError(field+".auth", "username and password environment variables must be set"))
+		}
+		return errs
+
+	default:
+		return Errors{fieldError(field+".auth", "unknown auth method %v. Must be one of %v, %v, %v, %v or %v", auth.Method, AuthMethodPAT, AuthMethodClientSecret, AuthMethodClientCertificate, AuthMethodWorkloadIdentity, AuthMethodNTLM)}
+	}
+
+	if auth.TenantID == "" || auth.ClientID == "" {
+		errs = append(errs, fieldError(field+".auth", "TenantID and ClientID must be set"))
+	}
+
+	return errs
+}
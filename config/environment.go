@@ -0,0 +1,82 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func accessTokenEnvVar(name string) string {
+	return strings.ToUpper(fmt.Sprintf("TFSEX_%v_ACCESSTOKEN", name))
+}
+
+// FromEnvironment fills in secrets and credentials from environment variables, which take precedence over the config file
+func (c *Config) FromEnvironment(configLogger *log.Entry) {
+	for name, server := range c.Servers {
+		serverFromEnvironment(fmt.Sprintf("servers.%v", name), name, &server, configLogger)
+		c.Servers[name] = server
+	}
+
+	// Modules use TFSEX_MODULE_<name>_ variables so they don't clash with a server of the same name
+	for name, module := range c.Modules {
+		serverFromEnvironment(fmt.Sprintf("modules.%v", name), "MODULE_"+name, &module.Server, configLogger)
+		c.Modules[name] = module
+	}
+
+	proxyFromEnvironment(&c.Proxy, "TFSEX_PROXY")
+
+	// Password and secret might be in Env Vars, same as access tokens
+	if password := os.Getenv("TFSEX_SERVICEHOOKS_PASSWORD"); password != "" {
+		configLogger.WithField("envVar", "TFSEX_SERVICEHOOKS_PASSWORD").Info("Using service hooks password from environment variable")
+		c.ServiceHooks.Password = password
+	}
+	if secret := os.Getenv("TFSEX_SERVICEHOOKS_SECRET"); secret != "" {
+		configLogger.WithField("envVar", "TFSEX_SERVICEHOOKS_SECRET").Info("Using service hooks secret from environment variable")
+		c.ServiceHooks.Secret = secret
+	}
+
+	for name, sink := range c.Sinks {
+		envVar := strings.ToUpper(fmt.Sprintf("TFSEX_SINK_%v_TOKEN", name))
+		if token := os.Getenv(envVar); token != "" {
+			configLogger.WithFields(log.Fields{"sink": name, "envVar": envVar}).Info("Using sink token from environment variable")
+			sink.Token = token
+			c.Sinks[name] = sink
+		}
+	}
+
+	if password := os.Getenv("TFSEX_PUSH_PASSWORD"); password != "" {
+		configLogger.WithField("envVar", "TFSEX_PUSH_PASSWORD").Info("Using push password from environment variable")
+		c.Push.Password = password
+	}
+	if token := os.Getenv("TFSEX_PUSH_BEARERTOKEN"); token != "" {
+		configLogger.WithField("envVar", "TFSEX_PUSH_BEARERTOKEN").Info("Using push bearer token from environment variable")
+		c.Push.BearerToken = token
+	}
+}
+
+// serverFromEnvironment fills in the secrets and credentials of a server or module. envName is the name used in its TFSEX_ environment variables.
+func serverFromEnvironment(field string, envName string, server *Server, configLogger *log.Entry) {
+
+	//Check if access token exists as an Env Var
+	envVar := accessTokenEnvVar(envName)
+	accessToken := os.Getenv(envVar)
+
+	if accessToken != "" {
+		configLogger.WithFields(log.Fields{"serverName": field, "envVar": envVar}).Info("Using AccessToken from environment variable")
+
+		// AccessToken might already have been set from the config file. Just log we are going to override it.
+		if server.AccessToken != "" {
+			configLogger.WithFields(log.Fields{"serverName": field, "envVar": envVar}).Warning("AccessToken in config file will be overridden by AccessToken from environment variable")
+		}
+
+		// Assign EnvVar accessToken to the config object.
+		server.AccessToken = accessToken
+	} else {
+		configLogger.WithFields(log.Fields{"serverName": field, "envVar": envVar}).Debug("Environment variable for AccessToken does not exist")
+	}
+
+	authFromEnvironment(field, envName, &server.Auth, configLogger)
+	proxyFromEnvironment(&server.Proxy, fmt.Sprintf("TFSEX_%v_PROXY", envName))
+}
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var proxySchemes = map[string]bool{"http": true, "https": true, "socks5": true}
+
+// proxyFromEnvironment sets the credentials of a proxy from environment variables.
+// envPrefix is TFSEX_PROXY for the global proxy and TFSEX_<server name>_PROXY for a server's proxy.
+func proxyFromEnvironment(p *Proxy, envPrefix string) {
+	if username := os.Getenv(strings.ToUpper(envPrefix + "_USERNAME")); username != "" {
+		p.Username = username
+		p.Password = os.Getenv(strings.ToUpper(envPrefix + "_PASSWORD"))
+	}
+}
+
+// validateProxy checks the proxy URL can be used by a transport. Safe even if the URL is empty.
+func validateProxy(p Proxy) error {
+	if p.URL == "" {
+		return nil
+	}
+
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return fmt.Errorf("url cannot be parsed as a URL - %v", err)
+	}
+	if !proxySchemes[strings.ToLower(u.Scheme)] {
+		return fmt.Errorf("url scheme %q is not one of http, https or socks5", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("url %v has no host", p.URL)
+	}
+
+	return nil
+}
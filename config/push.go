@@ -0,0 +1,32 @@
+package config
+
+import "net/url"
+
+// validatePush returns everything wrong with the push settings
+func validatePush(p Push) Errors {
+	var errs Errors
+
+	if p.Mode != PushModeRemoteWrite && p.Mode != PushModePushgateway {
+		errs = append(errs, fieldError("push.mode", "unknown mode %q. Must be %v or %v", p.Mode, PushModeRemoteWrite, PushModePushgateway))
+	}
+
+	if u, err := url.Parse(p.URL); err != nil {
+		errs = append(errs, fieldError("push.url", "cannot be parsed as a URL - %v", err))
+	} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fieldError("push.url", "%v is not an http(s) URL", p.URL))
+	}
+
+	if p.Interval.Duration < 0 {
+		errs = append(errs, fieldError("push.interval", "%v is not a valid interval", p.Interval.Duration))
+	}
+
+	if p.BearerToken != "" && p.Username != "" {
+		errs = append(errs, fieldError("push", "only one of a username and password or a bearer token can be set"))
+	}
+
+	if _, err := p.TLS.ClientConfig(); err != nil {
+		errs = append(errs, fieldError("push.tls", "%v", err))
+	}
+
+	return errs
+}
@@ -0,0 +1,32 @@
+package config
+
+import "net/url"
+
+// validateSink returns everything wrong with a sink
+func validateSink(field string, s Sink) Errors {
+	var errs Errors
+
+	schemes := map[string]bool{}
+	switch s.Format {
+	case SinkFormatDogStatsD:
+		schemes["udp"] = true
+	case SinkFormatInflux:
+		schemes["udp"], schemes["http"], schemes["https"] = true, true, true
+	default:
+		errs = append(errs, fieldError(field+".format", "unknown format %q. Must be %v or %v", s.Format, SinkFormatDogStatsD, SinkFormatInflux))
+	}
+
+	if u, err := url.Parse(s.URL); err != nil {
+		errs = append(errs, fieldError(field+".url", "cannot be parsed as a URL - %v", err))
+	} else if u.Host == "" {
+		errs = append(errs, fieldError(field+".url", "%q has no host", s.URL))
+	} else if len(schemes) > 0 && !schemes[u.Scheme] {
+		errs = append(errs, fieldError(field+".url", "scheme %q can't be used with format %v", u.Scheme, s.Format))
+	}
+
+	if s.Interval.Duration < 0 {
+		errs = append(errs, fieldError(field+".interval", "%v is not a valid interval", s.Interval.Duration))
+	}
+
+	return errs
+}
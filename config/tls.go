@@ -0,0 +1,59 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ClientConfig creates the TLS config used to connect to a server.
+// The CA file is added to the system's CAs rather than replacing them so a proxy and public endpoints still verify.
+func (t TLS) ClientConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: t.ServerName}
+
+	if t.MinVersion != "" {
+		version, ok := tlsVersions[t.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("minVersion %v is not one of 1.0, 1.1, 1.2 or 1.3", t.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if t.CAFile != "" {
+		caCerts, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read caFile - %v", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caCerts) {
+			return nil, fmt.Errorf("caFile %v does not contain any PEM encoded certificates", t.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if t.CertFile != "" || t.KeyFile != "" {
+		if t.CertFile == "" || t.KeyFile == "" {
+			return nil, fmt.Errorf("certFile and keyFile must both be set for a client certificate")
+		}
+
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate - %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate and its key as PEM files, and returns their paths and the certificate
+func writeCertificate(t *testing.T, name string) (certFile string, keyFile string, cert *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = writeConfig(t, name+".pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	keyFile = writeConfig(t, name+"-key.pem", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+	return certFile, keyFile, cert
+}
+
+func TestTLSClientConfig(t *testing.T) {
+	caFile, _, ca := writeCertificate(t, "ca.internal")
+	certFile, keyFile, _ := writeCertificate(t, "client.internal")
+	_, otherKeyFile, _ := writeCertificate(t, "other.internal")
+	notPEM := writeConfig(t, "ca.txt", "not a certificate")
+
+	tests := []struct {
+		name    string
+		tls     TLS
+		wantErr string
+		check   func(t *testing.T, c *tls.Config)
+	}{
+		{
+			name: "empty",
+			check: func(t *testing.T, c *tls.Config) {
+				if c.RootCAs != nil || len(c.Certificates) != 0 || c.ServerName != "" || c.MinVersion != 0 || c.InsecureSkipVerify {
+					t.Errorf("got %+v, want the defaults", c)
+				}
+			},
+		},
+		{
+			name: "ca file",
+			tls:  TLS{CAFile: caFile},
+			check: func(t *testing.T, c *tls.Config) {
+				if _, err := ca.Verify(x509.VerifyOptions{Roots: c.RootCAs, DNSName: "ca.internal"}); err != nil {
+					t.Errorf("the CA isn't trusted - %v", err)
+				}
+			},
+		},
+		{name: "missing ca file", tls: TLS{CAFile: filepath.Join(t.TempDir(), "missing.pem")}, wantErr: "could not read caFile"},
+		{name: "ca file without certificates", tls: TLS{CAFile: notPEM}, wantErr: "does not contain any PEM encoded certificates"},
+		{
+			name: "client certificate",
+			tls:  TLS{CertFile: certFile, KeyFile: keyFile},
+			check: func(t *testing.T, c *tls.Config) {
+				if len(c.Certificates) != 1 {
+					t.Errorf("got %v client certificates, want 1", len(c.Certificates))
+				}
+			},
+		},
+		{name: "client certificate without its key", tls: TLS{CertFile: certFile}, wantErr: "certFile and keyFile must both be set"},
+		{name: "client key without its certificate", tls: TLS{KeyFile: keyFile}, wantErr: "certFile and keyFile must both be set"},
+		{name: "client certificate with another key", tls: TLS{CertFile: certFile, KeyFile: otherKeyFile}, wantErr: "could not load client certificate"},
+		{
+			name: "server name",
+			tls:  TLS{ServerName: "azdo.internal"},
+			check: func(t *testing.T, c *tls.Config) {
+				if c.ServerName != "azdo.internal" {
+					t.Errorf("got server name %q, want azdo.internal", c.ServerName)
+				}
+			},
+		},
+		{
+			name: "min version",
+			tls:  TLS{MinVersion: "1.2"},
+			check: func(t *testing.T, c *tls.Config) {
+				if c.MinVersion != tls.VersionTLS12 {
+					t.Errorf("got min version %x, want TLS 1.2", c.MinVersion)
+				}
+			},
+		},
+		{name: "unknown min version", tls: TLS{MinVersion: "1.4"}, wantErr: "minVersion 1.4 is not one of"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := test.tls.ClientConfig()
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.check(t, c)
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package config
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// VariablePrefix starts the name of every environment variable which maps to a setting of the config
+const VariablePrefix = "AZDOEX_"
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// FromVariables sets the config from AZDOEX_ environment variables, overriding the config file.
+// The name of a variable is the path to the setting in upper case separated by _, e.g. AZDOEX_EXPORTER_PORT or AZDOEX_SERVERS_<NAME>_AUTH_METHOD.
+// The name of an entry of a table, such as a server, module, sink or OTLP header, follows the table's name. An entry which isn't in the config file is added.
+// Lists, such as accessTokenCommand, are split on spaces.
+func (c *Config) FromVariables(environ []string, configLogger *log.Entry) error {
+	var errs Errors
+
+	for _, variable := range environ {
+		parts := strings.SplitN(variable, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], VariablePrefix) {
+			continue
+		}
+		envVar, value := parts[0], parts[1]
+
+		if err := setSetting(reflect.ValueOf(c).Elem(), strings.TrimPrefix(envVar, VariablePrefix), value); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", envVar, err))
+			continue
+		}
+		configLogger.WithField("envVar", envVar).Info("Using setting from environment variable")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// setEntrySetting sets a setting of the entry of the table m named at the start of path, e.g. AZDO_AUTH_METHOD of servers.
+// Names can contain _ so the longest setting path which ends path is used, or for a table of values, such as headers, all of path is the name.
+func setEntrySetting(m reflect.Value, path string, value string) error {
+	entryType := m.Type().Elem()
+	name, setting := path, ""
+	if !isLeaf(entryType) {
+		upperPath := strings.ToUpper(path)
+		for _, p := range settingPaths(entryType, "") {
+			if len(p) > len(setting) && len(upperPath) > len(p)+1 && strings.HasSuffix(upperPath, "_"+p) {
+				setting = p
+			}
+		}
+		// A table within the entry, such as a sink's tags, ends with a name of its own rather than a setting
+		if setting == "" {
+			for _, table := range tablePaths(entryType) {
+				if i := strings.Index(upperPath, "_"+table+"_"); i > 0 && len(upperPath) > i+len(table)+2 {
+					setting = path[i+1:]
+					break
+				}
+			}
+		}
+		if setting == "" {
+			return fmt.Errorf("does not end with a setting of %v", strings.ToLower(entryType.Name()))
+		}
+		name = path[:len(path)-len(setting)-1]
+	}
+
+	if m.IsNil() {
+		m.Set(reflect.MakeMap(m.Type()))
+	}
+
+	// Environment variables are often upper case, so use the entry from the config file whatever its case
+	for _, existing := range m.MapKeys() {
+		if strings.EqualFold(existing.String(), name) {
+			name = existing.String()
+			break
+		}
+	}
+	key := reflect.ValueOf(name).Convert(m.Type().Key())
+
+	entry := reflect.New(entryType).Elem()
+	if existing := m.MapIndex(key); existing.IsValid() {
+		entry.Set(existing)
+	}
+
+	var err error
+	if setting == "" {
+		err = setValue(entry, value)
+	} else {
+		err = setSetting(entry, setting, value)
+	}
+	if err != nil {
+		return err
+	}
+	m.SetMapIndex(key, entry)
+	return nil
+}
+
+// setSetting sets the field of the struct v found by following path, e.g. AUTH_METHOD
+func setSetting(v reflect.Value, path string, value string) error {
+	upperPath := strings.ToUpper(path)
+
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.Tag.Get("toml") == "-" || !settable(field.Type) {
+			continue
+		}
+
+		if field.Anonymous {
+			for _, p := range settingPaths(field.Type, "") {
+				if p == upperPath {
+					return setSetting(v.Field(i), path, value)
+				}
+			}
+			continue
+		}
+
+		name := strings.ToUpper(field.Name)
+		switch {
+		case upperPath == name && isLeaf(field.Type):
+			return setValue(v.Field(i), value)
+		case strings.HasPrefix(upperPath, name+"_") && field.Type.Kind() == reflect.Map:
+			return setEntrySetting(v.Field(i), path[len(name)+1:], value)
+		case strings.HasPrefix(upperPath, name+"_") && !isLeaf(field.Type):
+			return setSetting(v.Field(i), path[len(name)+1:], value)
+		}
+	}
+
+	return fmt.Errorf("is not a setting")
+}
+
+func setValue(f reflect.Value, value string) error {
+	if reflect.PtrTo(f.Type()).Implements(textUnmarshalerType) {
+		return f.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(value))
+	}
+
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(value)
+	case reflect.Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		f.SetInt(int64(i))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		f.SetBool(b)
+	case reflect.Slice:
+		f.Set(reflect.ValueOf(strings.Fields(value)))
+	}
+	return nil
+}
+
+// settingPaths lists the path of every setting in the struct t, e.g. ADDRESS and AUTH_METHOD for a server.
+// Tables within t aren't listed as the names of their entries aren't known.
+func settingPaths(t reflect.Type, prefix string) []string {
+	var paths []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Tag.Get("toml") == "-" || !settable(field.Type) || field.Type.Kind() == reflect.Map {
+			continue
+		}
+
+		switch {
+		case field.Anonymous:
+			paths = append(paths, settingPaths(field.Type, prefix)...)
+		case isLeaf(field.Type):
+			paths = append(paths, prefix+strings.ToUpper(field.Name))
+		default:
+			paths = append(paths, settingPaths(field.Type, prefix+strings.ToUpper(field.Name)+"_")...)
+		}
+	}
+	return paths
+}
+
+// tablePaths lists the path of every table in the struct t, e.g. TAGS for a sink
+func tablePaths(t reflect.Type) []string {
+	var paths []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Tag.Get("toml") == "-" || !settable(field.Type) {
+			continue
+		}
+
+		switch {
+		case field.Anonymous:
+			paths = append(paths, tablePaths(field.Type)...)
+		case field.Type.Kind() == reflect.Map:
+			paths = append(paths, strings.ToUpper(field.Name))
+		}
+	}
+	return paths
+}
+
+// settable is true for the types which can be set from a variable, or structs and tables which hold them
+func settable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Int, reflect.Bool, reflect.Struct:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.String
+	case reflect.Map:
+		return t.Key().Kind() == reflect.String && settable(t.Elem())
+	}
+	return false
+}
+
+// isLeaf is true for a setting which is set from a single variable, rather than a table of them
+func isLeaf(t reflect.Type) bool {
+	return (t.Kind() != reflect.Struct && t.Kind() != reflect.Map) || reflect.PtrTo(t).Implements(textUnmarshalerType)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"azdoexporter/azdo"
+)
+
+const dashboardPath = "/dashboard"
+
+// dashboardPage is the data every dashboard template is rendered with
+type dashboardPage struct {
+	Now          time.Time
+	Server       string
+	SnapshotTime time.Time
+	Error        string // Why the last scrape failed, if it did, in which case the snapshot is from the last to succeed
+}
+
+type dashboardServer struct {
+	Name         string
+	Address      string
+	Status       scrapeStatus
+	SnapshotTime time.Time
+	Pools        []dashboardPool
+	Queued       []dashboardJob // Queued on any of the pools, oldest first
+}
+
+// dashboardPool counts the agents of a pool. Online agents are those online and not running a job, which are busy
+type dashboardPool struct {
+	azdo.Pool
+	Online  int
+	Busy    int
+	Offline int
+	Queued  int
+	Running int
+}
+
+type dashboardAgent struct {
+	azdo.Agent
+	Job *azdo.Job // The job the agent is running, if any
+}
+
+type dashboardJob struct {
+	azdo.Job
+	Pool azdo.Pool
+}
+
+// dashboardHandler renders a page of every server and its pools, and a page per pool, from the snapshot of the last scrape of each server's agents which succeeded:
+//
+//	/dashboard
+//	/dashboard/<name>/pools/<id>
+type dashboardHandler struct {
+	servers *serverManager
+}
+
+func (h dashboardHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, dashboardPath), "/"), "/")
+	if len(parts) == 1 && parts[0] == "" {
+		h.serveServers(w)
+		return
+	}
+
+	if len(parts) != 3 || parts[1] != "pools" {
+		http.NotFound(w, r)
+		return
+	}
+
+	collector, ok := h.servers.agentsCollector(parts[0])
+	if !ok {
+		http.Error(w, "Unknown server "+parts[0], http.StatusNotFound)
+		return
+	}
+	snapshot, snapshotTime := collector.lastSnapshot()
+	for _, p := range snapshot {
+		if strconv.Itoa(p.pool.ID) == parts[2] {
+			h.servePool(w, dashboardPage{Now: time.Now(), Server: parts[0], SnapshotTime: snapshotTime, Error: collector.scrapeStatus().Error}, p)
+			return
+		}
+	}
+	http.Error(w, "Unknown pool "+parts[2], http.StatusNotFound)
+}
+
+func (h dashboardHandler) serveServers(w http.ResponseWriter) {
+	h.servers.mu.RLock()
+	servers := make([]dashboardServer, 0, len(h.servers.servers))
+	for name, s := range h.servers.servers {
+		snapshot, snapshotTime := s.agents.lastSnapshot()
+		server := dashboardServer{Name: name, Address: s.settings.Address, Status: s.agents.scrapeStatus(), SnapshotTime: snapshotTime}
+
+		for _, p := range snapshot {
+			pool := dashboardPool{Pool: p.pool}
+			for _, agent := range poolAgents(p) {
+				switch {
+				case !strings.EqualFold(agent.Status, "online"):
+					pool.Offline++
+				case agent.Job != nil:
+					pool.Busy++
+				default:
+					pool.Online++
+				}
+			}
+			for _, job := range p.currentJobs {
+				if job.AssignTime.IsZero() {
+					pool.Queued++
+					server.Queued = append(server.Queued, dashboardJob{Job: job, Pool: p.pool})
+				} else {
+					pool.Running++
+				}
+			}
+			server.Pools = append(server.Pools, pool)
+		}
+		sort.Slice(server.Queued, func(i, j int) bool { return server.Queued[i].QueueTime.Before(server.Queued[j].QueueTime) })
+
+		servers = append(servers, server)
+	}
+	h.servers.mu.RUnlock()
+
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Name < servers[j].Name })
+	renderDashboard(w, "servers", struct {
+		dashboardPage
+		Servers []dashboardServer
+	}{dashboardPage{Now: time.Now()}, servers})
+}
+
+func (h dashboardHandler) servePool(w http.ResponseWriter, page dashboardPage, p poolSnapshot) {
+	var queued, running []azdo.Job
+	for _, job := range p.currentJobs {
+		if job.AssignTime.IsZero() {
+			queued = append(queued, job)
+		} else {
+			running = append(running, job)
+		}
+	}
+	sort.Slice(queued, func(i, j int) bool { return queued[i].QueueTime.Before(queued[j].QueueTime) })
+
+	renderDashboard(w, "pool", struct {
+		dashboardPage
+		Pool    azdo.Pool
+		Agents  []dashboardAgent
+		Queued  []azdo.Job
+		Running []azdo.Job
+		Recent  []azdo.Job
+	}{page, p.pool, poolAgents(p), queued, running, p.recentJobs})
+}
+
+// poolAgents returns the pool's agents sorted by name, with the job each is running
+func poolAgents(p poolSnapshot) []dashboardAgent {
+	running := make(map[int]azdo.Job)
+	for _, job := range p.currentJobs {
+		if !job.AssignTime.IsZero() {
+			running[job.ReservedAgent.ID] = job
+		}
+	}
+
+	agents := make([]dashboardAgent, 0, len(p.agents))
+	for _, agent := range p.agents {
+		a := dashboardAgent{Agent: agent}
+		if job, ok := running[agent.ID]; ok {
+			a.Job = &job
+		}
+		agents = append(agents, a)
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].Name < agents[j].Name })
+	return agents
+}
+
+// renderDashboard renders a page before writing any of it, so a page which fails to render is an error rather than half a page
+func renderDashboard(w http.ResponseWriter, name string, data interface{}) {
+	var page bytes.Buffer
+	if err := dashboardTemplates.ExecuteTemplate(&page, name, data); err != nil {
+		log.WithFields(log.Fields{"page": name, "error": err}).Error("Failed to render dashboard")
+		http.Error(w, "Failed to render dashboard", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	page.WriteTo(w)
+}
+
+// since formats how long ago t was, to the second
+func since(now time.Time, t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return now.Sub(t).Round(time.Second).String()
+}
+
+//go:embed templates/*.html
+var dashboardFiles embed.FS
+
+var dashboardTemplates = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"since": since,
+	"duration": func(from, to time.Time) string {
+		if from.IsZero() || to.IsZero() {
+			return ""
+		}
+		return to.Sub(from).Round(time.Second).String()
+	},
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.Local().Format("2006-01-02 15:04:05")
+	},
+}).ParseFS(dashboardFiles, "templates/*.html"))
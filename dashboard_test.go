@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDashboardHandler(t *testing.T) {
+	handler := dashboardHandler{snapshotServers(t)}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		wantCode int
+		want     []string
+	}{
+		{
+			name: "servers", path: "/dashboard", wantCode: http.StatusOK,
+			want: []string{"<h2>s1</h2>", `<a href="/dashboard/s1/pools/1">Default</a>`, "(hosted)", "Queued job", "<h2>s2</h2>", "could not retrieve pools", "Not scraped yet."},
+		},
+		{
+			name: "pool", path: "/dashboard/s1/pools/1", wantCode: http.StatusOK,
+			want: []string{"<h1>Default</h1>", "agent-1", "agent-2", "Queued job", "Running job", "Finished job", `<td class="failed">failed</td>`},
+		},
+		{
+			name: "pool without agents or jobs", path: "/dashboard/s1/pools/2", wantCode: http.StatusOK,
+			want: []string{"<h1>Hosted</h1>", "No agents", "No queued jobs", "No running jobs", "No jobs have finished"},
+		},
+		{name: "unknown server", path: "/dashboard/missing/pools/1", wantCode: http.StatusNotFound},
+		{name: "server not scraped yet", path: "/dashboard/s2/pools/1", wantCode: http.StatusNotFound},
+		{name: "unknown pool", path: "/dashboard/s1/pools/99", wantCode: http.StatusNotFound},
+		{name: "unknown page", path: "/dashboard/s1", wantCode: http.StatusNotFound},
+		{name: "post", method: http.MethodPost, path: "/dashboard", wantCode: http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			method := test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(method, test.path, nil))
+
+			if w.Code != test.wantCode {
+				t.Fatalf("got status %v, want %v: %v", w.Code, test.wantCode, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			body := w.Body.String()
+			if !strings.HasSuffix(strings.TrimSpace(body), "</html>") {
+				t.Errorf("got a page which wasn't rendered to the end: %v", body)
+			}
+			for _, want := range test.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("the page doesn't contain %q", want)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderDashboardFailsOnTemplateErrors(t *testing.T) {
+	w := httptest.NewRecorder()
+	renderDashboard(w, "pool", struct{ Server string }{"s1"}) // Missing the fields the page needs
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got status %v, want %v", w.Code, http.StatusInternalServerError)
+	}
+	if strings.Contains(w.Body.String(), "<html>") {
+		t.Error("half of the page was written")
+	}
+}
+
+func TestDashboardShowsTheLastScrapeWhichSucceeded(t *testing.T) {
+	servers := snapshotServers(t)
+	servers.servers["s1"].agents.recordScrape(time.Now(), 2, errors.New("could not retrieve agents for pool 1"))
+	handler := dashboardHandler{servers}
+
+	for _, path := range []string{"/dashboard", "/dashboard/s1/pools/1"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+
+		body := w.Body.String()
+		if w.Code != http.StatusOK || !strings.Contains(body, "Default") {
+			t.Fatalf("got status %v, want %v with the snapshot of the scrape before: %v", w.Code, http.StatusOK, body)
+		}
+		if !strings.Contains(body, "last scrape to succeed") && !strings.Contains(body, "last one to succeed") {
+			t.Errorf("%v doesn't say the snapshot is from the last scrape to succeed", path)
+		}
+		if !strings.Contains(body, "could not retrieve agents for pool 1") {
+			t.Errorf("%v doesn't show why the latest scrape failed", path)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"azdoexporter/azdo"
+	"azdoexporter/config"
+)
+
+var dogStatsDTagReplacer = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", " ")
+
+// dogStatsDFormat formats metrics as DogStatsD, with their labels as tags.
+// DogStatsD counts are increments, so counters, and the count and sum of histograms and summaries, are sent as the increase since the last send.
+type dogStatsDFormat struct {
+	prefix string
+	tags   map[string]string
+
+	previous map[string]float64 // The last value of each cumulative series. Only used from the sink's send
+}
+
+func newDogStatsDFormat(settings config.Sink) *dogStatsDFormat {
+	return &dogStatsDFormat{prefix: settings.Prefix, tags: settings.Tags, previous: make(map[string]float64)}
+}
+
+func (f *dogStatsDFormat) formatMetrics(families []*dto.MetricFamily, now time.Time) []string {
+	var lines []string
+	seen := make(map[string]float64, len(f.previous))
+
+	count := func(name string, tags string, value float64) {
+		key := name + "|" + tags
+		seen[key] = value
+
+		// The first value is only a baseline. A lower value means the counter was reset, e.g. the server was reloaded
+		previous, ok := f.previous[key]
+		if !ok {
+			return
+		}
+		increase := value - previous
+		if increase < 0 {
+			increase = value
+		}
+		lines = append(lines, f.line(name, increase, "c", tags))
+	}
+
+	for _, family := range families {
+		name := family.GetName()
+		// The job histograms are sent as an observation of each job by formatJobs, so the agent aggregates them, rather than as their count and sum
+		if jobHistogramNames[name] {
+			continue
+		}
+
+		for _, m := range family.GetMetric() {
+			tags := f.formatTags(sortedTags(m.GetLabel(), f.tags))
+
+			switch family.GetType() {
+			case dto.MetricType_GAUGE:
+				lines = append(lines, f.line(name, m.GetGauge().GetValue(), "g", tags))
+			case dto.MetricType_UNTYPED:
+				lines = append(lines, f.line(name, m.GetUntyped().GetValue(), "g", tags))
+			case dto.MetricType_COUNTER:
+				count(name, tags, m.GetCounter().GetValue())
+			case dto.MetricType_SUMMARY:
+				count(name+"_count", tags, float64(m.GetSummary().GetSampleCount()))
+				count(name+"_sum", tags, m.GetSummary().GetSampleSum())
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				count(name+"_count", tags, float64(m.GetHistogram().GetSampleCount()))
+				count(name+"_sum", tags, m.GetHistogram().GetSampleSum())
+			}
+		}
+	}
+
+	// Series which are gone, e.g. a removed server's, are forgotten
+	f.previous = seen
+	return removeEmpty(lines)
+}
+
+// formatJobs sends each job's durations as histogram observations, so the agent aggregates them
+func (f *dogStatsDFormat) formatJobs(server string, pool azdo.Pool, jobs []azdo.Job) []string {
+	var lines []string
+	for _, job := range jobs {
+		tags := f.formatTags(jobTags(server, pool, job, f.tags))
+
+		total, queue, running, received := jobDurations(job)
+		lines = append(lines, f.line("tfs_pool_job_total_length_secs", total.Seconds(), "h", tags))
+		if received {
+			lines = append(lines, f.line("tfs_pool_job_queue_length_secs", queue.Seconds(), "h", tags))
+			lines = append(lines, f.line("tfs_pool_job_running_length_secs", running.Seconds(), "h", tags))
+		}
+	}
+	return lines
+}
+
+// line formats one metric. It's empty for values DogStatsD can't take
+func (f *dogStatsDFormat) line(name string, value float64, metricType string, tags string) string {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return ""
+	}
+
+	line := fmt.Sprintf("%v%v:%v|%v", f.prefix, name, strconv.FormatFloat(value, 'f', -1, 64), metricType)
+	if tags != "" {
+		line += "|#" + tags
+	}
+	return line
+}
+
+func (f *dogStatsDFormat) formatTags(tags []sinkTag) string {
+	formatted := make([]string, 0, len(tags))
+	for _, t := range tags {
+		if t.value == "" {
+			continue
+		}
+		formatted = append(formatted, dogStatsDTagReplacer.Replace(t.name)+":"+dogStatsDTagReplacer.Replace(t.value))
+	}
+	return strings.Join(formatted, ",")
+}
+
+func removeEmpty(lines []string) []string {
+	kept := lines[:0]
+	for _, line := range lines {
+		if line != "" {
+			kept = append(kept, line)
+		}
+	}
+	return kept
+}
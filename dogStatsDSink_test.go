@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"azdoexporter/azdo"
+	"azdoexporter/config"
+)
+
+func TestDogStatsDSinkOverUDP(t *testing.T) {
+	listener, packets := udpListener(t)
+	defer listener.Close()
+
+	reg, counter, histograms := testRegistry(t, "a,b|c#d")
+	settings := config.Sink{
+		Format:   config.SinkFormatDogStatsD,
+		URL:      "udp://" + listener.LocalAddr().String(),
+		Prefix:   "azdo.",
+		Tags:     map[string]string{"env": "prod x", "name": "overridden by the label"},
+		Interval: config.Duration{Duration: 5 * time.Second},
+	}
+	s, err := newSink("test", settings, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first send is the baseline of the counts
+	if err := s.send(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	receivePackets(t, packets)
+
+	pool, job := testJob()
+	counter.Add(2)
+	observeJobHistograms(histograms, metricsContext{pool: pool, finishedJobs: []azdo.Job{job}})
+	s.observeJobs("s1", pool, []azdo.Job{job})
+	if err := s.send(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	for _, packet := range receivePackets(t, packets) {
+		lines = append(lines, strings.Split(packet, "\n")...)
+	}
+	sort.Strings(lines)
+
+	jobTags := "|#agent:agent_1,definition:ci_build_2,env:prod x,name:s1,pool:Default pool,result:succeeded"
+	want := []string{
+		"azdo.tfs_pool_job_queue_length_secs:40|h" + jobTags,
+		"azdo.tfs_pool_job_running_length_secs:60|h" + jobTags,
+		"azdo.tfs_pool_job_total_length_secs:100|h" + jobTags,
+		"azdo.tfs_test_gauge:3|g|#env:prod x,name:s1,pool:a_b_c_d",
+		"azdo.tfs_test_total:2|c|#env:prod x,name:s1",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got lines\n%v\nwant\n%v", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// finishedHistograms are histograms of how long what finished took, such as the jobs of each pool, keyed by metric name.
+// The pushes are given cumulative histograms of everything which finished. Prometheus is given histograms of what finished
+// since its last scrape, which its scrape resets. Both are registered apart from the collector which observes what finished,
+// and Prometheus' after it, so a gather for the pushes can't take what finished from Prometheus' next scrape.
+type finishedHistograms struct {
+	cumulative map[string]*prometheus.HistogramVec
+
+	mu      sync.Mutex // Held to observe into scraped, and while Prometheus' scrape collects and resets it
+	scraped map[string]*prometheus.HistogramVec
+}
+
+// histogramObserver is a collector which observes what finished into histograms of its own
+type histogramObserver interface {
+	finishedHistograms() *finishedHistograms
+}
+
+func newFinishedHistograms(labelNames []string, opts ...prometheus.HistogramOpts) *finishedHistograms {
+	h := &finishedHistograms{cumulative: make(map[string]*prometheus.HistogramVec), scraped: make(map[string]*prometheus.HistogramVec)}
+	for _, o := range opts {
+		h.cumulative[o.Name] = prometheus.NewHistogramVec(o, labelNames)
+		h.scraped[o.Name] = prometheus.NewHistogramVec(o, labelNames)
+	}
+	return h
+}
+
+// add makes sure the histograms named have the label values, so they're reported before anything with them finishes
+func (h *finishedHistograms) add(labelValues []string, names ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, name := range names {
+		h.cumulative[name].WithLabelValues(labelValues...)
+		h.scraped[name].WithLabelValues(labelValues...)
+	}
+}
+
+// observe adds how long something which finished took to the histograms named
+func (h *finishedHistograms) observe(name string, d time.Duration, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.cumulative[name].WithLabelValues(labelValues...).Observe(d.Seconds())
+	h.scraped[name].WithLabelValues(labelValues...).Observe(d.Seconds())
+}
+
+// cumulativeHistograms returns the collector of the histograms the pushes are given
+func (h *finishedHistograms) cumulativeHistograms() prometheus.Collector {
+	return cumulativeHistograms{h}
+}
+
+// scrapedHistograms returns the collector of the histograms Prometheus is given
+func (h *finishedHistograms) scrapedHistograms() prometheus.Collector {
+	return scrapedHistograms{h}
+}
+
+type cumulativeHistograms struct {
+	h *finishedHistograms
+}
+
+func (c cumulativeHistograms) Describe(ch chan<- *prometheus.Desc) {
+	for _, vec := range c.h.cumulative {
+		vec.Describe(ch)
+	}
+}
+
+func (c cumulativeHistograms) Collect(ch chan<- prometheus.Metric) {
+	for _, vec := range c.h.cumulative {
+		vec.Collect(ch)
+	}
+}
+
+// scrapedHistograms gives Prometheus what finished since its last scrape, and forgets it
+type scrapedHistograms struct {
+	h *finishedHistograms
+}
+
+func (s scrapedHistograms) Describe(ch chan<- *prometheus.Desc) {
+	for _, vec := range s.h.scraped {
+		vec.Describe(ch)
+	}
+}
+
+func (s scrapedHistograms) Collect(ch chan<- prometheus.Metric) {
+	s.h.mu.Lock()
+	defer s.h.mu.Unlock()
+
+	for _, vec := range s.h.scraped {
+		vec.Collect(ch)
+		vec.Reset()
+	}
+}
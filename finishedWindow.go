@@ -0,0 +1,31 @@
+package main
+
+import "time"
+
+// finishedWindow is what a project's last scrape which succeeded saw, so what finishes is only observed once.
+// Something which finishes while a scrape is in progress finishes after the scrape's start, so the next scrape
+// is given it again. The IDs of what finished after the start are kept to filter it out.
+type finishedWindow struct {
+	start time.Time         // The start of the last scrape which succeeded. Zero until the first has
+	seen  map[int]time.Time // What finished after start, keyed by ID, with when it finished
+}
+
+// unseen returns whether what has the ID hasn't been observed by a previous scrape
+func (w finishedWindow) unseen(id int) bool {
+	_, seen := w.seen[id]
+	return !seen
+}
+
+// next returns the window of a scrape which started at start and succeeded, given the finish time of
+// everything it was given keyed by ID, including what it filtered out as already seen
+func (w finishedWindow) next(start time.Time, finished map[int]time.Time) finishedWindow {
+	seen := make(map[int]time.Time)
+	for _, ids := range []map[int]time.Time{w.seen, finished} {
+		for id, finish := range ids {
+			if finish.After(start) {
+				seen[id] = finish
+			}
+		}
+	}
+	return finishedWindow{start: start, seen: seen}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"azdoexporter/config"
+)
+
+// sharedGatherer gathers the registry for Prometheus' scrapes and for everything which pushes the metrics, OTLP, the pusher and the sinks.
+// Each gather scrapes Azure DevOps, so the pushes reuse the last gather if it's recent enough rather than each scraping on its own schedule.
+// What's gathered is shared, so it must not be modified.
+//
+// The job histograms aren't in the registry. Prometheus is given those of the jobs since its last scrape, and the pushes cumulative ones,
+// so a gather for the pushes doesn't take the jobs which finished from Prometheus.
+type sharedGatherer struct {
+	gatherer prometheus.Gatherer
+	scraped  prometheus.Gatherer // Only gathered for Prometheus' scrapes, after gatherer, as it's what gatherer's scrapes observed
+	pushed   prometheus.Gatherer // Only gathered for the pushes
+
+	mu       sync.Mutex // Only held to read or update what was gathered, so scrapes run concurrently
+	maxAge   time.Duration
+	families []*dto.MetricFamily
+	err      error
+	gathered time.Time // When the gather kept started
+}
+
+func newSharedGatherer(gatherer, scraped, pushed prometheus.Gatherer) *sharedGatherer {
+	return &sharedGatherer{gatherer: gatherer, scraped: scraped, pushed: pushed}
+}
+
+// setPushInterval makes the pushes reuse a gather for up to the shortest interval anything pushes at
+func (g *sharedGatherer) setPushInterval(c config.Config) {
+	var intervals []time.Duration
+	if c.OTLP.Endpoint != "" {
+		intervals = append(intervals, c.OTLP.Interval.Duration)
+	}
+	if c.Push.URL != "" {
+		intervals = append(intervals, c.Push.Interval.Duration)
+	}
+	for _, sink := range c.Sinks {
+		intervals = append(intervals, sink.Interval.Duration)
+	}
+
+	var maxAge time.Duration
+	for _, interval := range intervals {
+		if maxAge == 0 || interval < maxAge {
+			maxAge = interval
+		}
+	}
+
+	g.mu.Lock()
+	g.maxAge = maxAge
+	g.mu.Unlock()
+}
+
+// Gather always gathers, as Prometheus expects a scrape to be current. What's gathered is kept for the pushes
+func (g *sharedGatherer) Gather() ([]*dto.MetricFamily, error) {
+	return prometheus.Gatherers{
+		prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return g.gather(false)
+		}),
+		g.scraped,
+	}.Gather()
+}
+
+// recent returns a gatherer for the pushes, which reuses the last gather if it's within the push interval
+func (g *sharedGatherer) recent() prometheus.Gatherer {
+	return prometheus.Gatherers{
+		prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return g.gather(true)
+		}),
+		g.pushed,
+	}
+}
+
+func (g *sharedGatherer) gather(reuse bool) ([]*dto.MetricFamily, error) {
+	g.mu.Lock()
+	if reuse && !g.gathered.IsZero() && time.Since(g.gathered) < g.maxAge {
+		families, err := g.families, g.err
+		g.mu.Unlock()
+		return families, err
+	}
+	g.mu.Unlock()
+
+	started := time.Now()
+	families, err := g.gatherer.Gather()
+
+	// Gathers which overlap finish in any order, so only one which started after the gather kept replaces it
+	g.mu.Lock()
+	if started.After(g.gathered) {
+		g.families, g.err, g.gathered = families, err, started
+	}
+	g.mu.Unlock()
+	return families, err
+}
+
+// serverFamilies returns the metrics of one server, without their name label, from what was gathered for every server.
+// The metrics are copied rather than modified as what was gathered is shared.
+func serverFamilies(families []*dto.MetricFamily, name string) []*dto.MetricFamily {
+	var filtered []*dto.MetricFamily
+	for _, family := range families {
+		var metrics []*dto.Metric
+		for _, m := range family.Metric {
+			labels := make([]*dto.LabelPair, 0, len(m.Label))
+			server := false
+			for _, label := range m.Label {
+				if label.GetName() == "name" {
+					server = label.GetValue() == name
+					continue
+				}
+				labels = append(labels, label)
+			}
+			if !server {
+				continue
+			}
+
+			metrics = append(metrics, &dto.Metric{
+				Label:       labels,
+				Gauge:       m.Gauge,
+				Counter:     m.Counter,
+				Summary:     m.Summary,
+				Untyped:     m.Untyped,
+				Histogram:   m.Histogram,
+				TimestampMs: m.TimestampMs,
+			})
+		}
+
+		if len(metrics) > 0 {
+			filtered = append(filtered, &dto.MetricFamily{Name: family.Name, Help: family.Help, Type: family.Type, Unit: family.Unit, Metric: metrics})
+		}
+	}
+	return filtered
+}
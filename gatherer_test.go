@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"azdoexporter/azdo"
+)
+
+func TestSharedGathererScrapesConcurrently(t *testing.T) {
+	// Each gather waits until the other has started, so they only both finish if neither waits for the other
+	var started atomic.Int32
+	both := make(chan struct{})
+	g := newSharedGatherer(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		if started.Add(1) == 2 {
+			close(both)
+		}
+		select {
+		case <-both:
+		case <-time.After(5 * time.Second):
+			t.Error("a gather waited for another to finish")
+		}
+		return nil, nil
+	}), prometheus.Gatherers{}, prometheus.Gatherers{})
+
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go func() {
+			g.Gather()
+			done <- struct{}{}
+		}()
+	}
+	<-done
+	<-done
+}
+
+func TestSharedGathererReusesRecentGathers(t *testing.T) {
+	var gathers atomic.Int32
+	g := newSharedGatherer(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		gathers.Add(1)
+		return nil, nil
+	}), prometheus.Gatherers{}, prometheus.Gatherers{})
+	g.maxAge = time.Hour
+
+	g.Gather()
+	g.recent().Gather()
+	if n := gathers.Load(); n != 1 {
+		t.Errorf("got %v gathers, want a push to reuse the scrape's", n)
+	}
+
+	// Prometheus' scrapes are always current
+	g.Gather()
+	if n := gathers.Load(); n != 2 {
+		t.Errorf("got %v gathers, want a scrape to gather again", n)
+	}
+}
+
+func TestSharedGathererLeavesTheFinishedJobsToPrometheus(t *testing.T) {
+	var finished atomic.Int64
+	azdoServer := agentsServer(t, &atomic.Bool{}, &finished)
+
+	sm := newServerManager(t.Context(), prometheus.NewRegistry(), "")
+	azc := newAzDoCollector(azdo.AzDoClient{Client: azdoServer.Client(), Name: "s1", Address: azdoServer.URL, AccessToken: "token"}, true)
+	if err := sm.register("s1", &server{agents: azc, collectors: []prometheus.Collector{azc}}); err != nil {
+		t.Fatal(err)
+	}
+	gatherMetrics(t, sm.gatherer)
+
+	// The job finishes between Prometheus' scrapes, and the pushes, which don't reuse a gather, scrape Azure DevOps before Prometheus does
+	finished.Store(time.Now().UnixNano())
+	for push := 1; push <= 2; push++ {
+		total := gatherMetrics(t, sm.gatherer.recent())["tfs_pool_job_total_length_secs"]
+		if len(total) != 1 || total[0].GetHistogram().GetSampleCount() != 1 {
+			t.Errorf("got %v for push %v, want the job in the cumulative histogram", total, push)
+		}
+	}
+
+	for scrape, want := range []uint64{1, 0} {
+		total := gatherMetrics(t, sm.gatherer)["tfs_pool_job_total_length_secs"]
+		if len(total) != 1 || total[0].GetHistogram().GetSampleCount() != want {
+			t.Errorf("got %v for scrape %v, want %v jobs observed", total, scrape+1, want)
+		}
+	}
+}
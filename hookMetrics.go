@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	hookJobsDesc = prometheus.NewDesc(
+		"tfs_hook_jobs",
+		"Total of queued or running jobs for pipeline, from service hook events",
+		[]string{"pipeline", "state"},
+		nil,
+	)
+
+	hookRunsDesc = prometheus.NewDesc(
+		"tfs_hook_runs_in_progress",
+		"Total of in progress runs for pipeline, from service hook events",
+		[]string{"pipeline"},
+		nil,
+	)
+)
+
+func calculateHookMetrics(jobs map[string]*hookJob, runs map[int]*hookRun) []prometheus.Metric {
+
+	type jobKey struct {
+		pipeline string
+		state    string
+	}
+
+	jobCounts := make(map[jobKey]float64)
+	for _, job := range jobs {
+		state := "queued"
+		if job.running {
+			state = "running"
+		}
+		jobCounts[jobKey{job.pipeline, state}]++
+	}
+
+	runCounts := make(map[string]float64)
+	for _, run := range runs {
+		runCounts[run.pipeline]++
+	}
+
+	promMetrics := []prometheus.Metric{}
+	for k, count := range jobCounts {
+		promMetrics = append(promMetrics, prometheus.MustNewConstMetric(
+			hookJobsDesc,
+			prometheus.GaugeValue,
+			count,
+			k.pipeline,
+			k.state,
+		))
+	}
+
+	for pipeline, count := range runCounts {
+		promMetrics = append(promMetrics, prometheus.MustNewConstMetric(
+			hookRunsDesc,
+			prometheus.GaugeValue,
+			count,
+			pipeline,
+		))
+	}
+
+	return promMetrics
+}
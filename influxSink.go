@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"azdoexporter/azdo"
+	"azdoexporter/config"
+)
+
+var (
+	influxMeasurementReplacer = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", " ")
+	influxTagReplacer         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", " ")
+)
+
+// influxFormat formats metrics as InfluxDB line protocol, with the metric's name as the measurement and its labels as tags.
+// Histograms and summaries have sum and count fields, everything else a value field.
+type influxFormat struct {
+	prefix string
+	tags   map[string]string
+}
+
+func newInfluxFormat(settings config.Sink) *influxFormat {
+	return &influxFormat{prefix: settings.Prefix, tags: settings.Tags}
+}
+
+func (f *influxFormat) formatMetrics(families []*dto.MetricFamily, now time.Time) []string {
+	var lines []string
+	for _, family := range families {
+		name := family.GetName()
+		for _, m := range family.GetMetric() {
+			tags := sortedTags(m.GetLabel(), f.tags)
+
+			timestamp := now
+			if m.TimestampMs != nil {
+				timestamp = time.Unix(0, m.GetTimestampMs()*int64(time.Millisecond))
+			}
+
+			var fields []influxField
+			switch family.GetType() {
+			case dto.MetricType_GAUGE:
+				fields = []influxField{{"value", m.GetGauge().GetValue()}}
+			case dto.MetricType_COUNTER:
+				fields = []influxField{{"value", m.GetCounter().GetValue()}}
+			case dto.MetricType_UNTYPED:
+				fields = []influxField{{"value", m.GetUntyped().GetValue()}}
+			case dto.MetricType_SUMMARY:
+				fields = []influxField{{"count", float64(m.GetSummary().GetSampleCount())}, {"sum", m.GetSummary().GetSampleSum()}}
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				fields = []influxField{{"count", float64(m.GetHistogram().GetSampleCount())}, {"sum", m.GetHistogram().GetSampleSum()}}
+			}
+
+			if line := f.line(name, tags, fields, timestamp); line != "" {
+				lines = append(lines, line)
+			}
+		}
+	}
+	return lines
+}
+
+// formatJobs writes a point for each job at the time it finished, with its durations as fields
+func (f *influxFormat) formatJobs(server string, pool azdo.Pool, jobs []azdo.Job) []string {
+	var lines []string
+	for _, job := range jobs {
+		total, queue, running, received := jobDurations(job)
+
+		fields := []influxField{{"total_length_secs", total.Seconds()}}
+		if received {
+			fields = append(fields, influxField{"queue_length_secs", queue.Seconds()}, influxField{"running_length_secs", running.Seconds()})
+		}
+
+		if line := f.line("tfs_pool_job", jobTags(server, pool, job, f.tags), fields, job.FinishTime); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+type influxField struct {
+	name  string
+	value float64
+}
+
+// line formats one point. Fields InfluxDB can't store, NaN and infinities, are left out. It's empty if no fields are left
+func (f *influxFormat) line(measurement string, tags []sinkTag, fields []influxField, timestamp time.Time) string {
+	var formattedFields []string
+	for _, field := range fields {
+		if math.IsNaN(field.value) || math.IsInf(field.value, 0) {
+			continue
+		}
+		formattedFields = append(formattedFields, influxTagReplacer.Replace(field.name)+"="+strconv.FormatFloat(field.value, 'f', -1, 64))
+	}
+	if len(formattedFields) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString(influxMeasurementReplacer.Replace(f.prefix + measurement))
+	for _, t := range tags {
+		// Tags can't be empty in line protocol
+		if t.value == "" {
+			continue
+		}
+		b.WriteString("," + influxTagReplacer.Replace(t.name) + "=" + influxTagReplacer.Replace(t.value))
+	}
+	b.WriteString(" " + strings.Join(formattedFields, ","))
+	b.WriteString(" " + strconv.FormatInt(timestamp.UnixNano(), 10))
+	return b.String()
+}
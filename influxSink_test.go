@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"azdoexporter/azdo"
+	"azdoexporter/config"
+)
+
+func TestInfluxSinkOverHTTP(t *testing.T) {
+	writes := make(chan *http.Request, 10)
+	bodies := make(chan string, 10)
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		writes <- r
+		bodies <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influx.Close()
+
+	reg, _, _ := testRegistry(t, "a,b=c d")
+	settings := config.Sink{
+		Format:   config.SinkFormatInflux,
+		URL:      influx.URL + "/api/v2/write?org=o&bucket=b",
+		Prefix:   "azdo.",
+		Tags:     map[string]string{"env": "prod x"},
+		Token:    "secret",
+		Interval: config.Duration{Duration: 5 * time.Second},
+	}
+	s, err := newSink("test", settings, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool, job := testJob()
+	s.observeJobs("s1", pool, []azdo.Job{job})
+	if err := s.send(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-writes
+	if r.Method != http.MethodPost || r.URL.RawQuery != "org=o&bucket=b" {
+		t.Errorf("got %v %v, want a POST to the write API", r.Method, r.URL)
+	}
+	if auth := r.Header.Get("Authorization"); auth != "Token secret" {
+		t.Errorf("Authorization header = %q, want the token", auth)
+	}
+
+	lines := strings.Split(<-bodies, "\n")
+	sort.Strings(lines)
+
+	// The metrics are at the time of the send, so only the job's timestamp is known. The job histograms have no series until a job is observed
+	want := []string{
+		`azdo.tfs_pool_job,agent=agent\,1,definition=ci|build#2,env=prod\ x,name=s1,pool=Default\ pool,result=succeeded total_length_secs=100,queue_length_secs=40,running_length_secs=60 ` + strconv.FormatInt(job.FinishTime.UnixNano(), 10),
+		`azdo.tfs_test_gauge,env=prod\ x,name=s1,pool=a\,b\=c\ d value=3 `,
+		`azdo.tfs_test_total,env=prod\ x,name=s1 value=0 `,
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("got lines\n%v\nwant %v lines", strings.Join(lines, "\n"), len(want))
+	}
+	for i := range want {
+		if !strings.HasPrefix(lines[i], want[i]) {
+			t.Errorf("got line\n%v\nwant it to start with\n%v", lines[i], want[i])
+		}
+	}
+}
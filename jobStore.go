@@ -0,0 +1,208 @@
+package main
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	log "github.com/sirupsen/logrus"
+
+	"azdoexporter/azdo"
+	"azdoexporter/config"
+)
+
+// Jobs older than the retention are deleted this often
+const jobStorePruneInterval = time.Hour
+
+// The scrapes of this many pools can be waiting to be written before further ones are dropped
+const jobStoreQueueSize = 256
+
+// A job is a row per server and request ID. Times are seconds since the Unix epoch, NULL until they happen,
+// so durations can be calculated in SQL, e.g. receive_time - queue_time is the time the job was queued.
+// The finish of a job isn't seen if more jobs finished on its pool between scrapes than the API returns,
+// so its finish_time stays NULL until it's deleted with the rest of the jobs older than the retention.
+const jobStoreSchema = `
+CREATE TABLE IF NOT EXISTS jobs (
+	server          TEXT    NOT NULL,
+	request_id      INTEGER NOT NULL,
+	name            TEXT    NOT NULL,
+	plan_type       TEXT    NOT NULL,
+	result          TEXT    NOT NULL,
+	pool_id         INTEGER NOT NULL,
+	pool_name       TEXT    NOT NULL,
+	agent_id        INTEGER,
+	agent_name      TEXT,
+	definition_id   INTEGER NOT NULL,
+	definition_name TEXT    NOT NULL,
+	owner_id        INTEGER NOT NULL,
+	owner_name      TEXT    NOT NULL,
+	queue_time      REAL    NOT NULL,
+	assign_time     REAL,
+	receive_time    REAL,
+	finish_time     REAL,
+	PRIMARY KEY (server, request_id)
+);
+CREATE INDEX IF NOT EXISTS jobs_queue_time ON jobs (queue_time);
+CREATE INDEX IF NOT EXISTS jobs_pool_finish_time ON jobs (pool_name, finish_time);
+`
+
+// Each time a job is seen its row is updated, keeping what earlier sightings saw which this one didn't,
+// e.g. the agent and times of a job seen running before being seen again without them
+const jobStoreUpsert = `
+INSERT INTO jobs (server, request_id, name, plan_type, result, pool_id, pool_name, agent_id, agent_name, definition_id, definition_name, owner_id, owner_name, queue_time, assign_time, receive_time, finish_time)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (server, request_id) DO UPDATE SET
+	name = excluded.name, plan_type = excluded.plan_type, result = COALESCE(NULLIF(excluded.result, ''), jobs.result), pool_id = excluded.pool_id, pool_name = excluded.pool_name,
+	agent_id = COALESCE(excluded.agent_id, jobs.agent_id), agent_name = COALESCE(excluded.agent_name, jobs.agent_name),
+	definition_id = excluded.definition_id, definition_name = excluded.definition_name, owner_id = excluded.owner_id, owner_name = excluded.owner_name,
+	queue_time = excluded.queue_time, assign_time = COALESCE(excluded.assign_time, jobs.assign_time),
+	receive_time = COALESCE(excluded.receive_time, jobs.receive_time), finish_time = COALESCE(excluded.finish_time, jobs.finish_time)
+`
+
+// jobStore records every job the collectors see, queued, running and finished, in a SQLite database.
+// The API only returns the last few finished jobs, so recording jobs while they're queued and running means
+// a job is still stored if more finished between scrapes than the API returns, though without its finish.
+// The jobs are written by run rather than by the scrapes, so a slow disk doesn't hold up Prometheus.
+type jobStore struct {
+	settings config.JobStore
+	db       *sql.DB
+	writes   chan jobStoreWrite
+	done     chan struct{} // Closed once run has written everything queued
+
+	mu     sync.Mutex // Guards closed, so nothing is queued once writes is closed
+	closed bool
+}
+
+// jobStoreWrite is the jobs seen on a pool by a scrape
+type jobStoreWrite struct {
+	server string
+	pool   azdo.Pool
+	jobs   [][]azdo.Job
+}
+
+func openJobStore(settings config.JobStore) (*jobStore, error) {
+	db, err := sql.Open("sqlite3", settings.Path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	// Writes are serialised by SQLite anyway, and one connection avoids them waiting on each other's locks
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(jobStoreSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &jobStore{settings: settings, db: db, writes: make(chan jobStoreWrite, jobStoreQueueSize), done: make(chan struct{})}, nil
+}
+
+// openJobStoreForQueries opens the database of a job store which may be being written by a running exporter.
+// It isn't opened read only as reading a WAL database needs its -shm file, which is created if the exporter isn't running.
+func openJobStoreForQueries(path string) (*sql.DB, error) {
+	return sql.Open("sqlite3", "file:"+path+"?mode=rw&_query_only=true&_busy_timeout=5000")
+}
+
+// record queues the jobs seen on a pool by a scrape to be stored. They're dropped if the queue is full or the store is closed
+func (js *jobStore) record(server string, pool azdo.Pool, jobs ...[]azdo.Job) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	if js.closed {
+		return
+	}
+	select {
+	case js.writes <- jobStoreWrite{server: server, pool: pool, jobs: jobs}:
+	default:
+		log.WithFields(log.Fields{"serverName": server, "poolId": pool.ID}).Warning("Job store is behind, dropping the jobs seen by this scrape")
+	}
+}
+
+func (js *jobStore) upsert(server string, pool azdo.Pool, jobs ...[]azdo.Job) error {
+	tx, err := js.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(jobStoreUpsert)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, list := range jobs {
+		for _, job := range list {
+			// A queued job hasn't been reserved by an agent yet
+			var agentID, agentName interface{}
+			if job.ReservedAgent.Name != "" {
+				agentID, agentName = job.ReservedAgent.ID, job.ReservedAgent.Name
+			}
+
+			_, err := stmt.Exec(server, job.RequestID, job.Name, job.PlanType, job.Result, pool.ID, pool.Name, agentID, agentName,
+				job.Definition.ID, job.Definition.Name, job.Owner.ID, job.Owner.Name,
+				unixSeconds(job.QueueTime), unixSeconds(job.AssignTime), unixSeconds(job.ReceiveTime), unixSeconds(job.FinishTime))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// run writes the queued jobs, and deletes the jobs older than the retention now and then every prune interval, until the store is closed
+func (js *jobStore) run() {
+	log.WithFields(log.Fields{"path": js.settings.Path, "retention": js.settings.Retention.Duration}).Info("Storing jobs")
+	defer close(js.done)
+
+	ticker := time.NewTicker(jobStorePruneInterval)
+	defer ticker.Stop()
+
+	js.prune()
+	for {
+		select {
+		case w, ok := <-js.writes:
+			if !ok {
+				return
+			}
+			if err := js.upsert(w.server, w.pool, w.jobs...); err != nil {
+				log.WithFields(log.Fields{"serverName": w.server, "poolId": w.pool.ID, "error": err}).Error("Failed to store jobs")
+			}
+		case <-ticker.C:
+			js.prune()
+		}
+	}
+}
+
+func (js *jobStore) prune() {
+	result, err := js.db.Exec("DELETE FROM jobs WHERE queue_time < ?", unixSeconds(time.Now().Add(-js.settings.Retention.Duration)))
+	if err != nil {
+		log.WithFields(log.Fields{"path": js.settings.Path, "error": err}).Error("Failed to delete jobs older than the retention")
+		return
+	}
+	if deleted, _ := result.RowsAffected(); deleted > 0 {
+		log.WithFields(log.Fields{"path": js.settings.Path, "deleted": deleted}).Info("Deleted jobs older than the retention")
+	}
+}
+
+// close waits for the queued jobs to be written, then closes the database. Jobs recorded after it's called are dropped
+func (js *jobStore) close() {
+	js.mu.Lock()
+	if !js.closed {
+		js.closed = true
+		close(js.writes)
+	}
+	js.mu.Unlock()
+	<-js.done
+
+	if err := js.db.Close(); err != nil {
+		log.WithFields(log.Fields{"path": js.settings.Path, "error": err}).Error("Failed to close job store")
+	}
+}
+
+// unixSeconds is t as seconds since the Unix epoch, or NULL if it's zero
+func unixSeconds(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return float64(t.UnixNano()) / float64(time.Second)
+}
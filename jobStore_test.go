@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"azdoexporter/azdo"
+	"azdoexporter/config"
+)
+
+func testJobStore(t *testing.T, retention time.Duration) *jobStore {
+	js, err := openJobStore(config.JobStore{Path: filepath.Join(t.TempDir(), "jobs.db"), Retention: config.Duration{Duration: retention}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return js
+}
+
+// storedJob is a finished job which was queued for a minute and ran for run
+func storedJob(requestID int, definition string, agent string, finished time.Time, run time.Duration) azdo.Job {
+	received := finished.Add(-run)
+	return azdo.Job{
+		RequestID:     requestID,
+		Name:          "Job",
+		Result:        "succeeded",
+		Definition:    azdo.JobReference{ID: 1, Name: definition},
+		ReservedAgent: azdo.Agent{ID: 2, Name: agent},
+		QueueTime:     received.Add(-time.Minute),
+		AssignTime:    received.Add(-time.Minute),
+		ReceiveTime:   received,
+		FinishTime:    finished,
+	}
+}
+
+func TestJobStoreUpsertMergesSightingsOfAJob(t *testing.T) {
+	js := testJobStore(t, time.Hour)
+	defer js.db.Close()
+
+	pool := azdo.Pool{ID: 1, Name: "Default"}
+	queued := time.Now().Add(-time.Hour).Truncate(time.Second)
+	job := azdo.Job{RequestID: 7, Name: "Job", Definition: azdo.JobReference{ID: 1, Name: "pipeline"}, QueueTime: queued}
+
+	// Seen queued, then assigned to an agent, then finished without its agent
+	assigned := job
+	assigned.ReservedAgent = azdo.Agent{ID: 2, Name: "agent"}
+	assigned.AssignTime = queued.Add(time.Minute)
+	assigned.ReceiveTime = queued.Add(2 * time.Minute)
+	finished := job
+	finished.FinishTime = queued.Add(3 * time.Minute)
+	finished.Result = "failed"
+
+	for _, sighting := range []azdo.Job{job, assigned, finished, job} {
+		if err := js.upsert("s1", pool, []azdo.Job{sighting}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var rows int
+	if err := js.db.QueryRow("SELECT COUNT(*) FROM jobs").Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 {
+		t.Errorf("got %v rows, want one for the request", rows)
+	}
+
+	var agentName, result string
+	var queue, receive, finish float64
+	err := js.db.QueryRow("SELECT agent_name, result, queue_time, receive_time, finish_time FROM jobs WHERE server = 's1' AND request_id = 7").
+		Scan(&agentName, &result, &queue, &receive, &finish)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agentName != "agent" || result != "failed" {
+		t.Errorf("got agent %q and result %q, want those of each sighting kept", agentName, result)
+	}
+	if receive-queue != 120 || finish-queue != 180 {
+		t.Errorf("got received after %v and finished after %v, want 120 and 180 seconds", receive-queue, finish-queue)
+	}
+}
+
+func TestJobStorePruneHonoursRetention(t *testing.T) {
+	js := testJobStore(t, 24*time.Hour)
+	defer js.db.Close()
+
+	now := time.Now()
+	old := storedJob(1, "pipeline", "agent", now.Add(-25*time.Hour), time.Minute)
+	unfinished := azdo.Job{RequestID: 2, QueueTime: now.Add(-48 * time.Hour)} // Its finish was never seen
+	recent := storedJob(3, "pipeline", "agent", now, time.Minute)
+	if err := js.upsert("s1", azdo.Pool{ID: 1, Name: "Default"}, []azdo.Job{old, unfinished, recent}); err != nil {
+		t.Fatal(err)
+	}
+
+	js.prune()
+
+	var requestIDs []int
+	rows, err := js.db.Query("SELECT request_id FROM jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		rows.Scan(&id)
+		requestIDs = append(requestIDs, id)
+	}
+	if len(requestIDs) != 1 || requestIDs[0] != 3 {
+		t.Errorf("got jobs %v, want only the job queued within the retention", requestIDs)
+	}
+}
+
+// queryJobStore is a job store closed by the exporter, so its -wal and -shm files are gone, opened for queries
+func queryJobStore(t *testing.T) *sql.DB {
+	js := testJobStore(t, time.Hour)
+	now := time.Now()
+	jobs := []azdo.Job{
+		storedJob(1, "pipeline", "agent-1", now.Add(-time.Hour), 10*time.Second),
+		storedJob(2, "pipeline", "agent-2", now.Add(-2*time.Hour), 20*time.Second),
+		storedJob(3, "pipeline", "agent-1", now.Add(-3*time.Hour), 30*time.Second),
+		storedJob(4, "other", "agent-1", now.Add(-90*time.Minute), time.Hour),
+		storedJob(5, "pipeline", "agent-1", now.Add(-10*24*time.Hour), time.Hour), // Finished before --since
+		{RequestID: 6, Definition: azdo.JobReference{Name: "pipeline"}, QueueTime: now.Add(-time.Hour)},
+	}
+	if err := js.upsert("s1", azdo.Pool{ID: 1, Name: "Default"}, jobs); err != nil {
+		t.Fatal(err)
+	}
+	js.db.Close()
+
+	db, err := openJobStoreForQueries(js.settings.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestJobStoreOpenedForQueriesIsNotWritten(t *testing.T) {
+	db := queryJobStore(t)
+
+	if _, err := db.Exec("DELETE FROM jobs"); err == nil {
+		t.Error("a job store opened for queries was written")
+	}
+}
+
+func TestPrintJobPercentiles(t *testing.T) {
+	db := queryJobStore(t)
+
+	var out bytes.Buffer
+	if err := printJobPercentiles(&out, db, jobQuery{definition: "PIPELINE", since: 7 * 24 * time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the finished jobs of the definition within --since
+	lines := strings.Split(out.String(), "\n")
+	if lines[0] != "Jobs which finished in the last 168h0m0s: 3" {
+		t.Errorf("got %q, want the 3 matching jobs", lines[0])
+	}
+	if running := strings.Fields(lines[4]); len(running) != 8 || running[0] != "running" || running[1] != "3" || running[2] != "10s" || running[3] != "20s" || running[7] != "30s" {
+		t.Errorf("got %q, want 3 jobs running between 10s and 30s with a median of 20s", lines[4])
+	}
+	if queued := strings.Fields(lines[3]); len(queued) != 8 || queued[2] != "1m0s" || queued[7] != "1m0s" {
+		t.Errorf("got %q, want the jobs queued for a minute", lines[3])
+	}
+}
+
+func TestListJobs(t *testing.T) {
+	db := queryJobStore(t)
+
+	var out bytes.Buffer
+	if err := listJobs(&out, db, jobQuery{agent: "agent-1", since: 7 * 24 * time.Hour}, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// The newest of the finished jobs on the agent, up to the limit
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "SERVER") {
+		t.Fatalf("got %q, want a header and 2 jobs", out.String())
+	}
+	for i, requestID := range []string{"1", "4"} {
+		if fields := strings.Fields(lines[i+1]); fields[1] != requestID || fields[3] != "agent-1" {
+			t.Errorf("got %q, want request %v", lines[i+1], requestID)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	tests := []struct {
+		p    float64
+		want float64
+	}{{0, 1}, {50, 5}, {90, 9}, {95, 10}, {99, 10}, {100, 10}}
+
+	for _, test := range tests {
+		if got := percentile(sorted, test.p); got != test.want {
+			t.Errorf("p%v: got %v, want %v", test.p, got, test.want)
+		}
+	}
+	if !math.IsNaN(percentile(nil, 50)) {
+		t.Error("the percentile of no values isn't NaN")
+	}
+}
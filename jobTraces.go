@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"azdoexporter/azdo"
+)
+
+// traceJobs records a trace for each finished job, from when it was queued until it finished.
+// It has a child span for the time spent queued until an agent received it, then one for the time the agent ran it.
+func traceJobs(tracer trace.Tracer, pool azdo.Pool, jobs []azdo.Job) {
+	for _, job := range jobs {
+		attributes := []attribute.KeyValue{
+			attribute.Int("azdo.job.request_id", job.RequestID),
+			attribute.String("azdo.job.name", job.Name),
+			attribute.String("azdo.job.plan_type", job.PlanType),
+			attribute.String("azdo.job.result", job.Result),
+			attribute.Int("azdo.pool.id", pool.ID),
+			attribute.String("azdo.pool.name", pool.Name),
+			attribute.Int("azdo.definition.id", job.Definition.ID),
+			attribute.String("azdo.definition.name", job.Definition.Name),
+			attribute.String("azdo.owner.name", job.Owner.Name),
+		}
+		// A job cancelled while it was queued was never assigned an agent
+		if job.ReservedAgent.ID != 0 {
+			attributes = append(attributes, attribute.Int("azdo.agent.id", job.ReservedAgent.ID), attribute.String("azdo.agent.name", job.ReservedAgent.Name))
+		}
+
+		ctx, span := tracer.Start(context.Background(), job.Name, trace.WithTimestamp(job.QueueTime), trace.WithAttributes(attributes...))
+		if job.Result == "failed" {
+			span.SetStatus(codes.Error, "job failed")
+		}
+
+		// A job cancelled while it was queued was never received by an agent
+		queueEnd := job.ReceiveTime
+		if queueEnd.IsZero() {
+			queueEnd = job.FinishTime
+		}
+
+		_, queue := tracer.Start(ctx, "queue", trace.WithTimestamp(job.QueueTime))
+		if !job.AssignTime.IsZero() {
+			queue.AddEvent("assigned", trace.WithTimestamp(job.AssignTime), trace.WithAttributes(attribute.String("azdo.agent.name", job.ReservedAgent.Name)))
+		}
+		queue.End(trace.WithTimestamp(queueEnd))
+
+		if !job.ReceiveTime.IsZero() {
+			_, execution := tracer.Start(ctx, "execution", trace.WithTimestamp(job.ReceiveTime))
+			execution.End(trace.WithTimestamp(job.FinishTime))
+		}
+
+		span.End(trace.WithTimestamp(job.FinishTime))
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"azdoexporter/azdo"
+)
+
+// spanAttributes is a span's attributes keyed by name
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attributes := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		attributes[kv.Key] = kv.Value
+	}
+	return attributes
+}
+
+// childSpans is the spans whose parent is span, keyed by name
+func childSpans(recorder *tracetest.SpanRecorder, span sdktrace.ReadOnlySpan) map[string]sdktrace.ReadOnlySpan {
+	children := make(map[string]sdktrace.ReadOnlySpan)
+	for _, child := range recorder.Ended() {
+		if child.Parent().SpanID() == span.SpanContext().SpanID() {
+			children[child.Name()] = child
+		}
+	}
+	return children
+}
+
+func TestTraceJobs(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	queued := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	pool := azdo.Pool{ID: 1, Name: "Default"}
+	ran := azdo.Job{
+		RequestID:     7,
+		Name:          "Build",
+		Result:        "failed",
+		PlanType:      "Build",
+		Definition:    azdo.JobReference{ID: 3, Name: "pipeline"},
+		Owner:         azdo.JobReference{ID: 4, Name: "20260101.1"},
+		ReservedAgent: azdo.Agent{ID: 2, Name: "agent"},
+		QueueTime:     queued,
+		AssignTime:    queued.Add(time.Minute),
+		ReceiveTime:   queued.Add(2 * time.Minute),
+		FinishTime:    queued.Add(10 * time.Minute),
+	}
+	cancelled := azdo.Job{RequestID: 8, Name: "Deploy", Result: "canceled", QueueTime: queued, FinishTime: queued.Add(5 * time.Minute)}
+
+	traceJobs(tracer, pool, []azdo.Job{ran, cancelled})
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		if !span.Parent().IsValid() {
+			spans[span.Name()] = span
+		}
+	}
+	if len(recorder.Ended()) != 5 {
+		t.Fatalf("got %v spans, want a job, queue and execution span for the job which ran and a job and queue span for the cancelled job", len(recorder.Ended()))
+	}
+
+	t.Run("job which ran", func(t *testing.T) {
+		job := spans["Build"]
+		if !job.StartTime().Equal(ran.QueueTime) || !job.EndTime().Equal(ran.FinishTime) {
+			t.Errorf("got job span from %v to %v, want from when it was queued until it finished", job.StartTime(), job.EndTime())
+		}
+		if job.Status().Code != codes.Error {
+			t.Errorf("got status %v, want an error as the job failed", job.Status().Code)
+		}
+
+		attributes := spanAttributes(job)
+		want := map[attribute.Key]attribute.Value{
+			"azdo.job.request_id":  attribute.IntValue(7),
+			"azdo.job.result":      attribute.StringValue("failed"),
+			"azdo.pool.name":       attribute.StringValue("Default"),
+			"azdo.agent.id":        attribute.IntValue(2),
+			"azdo.agent.name":      attribute.StringValue("agent"),
+			"azdo.definition.name": attribute.StringValue("pipeline"),
+			"azdo.owner.name":      attribute.StringValue("20260101.1"),
+		}
+		for key, value := range want {
+			if attributes[key] != value {
+				t.Errorf("got %v %v, want %v", key, attributes[key].Emit(), value.Emit())
+			}
+		}
+
+		children := childSpans(recorder, job)
+		queue, ok := children["queue"]
+		if !ok {
+			t.Fatal("there is no queue span")
+		}
+		if !queue.StartTime().Equal(ran.QueueTime) || !queue.EndTime().Equal(ran.ReceiveTime) {
+			t.Errorf("got queue span from %v to %v, want from when it was queued until the agent received it", queue.StartTime(), queue.EndTime())
+		}
+		if events := queue.Events(); len(events) != 1 || events[0].Name != "assigned" || !events[0].Time.Equal(ran.AssignTime) {
+			t.Errorf("got events %+v, want it assigned to an agent after a minute", events)
+		}
+
+		execution, ok := children["execution"]
+		if !ok {
+			t.Fatal("there is no execution span")
+		}
+		if !execution.StartTime().Equal(ran.ReceiveTime) || !execution.EndTime().Equal(ran.FinishTime) {
+			t.Errorf("got execution span from %v to %v, want from when the agent received it until it finished", execution.StartTime(), execution.EndTime())
+		}
+	})
+
+	t.Run("job cancelled while queued", func(t *testing.T) {
+		job := spans["Deploy"]
+		if !job.StartTime().Equal(cancelled.QueueTime) || !job.EndTime().Equal(cancelled.FinishTime) {
+			t.Errorf("got job span from %v to %v, want from when it was queued until it was cancelled", job.StartTime(), job.EndTime())
+		}
+		if job.Status().Code == codes.Error {
+			t.Error("got an error status for a job which was cancelled")
+		}
+		attributes := spanAttributes(job)
+		if _, ok := attributes["azdo.agent.name"]; ok {
+			t.Error("got an agent for a job which was never assigned one")
+		}
+
+		children := childSpans(recorder, job)
+		queue, ok := children["queue"]
+		if !ok || len(children) != 1 {
+			t.Fatalf("got spans %v, want only a queue span as no agent received it", children)
+		}
+		if !queue.EndTime().Equal(cancelled.FinishTime) || len(queue.Events()) != 0 {
+			t.Errorf("got queue span until %v with events %+v, want it queued until it was cancelled", queue.EndTime(), queue.Events())
+		}
+	})
+}
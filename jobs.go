@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"azdoexporter/config"
+)
+
+// jobQuery filters the finished jobs in the job store
+type jobQuery struct {
+	server     string
+	pool       string
+	definition string
+	agent      string
+	result     string
+	since      time.Duration // Jobs which finished within this long ago
+}
+
+// where returns the SQL condition and its arguments matching the jobs. Names match case insensitively.
+// Jobs whose finish wasn't seen are never matched, so they aren't counted as running until they're deleted.
+func (q jobQuery) where(now time.Time) (string, []interface{}) {
+	conditions := []string{"finish_time IS NOT NULL", "finish_time >= ?"}
+	args := []interface{}{unixSeconds(now.Add(-q.since))}
+
+	for _, filter := range []struct{ column, value string }{
+		{"server", q.server}, {"pool_name", q.pool}, {"definition_name", q.definition}, {"agent_name", q.agent}, {"result", q.result},
+	} {
+		if filter.value != "" {
+			conditions = append(conditions, filter.column+" = ? COLLATE NOCASE")
+			args = append(args, filter.value)
+		}
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// jobsCommand is `azdoexporter jobs --config <path>`. It prints the percentiles of how long the jobs in the job store
+// which finished recently were queued and ran for, or lists them with --list. Returns the exit code.
+func jobsCommand(args []string) int {
+	flags := flag.NewFlagSet("jobs", flag.ContinueOnError)
+	pathToConfig := flags.String("config", "config.toml", "Path to config file, TOML or YAML. The job store's path is read from it")
+	pathToDB := flags.String("db", "", "Path to the job store's database, instead of reading it from the config")
+	var q jobQuery
+	flags.StringVar(&q.server, "server", "", "Only jobs from this server")
+	flags.StringVar(&q.pool, "pool", "", "Only jobs which ran on this pool")
+	flags.StringVar(&q.definition, "definition", "", "Only jobs queued by this build or release definition")
+	flags.StringVar(&q.agent, "agent", "", "Only jobs which ran on this agent")
+	flags.StringVar(&q.result, "result", "", "Only jobs with this result, e.g. succeeded or failed")
+	flags.DurationVar(&q.since, "since", 7*24*time.Hour, "Only jobs which finished within this long ago")
+	list := flags.Bool("list", false, "List the jobs, newest first, rather than their percentiles")
+	limit := flags.Int("limit", 100, "How many jobs --list prints")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	log.SetLevel(log.WarnLevel)
+
+	if *pathToDB == "" {
+		*pathToConfig = configPath(flags, *pathToConfig)
+		c, err := config.Load(*pathToConfig)
+		if err != nil {
+			printConfigErrors(os.Stderr, *pathToConfig, err)
+			return 1
+		}
+		if c.JobStore.Path == "" {
+			fmt.Fprintln(os.Stderr, "The job store's path has not been set in the config. Set jobStore.path or use --db")
+			return 1
+		}
+		*pathToDB = c.JobStore.Path
+	}
+
+	if _, err := os.Stat(*pathToDB); err != nil {
+		fmt.Fprintf(os.Stderr, "Job store cannot be read - %v\n", err)
+		return 1
+	}
+	db, err := openJobStoreForQueries(*pathToDB)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open job store - %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	if *list {
+		err = listJobs(os.Stdout, db, q, *limit)
+	} else {
+		err = printJobPercentiles(os.Stdout, db, q)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to query job store - %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// printJobPercentiles prints how long the jobs were queued until an agent received them, how long they ran for, and the total of both.
+// These are the same durations the job histograms observe.
+func printJobPercentiles(w io.Writer, db *sql.DB, q jobQuery) error {
+	where, args := q.where(time.Now())
+	rows, err := db.Query("SELECT receive_time - queue_time, finish_time - receive_time, finish_time - queue_time FROM jobs WHERE "+where, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var queued, running, total []float64
+	for rows.Next() {
+		var queue, run sql.NullFloat64
+		var t float64
+		if err := rows.Scan(&queue, &run, &t); err != nil {
+			return err
+		}
+		// A job cancelled while it was queued was never received by an agent
+		if queue.Valid {
+			queued = append(queued, queue.Float64)
+			running = append(running, run.Float64)
+		}
+		total = append(total, t)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Jobs which finished in the last %v: %v\n\n", q.since, len(total))
+	if len(total) == 0 {
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "\tjobs\tmin\tp50\tp90\tp95\tp99\tmax\t")
+	for _, d := range []struct {
+		name    string
+		seconds []float64
+	}{{"queued", queued}, {"running", running}, {"total", total}} {
+		sort.Float64s(d.seconds)
+		fmt.Fprintf(tw, "%v\t%v\t", d.name, len(d.seconds))
+		for _, p := range []float64{0, 50, 90, 95, 99, 100} {
+			fmt.Fprintf(tw, "%v\t", formatSeconds(percentile(d.seconds, p)))
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+func listJobs(w io.Writer, db *sql.DB, q jobQuery, limit int) error {
+	where, args := q.where(time.Now())
+	rows, err := db.Query(`SELECT server, request_id, pool_name, COALESCE(agent_name, ''), definition_name, name, result,
+		queue_time, receive_time - queue_time, finish_time - receive_time, finish_time
+		FROM jobs WHERE `+where+` ORDER BY finish_time DESC LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVER\tREQUEST\tPOOL\tAGENT\tDEFINITION\tJOB\tRESULT\tQUEUED AT\tQUEUED\tRAN\tFINISHED AT")
+	for rows.Next() {
+		var server, pool, agent, definition, name, result string
+		var requestID int
+		var queueTime, finishTime float64
+		var queue, run sql.NullFloat64
+		if err := rows.Scan(&server, &requestID, &pool, &agent, &definition, &name, &result, &queueTime, &queue, &run, &finishTime); err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", server, requestID, pool, agent, definition, name, result,
+			formatUnixSeconds(queueTime), formatNullSeconds(queue), formatNullSeconds(run), formatUnixSeconds(finishTime))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return tw.Flush()
+}
+
+// percentile is the nearest-rank percentile p of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+func formatSeconds(seconds float64) string {
+	if math.IsNaN(seconds) {
+		return "-"
+	}
+	return time.Duration(seconds * float64(time.Second)).Round(time.Second).String()
+}
+
+func formatNullSeconds(seconds sql.NullFloat64) string {
+	if !seconds.Valid {
+		return "-"
+	}
+	return formatSeconds(seconds.Float64)
+}
+
+func formatUnixSeconds(seconds float64) string {
+	return time.Unix(0, int64(seconds*float64(time.Second))).Local().Format("2006-01-02 15:04:05")
+}
@@ -1,29 +1,28 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"fmt"
+	"log/slog"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
-	"strings"
-	"time"
+	"syscall"
 
-	"github.com/BurntSushi/toml"
 	colorable "github.com/mattn/go-colorable"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/exporter-toolkit/web"
 	log "github.com/sirupsen/logrus"
+
+	"azdoexporter/config"
 )
 
-// Validate the connection
-// Validate the permissions of PAT token
 // Add metrics for reporter
 // Expose "ignoreHostedPools" externally. Should it be global or per project
 // Improve logging (log lower level)
 // Reformat the structure of azdoCollector to allow poolname to be captured
-// Show error if not 200 is shown on http request
 // Add "noAccessToken" flag for times when no auth is needed
 // Show retry succeeded
 // Make config file not be optional
@@ -38,114 +37,126 @@ func init() {
 
 func main() {
 
-	pathToConfig := flag.String("config", "config.toml", "Path to config file")
-	flag.Parse()
-
-	var ignoreHostedPools = true
-
-	var proxyURL *url.URL
-
-	configLogger := log.WithFields(log.Fields{
-		"path": *pathToConfig,
-	})
-
-	// Read config
-	var c config
-	if _, err := toml.DecodeFile(*pathToConfig, &c); err != nil {
-		configLogger.WithField("error", err).Error("Failed to decode configuration file")
-		return
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validateCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "jobs" {
+		os.Exit(jobsCommand(os.Args[2:]))
 	}
-	configLogger.Debug("Configuration file successfully decoded")
-
-	// Validate config
-	configValid := true
-	for name, server := range c.Servers {
-
-		//Check if access token exists as an Env Var
-		envVar := strings.ToUpper(fmt.Sprintf("TFSEX_%v_ACCESSTOKEN", name))
-		accessToken := os.Getenv(envVar)
-
-		if accessToken != "" {
-			configLogger.WithFields(log.Fields{"serverName": fmt.Sprintf("servers.%v", name), "envVar": envVar}).Info("Using AccessToken from environment variable")
-
-			// AccessToken might already have been set from the config file. Just log we are going to override it.
-			if server.AccessToken != "" {
-				configLogger.WithFields(log.Fields{"serverName": fmt.Sprintf("servers.%v", name), "envVar": envVar}).Warning("AccessToken in config file will be overridden by AccessToken from environment variable")
-			}
-
-			// Assign EnvVar accessToken to the config object.
-			server.AccessToken = accessToken
-			c.Servers[name] = server
-		} else {
-			configLogger.WithFields(log.Fields{"serverName": fmt.Sprintf("servers.%v", name), "envVar": envVar}).Debug("Environment variable for AccessToken does not exist")
-		}
 
-		if server.AccessToken == "" {
-			configLogger.WithFields(log.Fields{"serverName": fmt.Sprintf("servers.%v", name), "envVar": envVar}).Error("AccessToken not found in config file or environment variable")
-			configValid = false
-		}
+	pathToConfig := flag.String("config", "config.toml", "Path to config file, TOML or YAML")
+	enableLifecycle := flag.Bool("web.enable-lifecycle", false, "Reload the config on a POST or PUT to /-/reload")
+	flag.Parse()
+	*pathToConfig = configPath(flag.CommandLine, *pathToConfig)
 
-		// Check that if a server has proxy set to true that the proxy table has been populated
-		if server.UseProxy && c.Proxy.URL == "" {
-			configLogger.WithField("serverName", fmt.Sprintf("servers.%v", name)).Error("UseProxy is true for but proxy url has not been set.")
-			configValid = false
+	// Create the collectors for each server and register them so they get called when Prometheus scrapes.
+	// Requests to Azure DevOps are cancelled when the exporter shuts down
+	var reg = prometheus.NewRegistry()
+	ctx, cancelRequests := context.WithCancel(context.Background())
+	servers := newServerManager(ctx, reg, *pathToConfig)
+	if err := servers.load(); err != nil {
+		logConfigErrors(*pathToConfig, err)
+		log.WithField("path", *pathToConfig).Fatal("Errors found within config")
+	}
+	c := servers.currentConfig()
+
+	// Where Prometheus can't reach the exporter, the metrics can be pushed to it instead.
+	// The metrics endpoint is still served as the same port serves the health checks, reloads, service hooks and API
+	if c.Push.URL != "" {
+		p, err := newPusher(c.Push, servers.gatherer.recent())
+		if err != nil {
+			log.WithField("error", err).Fatal("Failed to create pusher")
 		}
+		go p.run(ctx)
 	}
 
-	// Safe even if c.Proxy.Url is empty
-	proxyURL, err := url.Parse(c.Proxy.URL)
-	if err != nil {
-		configLogger.WithFields(log.Fields{"proxyURL": c.Proxy.URL, "error": err}).Error("proxyURL cannot be parsed as a URL")
-		configValid = false
-	}
+	// The config can be reloaded with SIGHUP, or a POST to /-/reload once enabled with --web.enable-lifecycle
+	go servers.reloadOnSignal()
 
-	//Check if the port has been set
-	if c.Exporter.Port == 0 {
-		c.Exporter.Port = portDefault
-		configLogger.WithField("port", c.Exporter.Port).Debug("Metrics will be exposed on default port")
-	} else {
-		configLogger.WithField("port", c.Exporter.Port).Debug("Metrics will be exposed on port specified")
-	}
+	// Other servers can be scraped through modules, the same as the blackbox exporter
+	probes := newProber(servers)
 
-	//Check if the endpoint has been set
-	if c.Exporter.Endpoint == "" {
-		c.Exporter.Endpoint = endpointDefault
-		configLogger.WithField("endpoint", c.Exporter.Endpoint).Debug("Metrics will be exposed on default endpoint")
-	} else {
-		if strings.HasPrefix(c.Exporter.Endpoint, "/") == false {
-			c.Exporter.Endpoint = "/" + c.Exporter.Endpoint
-		}
-		configLogger.WithField("endpoint", c.Exporter.Endpoint).Debug("Metrics will be exposed on endpoint specified")
+	// The web config applies TLS and basic auth to every handler. It's read again on each request so changes to it don't need a restart
+	if c.Exporter.WebConfigFile != "" {
+		log.WithField("webConfigFile", c.Exporter.WebConfigFile).Info("Using web config for TLS and authentication")
 	}
+	webConfig := webFlagConfig(c.Exporter)
+	webLogger := slog.New(slog.NewTextHandler(log.StandardLogger().Writer(), nil))
 
-	if configValid == false {
-		configLogger.Fatal("Errors found within config")
-		return
+	httpServer := &http.Server{Handler: newMux(c, servers, probes, *enableLifecycle)}
+	go func() {
+		if err := web.ListenAndServe(httpServer, webConfig, webLogger); err != http.ErrServerClosed {
+			log.WithField("error", err).Fatal("Failed to serve")
+		}
+	}()
+
+	// Shut down gracefully on SIGTERM, e.g. during a rolling deploy, or SIGINT
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	sig := <-stop
+
+	gracePeriod := servers.currentConfig().Exporter.ShutdownGracePeriod.Duration
+	log.WithFields(log.Fields{"signal": sig, "gracePeriod": gracePeriod}).Info("Shutting down")
+
+	// Stop accepting scrapes and wait for those being served to finish.
+	// In-flight requests to Azure DevOps are only cancelled once they've had the grace period to finish.
+	// The whole shutdown, including waiting for the scrapes that were cancelled and flushing OTLP, is bounded by the grace period.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.WithField("error", err).Warning("Grace period ended before in-flight requests finished. Cancelling them")
 	}
+	cancelRequests()
+	probes.close()
+	servers.close(shutdownCtx)
 
-	// Create and configure azdoCollector
-	var azDoCollectors []*azDoCollector
-	for name, server := range c.Servers {
-		server.Name = name
+	log.Info("Shut down")
+}
 
-		if server.UseProxy {
-			log.WithFields(log.Fields{"server": server.Name, "serverAddress": server.Address}).Info("Proxy will be used")
-			server.Client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), IdleConnTimeout: time.Second * 20}}
-		} else {
-			server.Client = &http.Client{Transport: &http.Transport{IdleConnTimeout: time.Second * 20}}
+// configPath returns the path of the config file to load, or "" to only use environment variables.
+// That's when the default config.toml doesn't exist and --config wasn't passed.
+func configPath(flags *flag.FlagSet, pathToConfig string) string {
+	explicit := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			explicit = true
 		}
+	})
 
-		azDoCollectors = append(azDoCollectors, newAzDoCollector(server.AzDoClient, ignoreHostedPools))
-		log.WithFields(log.Fields{"server": server.Name, "serverAddress": server.Address}).Info("Metrics collector created")
+	if _, err := os.Stat(pathToConfig); os.IsNotExist(err) && !explicit {
+		return ""
 	}
+	return pathToConfig
+}
 
-	// Add each azdoCollector to the register so they get called when Prometheus scrapes.
-	var reg = prometheus.NewRegistry()
-	for _, tc := range azDoCollectors {
-		prometheus.WrapRegistererWith(prometheus.Labels{"name": tc.AzDoClient.Name}, reg).MustRegister(tc)
+// newMux routes every endpoint the exporter serves on its port.
+// The config rejects metrics and service hook endpoints which clash with the others, listed in config.ReservedPaths
+func newMux(c config.Config, servers *serverManager, probes *prober, enableLifecycle bool) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/-/reload", lifecycleHandler(enableLifecycle, servers))
+
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", servers.readyz)
+	mux.HandleFunc("/status", servers.status)
+	mux.Handle(apiServersPath, apiHandler{servers})
+	mux.Handle(apiServersPath+"/", apiHandler{servers})
+	mux.Handle(dashboardPath, dashboardHandler{servers})
+	mux.Handle(dashboardPath+"/", dashboardHandler{servers})
+	mux.Handle("/probe", probes)
+
+	if c.ServiceHooks.Endpoint != "" {
+		mux.Handle(c.ServiceHooks.Endpoint+"/", newServiceHookHandler(c.ServiceHooks.Endpoint, servers))
+		log.Info("Receiving service hooks at " + c.ServiceHooks.Endpoint + "/<server name>")
 	}
 
-	http.Handle(c.Exporter.Endpoint, promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	mux.Handle(c.Exporter.Endpoint, promhttp.HandlerFor(servers.gatherer, promhttp.HandlerOpts{}))
 	log.Info("Serving metrics at " + c.Exporter.Endpoint + " on port: " + strconv.Itoa(c.Exporter.Port))
-	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(c.Exporter.Port), nil))
+	return mux
+}
+
+// webFlagConfig listens on the exporter's port, with the TLS and basic auth of its web config file, if any
+func webFlagConfig(e config.Exporter) *web.FlagConfig {
+	listenAddresses := []string{":" + strconv.Itoa(e.Port)}
+	systemdSocket := false
+	return &web.FlagConfig{WebListenAddresses: &listenAddresses, WebSystemdSocket: &systemdSocket, WebConfigFile: &e.WebConfigFile}
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/exporter-toolkit/web"
+
+	"azdoexporter/config"
+)
+
+func TestServeWithWebConfig(t *testing.T) {
+	// The bcrypt hash of "password"
+	webConfigFile := filepath.Join(t.TempDir(), "web.yml")
+	if err := os.WriteFile(webConfigFile, []byte("basic_auth_users:\n  prometheus: $2a$04$Y4LMbfENh3evJgILvPAfBeeHyk.xp9xLvGjN.87kfr8Sz51RC4mEi\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := config.Config{Exporter: config.Exporter{Endpoint: "/metrics", WebConfigFile: webConfigFile}}
+
+	servers := snapshotServers(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := &http.Server{Handler: newMux(c, servers, newProber(servers), false)}
+	served := make(chan error, 1)
+	go func() {
+		served <- web.Serve(listener, httpServer, webFlagConfig(c.Exporter), slog.New(slog.DiscardHandler))
+	}()
+	defer func() {
+		httpServer.Close()
+		if err := <-served; err != http.ErrServerClosed {
+			t.Errorf("got %v, want the server closed", err)
+		}
+	}()
+
+	tests := []struct {
+		name     string
+		path     string
+		username string
+		password string
+		wantCode int
+	}{
+		{name: "metrics without credentials", path: "/metrics", wantCode: http.StatusUnauthorized},
+		{name: "metrics with the wrong password", path: "/metrics", username: "prometheus", password: "wrong", wantCode: http.StatusUnauthorized},
+		{name: "metrics", path: "/metrics", username: "prometheus", password: "password", wantCode: http.StatusOK},
+		{name: "api without credentials", path: apiServersPath, wantCode: http.StatusUnauthorized},
+		{name: "api", path: apiServersPath, username: "prometheus", password: "password", wantCode: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://"+listener.Addr().String()+test.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.username != "" {
+				req.SetBasicAuth(test.username, test.password)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != test.wantCode {
+				t.Errorf("got status %v, want %v", resp.StatusCode, test.wantCode)
+			}
+		})
+	}
+}
+
+func TestMuxServesReservedPaths(t *testing.T) {
+	// The config rejects endpoints at these paths, so they must be the ones the exporter routes
+	servers := snapshotServers(t)
+	mux := newMux(config.Config{Exporter: config.Exporter{Endpoint: "/metrics"}}, servers, newProber(servers), false)
+
+	for _, path := range config.ReservedPaths {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, pattern := mux.Handler(req); pattern != path {
+			t.Errorf("%v is routed to %q, want it routed to itself", path, pattern)
+		}
+	}
+}
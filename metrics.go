@@ -2,6 +2,7 @@ package main
 
 import (
 	"strconv"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -43,48 +44,71 @@ var (
 	)
 )
 
-func calculateHistograms(metricContext metricsContext) []prometheus.Metric {
+const (
+	jobTotalLengthName   = "tfs_pool_job_total_length_secs"
+	jobQueueLengthName   = "tfs_pool_job_queue_length_secs"
+	jobRunningLengthName = "tfs_pool_job_running_length_secs"
+)
 
-	totalTimes := prometheus.NewHistogram(prometheus.HistogramOpts{
-		Name:        "tfs_pool_job_total_length_secs",
-		Help:        "Total length of job duration for pool",
-		Buckets:     calculateBuckets(),
-		ConstLabels: map[string]string{"pool": metricContext.pool.Name},
-	})
+// jobHistogramNames are the histograms of the lengths of the jobs which finished on each pool
+var jobHistogramNames = map[string]bool{
+	jobTotalLengthName:   true,
+	jobQueueLengthName:   true,
+	jobRunningLengthName: true,
+}
 
-	for _, job := range metricContext.finishedJobs {
-		totalTime := job.FinishTime.Sub(job.QueueTime)
-		totalTimes.Observe(totalTime.Seconds())
-	}
+// newJobHistograms creates the histograms of the lengths of the jobs which finished on each pool
+func newJobHistograms() *finishedHistograms {
+	return newFinishedHistograms([]string{"pool"},
+		prometheus.HistogramOpts{
+			Name:    jobTotalLengthName,
+			Help:    "Total length of job duration for pool",
+			Buckets: calculateBuckets(),
+		},
+		prometheus.HistogramOpts{
+			Name:    jobQueueLengthName,
+			Help:    "Total length of queue duration for pool",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 10), // 10 buckets, starting at one, doubling
+		},
+		prometheus.HistogramOpts{
+			Name:    jobRunningLengthName,
+			Help:    "Total length of queue duration for pool",
+			Buckets: calculateBuckets(),
+		},
+	)
+}
 
-	queueTimes := prometheus.NewHistogram(prometheus.HistogramOpts{
-		Name:        "tfs_pool_job_queue_length_secs",
-		Help:        "Total length of queue duration for pool",
-		Buckets:     prometheus.ExponentialBuckets(1, 2, 10), // 10 buckets, starting at one, doubling
-		ConstLabels: map[string]string{"pool": metricContext.pool.Name},
-	})
+// observeJobHistograms adds the jobs which finished on a pool since the last scrape. Every pool scraped has histograms, even before any of its jobs finish
+func observeJobHistograms(h *finishedHistograms, metricContext metricsContext) {
+	pool := metricContext.pool.Name
+	h.add([]string{pool}, jobTotalLengthName, jobQueueLengthName, jobRunningLengthName)
 
 	for _, job := range metricContext.finishedJobs {
-		queueTime := job.ReceiveTime.Sub(job.QueueTime) // Time received by the agent - Time queued by the user
-		queueTimes.Observe(queueTime.Seconds())
+		h.observe(jobTotalLengthName, job.FinishTime.Sub(job.QueueTime), pool)
+		h.observe(jobQueueLengthName, job.ReceiveTime.Sub(job.QueueTime), pool) // Time received by the agent - Time queued by the user
+		h.observe(jobRunningLengthName, job.FinishTime.Sub(job.ReceiveTime), pool)
 	}
+}
 
-	jobTimes := prometheus.NewHistogram(prometheus.HistogramOpts{
-		Name:        "tfs_pool_job_running_length_secs",
-		Help:        "Total length of queue duration for pool",
-		Buckets:     calculateBuckets(),
-		ConstLabels: map[string]string{"pool": metricContext.pool.Name},
-	})
-
-	for _, job := range metricContext.finishedJobs {
-		jobTime := job.FinishTime.Sub(job.ReceiveTime)
-		jobTimes.Observe(jobTime.Seconds())
+// newDurationHistogram creates a histogram of the durations given, for what's true at the time of the scrape such as the ages of the builds waiting
+func newDurationHistogram(desc *prometheus.Desc, buckets []float64, durations []time.Duration, labelValues ...string) prometheus.Metric {
+	var sum float64
+	counts := make(map[float64]uint64, len(buckets))
+	for _, bucket := range buckets {
+		counts[bucket] = 0
 	}
-	return []prometheus.Metric{
-		totalTimes,
-		queueTimes,
-		jobTimes,
+
+	for _, d := range durations {
+		seconds := d.Seconds()
+		sum += seconds
+		for _, bucket := range buckets {
+			if seconds <= bucket {
+				counts[bucket]++
+			}
+		}
 	}
+
+	return prometheus.MustNewConstHistogram(desc, uint64(len(durations)), sum, counts, labelValues...)
 }
 
 func calculateBuckets() []float64 {
@@ -141,8 +165,6 @@ func calculateJobMetrics(metricContext metricsContext) []prometheus.Metric {
 		),
 	}
 
-	calculatedMetrics = append(calculatedMetrics, calculateHistograms(metricContext)...)
-
 	return calculatedMetrics
 
 }
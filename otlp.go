@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	otelprom "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+
+	"azdoexporter/config"
+)
+
+// How long the exporters have to send what they're holding when the exporter shuts down
+const otlpShutdownTimeout = 5 * time.Second
+
+func init() {
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.WithField("error", err).Error("Failed to push with OTLP")
+	}))
+}
+
+// otlpExporter pushes the metrics of each server, and optionally traces of its finished jobs, to an OpenTelemetry collector.
+// Each server has its own providers so everything it pushes has resource attributes for the server and collection.
+// The server's metrics are taken from the shared gatherer through the Prometheus bridge, so histograms become OTel histograms.
+// The pushes are given cumulative job histograms, as OTel expects, rather than the Prometheus ones of the jobs since its last scrape.
+type otlpExporter struct {
+	settings config.OTLP
+	gatherer prometheus.Gatherer // Every server's metrics
+
+	mu        sync.Mutex
+	providers map[string]otlpProviders
+}
+
+type otlpProviders struct {
+	meters  *sdkmetric.MeterProvider
+	tracers *sdktrace.TracerProvider // nil unless jobs are traced
+}
+
+func newOTLPExporter(settings config.OTLP, gatherer prometheus.Gatherer) *otlpExporter {
+	log.WithFields(log.Fields{"endpoint": settings.Endpoint, "protocol": settings.Protocol, "interval": settings.Interval.Duration, "traces": settings.Traces}).Info("Pushing metrics with OTLP")
+	return &otlpExporter{settings: settings, gatherer: gatherer, providers: make(map[string]otlpProviders)}
+}
+
+func (o *otlpExporter) newMetricExporter(ctx context.Context) (sdkmetric.Exporter, error) {
+	switch o.settings.Protocol {
+	case config.OTLPProtocolGRPC:
+		opts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithEndpoint(o.settings.Endpoint), otlpmetricgrpc.WithHeaders(o.settings.Headers)}
+		if o.settings.Insecure {
+			opts = append(opts, otlpmetricgrpc.WithInsecure())
+		}
+		return otlpmetricgrpc.New(ctx, opts...)
+
+	default:
+		opts := []otlpmetrichttp.Option{otlpmetrichttp.WithEndpoint(o.settings.Endpoint), otlpmetrichttp.WithHeaders(o.settings.Headers)}
+		if o.settings.Insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		}
+		return otlpmetrichttp.New(ctx, opts...)
+	}
+}
+
+func (o *otlpExporter) newSpanExporter(ctx context.Context) (sdktrace.SpanExporter, error) {
+	switch o.settings.Protocol {
+	case config.OTLPProtocolGRPC:
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(o.settings.Endpoint), otlptracegrpc.WithHeaders(o.settings.Headers)}
+		if o.settings.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		return otlptracegrpc.New(ctx, opts...)
+
+	default:
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(o.settings.Endpoint), otlptracehttp.WithHeaders(o.settings.Headers)}
+		if o.settings.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, opts...)
+	}
+}
+
+// newProviders creates the providers which push the metrics of a server's collectors, and traces of its jobs,
+// once they're set. It must be called before the collectors are registered, as it sets their tracer.
+func (o *otlpExporter) newProviders(name string, s *server) (otlpProviders, error) {
+	// Nothing is gathered once the server has been removed, so its final push doesn't report it as down
+	ctx := s.client.Context
+	gatherer := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+		families, err := o.gatherer.Gather()
+		return serverFamilies(families, name), err
+	})
+
+	exporter, err := o.newMetricExporter(ctx)
+	if err != nil {
+		return otlpProviders{}, fmt.Errorf("failed to create OTLP exporter - %v", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", "azdo-exporter"),
+		attribute.String("azdo.server.name", name),
+		attribute.String("azdo.server.address", s.client.Address),
+		attribute.String("azdo.collection", s.client.DefaultCollection),
+	))
+	if err != nil {
+		return otlpProviders{}, fmt.Errorf("failed to create OTLP resource - %v", err)
+	}
+
+	var providers otlpProviders
+	if o.settings.Traces {
+		spanExporter, err := o.newSpanExporter(ctx)
+		if err != nil {
+			return otlpProviders{}, fmt.Errorf("failed to create OTLP trace exporter - %v", err)
+		}
+		providers.tracers = sdktrace.NewTracerProvider(sdktrace.WithResource(res), sdktrace.WithBatcher(spanExporter))
+		s.agents.tracer = providers.tracers.Tracer("azdoexporter")
+	}
+
+	reader := sdkmetric.NewPeriodicReader(exporter,
+		sdkmetric.WithInterval(o.settings.Interval.Duration),
+		sdkmetric.WithProducer(otelprom.NewMetricProducer(otelprom.WithGatherer(gatherer))),
+	)
+	providers.meters = sdkmetric.NewMeterProvider(sdkmetric.WithResource(res), sdkmetric.WithReader(reader))
+	return providers, nil
+}
+
+// set pushes with the providers of a server, replacing those it had
+func (o *otlpExporter) set(name string, providers otlpProviders) {
+	o.mu.Lock()
+	previous, ok := o.providers[name]
+	o.providers[name] = providers
+	o.mu.Unlock()
+
+	if ok {
+		go previous.shutdown(name)
+	}
+}
+
+// remove stops pushing the metrics of a server
+func (o *otlpExporter) remove(name string) {
+	o.mu.Lock()
+	providers, ok := o.providers[name]
+	delete(o.providers, name)
+	o.mu.Unlock()
+
+	if ok {
+		go providers.shutdown(name)
+	}
+}
+
+// shutdown stops pushing for every server, waiting for what's been collected to be sent
+func (o *otlpExporter) shutdown() {
+	o.mu.Lock()
+	all := o.providers
+	o.providers = make(map[string]otlpProviders)
+	o.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for name, providers := range all {
+		wg.Add(1)
+		go func(name string, providers otlpProviders) {
+			providers.shutdown(name)
+			wg.Done()
+		}(name, providers)
+	}
+	wg.Wait()
+}
+
+// shutdown sends what the providers of a server are holding, then stops them
+func (p otlpProviders) shutdown(name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), otlpShutdownTimeout)
+	defer cancel()
+
+	if err := p.meters.Shutdown(ctx); err != nil {
+		log.WithFields(log.Fields{"server": name, "error": err}).Warning("Failed to shut down OTLP metric exporter")
+	}
+	if p.tracers != nil {
+		if err := p.tracers.Shutdown(ctx); err != nil {
+			log.WithFields(log.Fields{"server": name, "error": err}).Warning("Failed to shut down OTLP trace exporter")
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
+
+	"azdoexporter/azdo"
+	"azdoexporter/config"
+)
+
+// otlpReceiver is an OTLP/HTTP collector which passes on each export request it receives
+func otlpReceiver(t *testing.T) (*httptest.Server, <-chan *colmetricpb.ExportMetricsServiceRequest) {
+	requests := make(chan *colmetricpb.ExportMetricsServiceRequest, 100)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" {
+			http.NotFound(w, r)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("reading export request: %v", err)
+			return
+		}
+		request := &colmetricpb.ExportMetricsServiceRequest{}
+		if err := proto.Unmarshal(body, request); err != nil {
+			t.Errorf("decoding export request: %v", err)
+			return
+		}
+		requests <- request
+
+		response, _ := proto.Marshal(&colmetricpb.ExportMetricsServiceResponse{})
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(response)
+	}))
+	return receiver, requests
+}
+
+func attributes(kvs []*commonpb.KeyValue) map[string]string {
+	m := make(map[string]string, len(kvs))
+	for _, kv := range kvs {
+		m[kv.Key] = kv.Value.GetStringValue()
+	}
+	return m
+}
+
+func TestOTLPExporterPushesServerMetrics(t *testing.T) {
+	receiver, requests := otlpReceiver(t)
+	defer receiver.Close()
+
+	// Two servers' job histograms, registered as the server manager does without the collectors which observe them. Prometheus has just scraped them, so its are empty
+	sm := newServerManager(t.Context(), prometheus.NewRegistry(), "")
+	agents := make(map[string]*azDoCollector)
+	for name, seconds := range map[string]float64{"s1": 30, "s2": 90} {
+		agents[name] = newAzDoCollector(azdo.AzDoClient{Name: name}, true)
+		labels := prometheus.Labels{"name": name}
+		prometheus.WrapRegistererWith(labels, sm.scraped).MustRegister(agents[name].durations.scrapedHistograms())
+		prometheus.WrapRegistererWith(labels, sm.pushed).MustRegister(agents[name].durations.cumulativeHistograms())
+
+		// Each server's cumulative histograms have the job Prometheus was given by an earlier scrape
+		finished := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+		agents[name].observeJobs(metricsContext{
+			pool:         azdo.Pool{ID: 1, Name: "Default"},
+			finishedJobs: []azdo.Job{{QueueTime: finished.Add(-time.Duration(seconds) * time.Second), ReceiveTime: finished.Add(-10 * time.Second), FinishTime: finished}},
+		})
+	}
+	gatherMetrics(t, sm.gatherer)
+
+	settings := config.OTLP{
+		Endpoint: strings.TrimPrefix(receiver.URL, "http://"),
+		Protocol: config.OTLPProtocolHTTP,
+		Insecure: true,
+		Interval: config.Duration{Duration: 50 * time.Millisecond},
+	}
+	o := newOTLPExporter(settings, sm.gatherer.recent())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := &server{client: config.Server{AzDoClient: azdo.AzDoClient{Name: "s1", Address: "https://dev.azure.com/org", DefaultCollection: "coll", Context: ctx}}, agents: agents["s1"]}
+	providers, err := o.newProviders("s1", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.set("s1", providers)
+	defer o.shutdown()
+
+	var request *colmetricpb.ExportMetricsServiceRequest
+	select {
+	case request = <-requests:
+	case <-time.After(10 * time.Second):
+		t.Fatal("nothing was pushed")
+	}
+
+	if len(request.ResourceMetrics) != 1 {
+		t.Fatalf("got %v resources, want 1", len(request.ResourceMetrics))
+	}
+	resourceMetrics := request.ResourceMetrics[0]
+
+	resource := attributes(resourceMetrics.Resource.Attributes)
+	for key, want := range map[string]string{
+		"service.name":        "azdo-exporter",
+		"azdo.server.name":    "s1",
+		"azdo.server.address": "https://dev.azure.com/org",
+		"azdo.collection":     "coll",
+	} {
+		if resource[key] != want {
+			t.Errorf("resource attribute %v = %q, want %q", key, resource[key], want)
+		}
+	}
+
+	found := false
+	for _, scope := range resourceMetrics.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			if m.Name != "tfs_pool_job_total_length_secs" {
+				continue
+			}
+			found = true
+
+			histogram, ok := m.Data.(*metricpb.Metric_Histogram)
+			if !ok {
+				t.Fatalf("%v is a %T, want a histogram", m.Name, m.Data)
+			}
+			if histogram.Histogram.AggregationTemporality != metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE {
+				t.Errorf("temporality is %v, want cumulative", histogram.Histogram.AggregationTemporality)
+			}
+			if len(histogram.Histogram.DataPoints) != 1 {
+				t.Fatalf("got %v data points, want only s1's cumulative histogram", len(histogram.Histogram.DataPoints))
+			}
+
+			point := histogram.Histogram.DataPoints[0]
+			if point.Count != 1 || point.GetSum() != 30 {
+				t.Errorf("count %v and sum %v, want 1 and 30", point.Count, point.GetSum())
+			}
+			if len(point.ExplicitBounds) != len(calculateBuckets()) {
+				t.Errorf("got %v bucket bounds, want %v", len(point.ExplicitBounds), len(calculateBuckets()))
+			}
+			labels := attributes(point.Attributes)
+			if labels["pool"] != "Default" {
+				t.Errorf("pool attribute = %q, want Default", labels["pool"])
+			}
+			if _, ok := labels["name"]; ok {
+				t.Error("the name label is pushed as a data point attribute as well as a resource attribute")
+			}
+		}
+	}
+	if !found {
+		t.Error("tfs_pool_job_total_length_secs was not pushed")
+	}
+}
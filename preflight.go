@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"azdoexporter/azdo"
+	"azdoexporter/config"
+)
+
+// The preflight checks of a server being loaded are cancelled after this long, as each of their requests can be retried for up to 30s
+// and a reload holds up other reloads and shutdown until the checks have finished.
+const preflightTimeout = 15 * time.Second
+
+// preflightServers checks each server concurrently. Returns false if any failed.
+func preflightServers(servers []*server) bool {
+	var (
+		passed = true
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+	)
+
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *server) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(s.client.Context, preflightTimeout)
+			defer cancel()
+			if !preflight(ctx, s.client) {
+				mu.Lock()
+				passed = false
+				mu.Unlock()
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	return passed
+}
+
+// preflight checks a server can be reached, its credentials are accepted and they can read everything the server's collectors need.
+// APIs which none of the server's collectors use are still checked but only warned about.
+// The checks' requests are cancelled when ctx is done. Returns false if anything needed failed.
+func preflight(ctx context.Context, server config.Server) bool {
+	logger := log.WithFields(log.Fields{"server": server.Name, "serverAddress": server.Address})
+	az := server.AzDoClient
+	az.Context = ctx
+	passed := true
+
+	check := func(api string, permission string, needed bool, err error) {
+		if err == nil {
+			logger.WithField("api", api).Debug("Preflight check passed")
+			return
+		}
+
+		fields := log.Fields{"api": api, "error": err}
+		message := "Preflight check failed"
+
+		var statusErr *azdo.StatusError
+		if errors.As(err, &statusErr) && statusErr.Unauthorised() {
+			fields["missingPermission"] = permission
+			message = "Preflight check failed. The credentials do not have the " + permission + " permission"
+		}
+
+		if !needed {
+			logger.WithFields(fields).Warning(message + ". It is not needed by the collectors for this server")
+			return
+		}
+
+		logger.WithFields(fields).Error(message)
+		passed = false
+	}
+
+	// Nothing else can pass if the server can't be reached or the credentials aren't accepted
+	connectionData, err := az.ConnectionData()
+	check("connectionData", "any", true, err)
+	if err != nil {
+		return false
+	}
+	logger.WithFields(log.Fields{"authenticatedAs": connectionData.AuthenticatedUser.ProviderDisplayName, "deploymentType": connectionData.DeploymentType}).Info("Connected to server")
+
+	pools, err := az.Pools(false)
+	check("pools", "Agent Pools (Read)", true, err)
+	if err == nil && len(pools) > 0 {
+		_, err = az.CurrentJobs(pools[0].ID)
+		check("jobrequests", "Agent Pools (Read)", true, err)
+	}
+
+	needsBuilds := server.CollectBuilds || server.CollectPipelineRuns || server.ReceiveServiceHooks
+	needsReleases := server.CollectReleases
+
+	projects, err := az.Projects()
+	check("projects", "Project and Team (Read)", needsBuilds || needsReleases, err)
+	if err == nil && len(projects) > 0 {
+		_, err = az.ActiveBuilds(projects[0].ID)
+		check("builds", "Build (Read)", needsBuilds, err)
+
+		_, err = az.PendingApprovals(projects[0].ID)
+		check("releases", "Release (Read)", needsReleases, err)
+	}
+
+	return passed
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"azdoexporter/azdo"
+	"azdoexporter/config"
+)
+
+// preflightServer responds to each API with its status, or OK with an empty list
+func preflightServer(t *testing.T, statuses map[string]int) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status, ok := statuses[r.URL.Path]; ok {
+			w.WriteHeader(status)
+			return
+		}
+		switch r.URL.Path {
+		case "/_apis/distributedtask/pools":
+			fmt.Fprint(w, `{"count": 1, "value": [{"id": 1, "name": "Default"}]}`)
+		case "/_apis/projects":
+			fmt.Fprint(w, `{"count": 1, "value": [{"id": "project", "name": "project"}]}`)
+		default:
+			fmt.Fprint(w, `{"count": 0, "value": []}`)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPreflight(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name          string
+		statuses      map[string]int
+		address       string // Defaults to the preflight server's
+		collectBuilds bool
+		want          bool
+	}{
+		{name: "everything can be read", want: true},
+		{name: "credentials not accepted", statuses: map[string]int{"/_apis/connectionData": http.StatusUnauthorized}},
+		{name: "sign in page instead of a response", statuses: map[string]int{"/_apis/connectionData": http.StatusNonAuthoritativeInfo}},
+		{name: "not an azure devops server", statuses: map[string]int{"/_apis/connectionData": http.StatusNotFound}},
+		{name: "server cannot be reached", address: closed.URL},
+		{name: "pools cannot be read", statuses: map[string]int{"/_apis/distributedtask/pools": http.StatusForbidden}},
+		{name: "job requests cannot be read", statuses: map[string]int{"/_apis/distributedtask/pools/1/jobrequests/": http.StatusUnauthorized}},
+		{name: "builds not needed cannot be read", statuses: map[string]int{"/project/_apis/build/builds": http.StatusUnauthorized}, want: true},
+		{name: "builds needed cannot be read", statuses: map[string]int{"/project/_apis/build/builds": http.StatusUnauthorized}, collectBuilds: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			address := test.address
+			if address == "" {
+				address = preflightServer(t, test.statuses).URL
+			}
+			server := config.Server{
+				AzDoClient:    azdo.AzDoClient{Client: http.DefaultClient, Name: "s1", Address: address, ReleaseAddress: address, AccessToken: "token"},
+				CollectBuilds: test.collectBuilds,
+			}
+
+			// Requests which fail to connect are retried until the checks are cancelled
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if got := preflight(ctx, server); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestApplyFailsOnPreflightError(t *testing.T) {
+	for _, failOnPreflightError := range []bool{true, false} {
+		t.Run(fmt.Sprintf("failOnPreflightError=%v", failOnPreflightError), func(t *testing.T) {
+			address := preflightServer(t, map[string]int{"/_apis/connectionData": http.StatusUnauthorized}).URL
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			sm := newServerManager(ctx, prometheus.NewRegistry(), "")
+
+			c := reloadConfig(address, "s1")
+			c.Exporter.FailOnPreflightError = failOnPreflightError
+			err := sm.apply(c)
+
+			if failOnPreflightError {
+				if err == nil || len(sm.servers) != 0 {
+					t.Errorf("got error %v and %v servers, want the config not applied", err, len(sm.servers))
+				}
+				return
+			}
+			// Otherwise the exporter runs degraded
+			if err != nil || len(sm.servers) != 1 {
+				t.Errorf("got error %v and %v servers, want the config applied", err, len(sm.servers))
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultModule   = "default"
+	probeTargetTTL  = time.Hour // Targets which haven't been probed for this long have their client and collectors dropped
+	maxProbeTargets = 500       // Beyond this the target probed least recently is dropped, so probes of many addresses can't use up the exporter's memory
+)
+
+// prober serves /probe?target=<server name or address>&module=<name>, the same as the blackbox exporter.
+// The client and collectors for each address are kept between probes so they keep their state, such as the time of the last scrape.
+// A server in the config is served from the shared gather, the same as the pushes, rather than a second set of collectors scraping it.
+type prober struct {
+	servers *serverManager
+
+	mu      sync.Mutex
+	targets map[probeKey]*probeTarget
+}
+
+type probeKey struct {
+	target string
+	module string
+}
+
+type probeTarget struct {
+	server   *server
+	reg      prometheus.Gatherer // Only this target's collectors, so only its metrics are returned
+	lastUsed time.Time
+}
+
+func newProber(servers *serverManager) *prober {
+	return &prober{servers: servers, targets: make(map[probeKey]*probeTarget)}
+}
+
+// settings returns what the collectors for an address scraped with a module are created from
+func (p *prober) settings(target string, moduleName string) (serverSettings, int, error) {
+	c := p.servers.currentConfig()
+
+	module, ok := c.Modules[moduleName]
+	if !ok {
+		return serverSettings{}, http.StatusBadRequest, fmt.Errorf("unknown module %q", moduleName)
+	}
+
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return serverSettings{}, http.StatusBadRequest, fmt.Errorf("target %q is not the name of a server or an http(s) address", target)
+	}
+
+	if !module.Allows(target) {
+		return serverSettings{}, http.StatusForbidden, fmt.Errorf("target %q is not allowed by module %q", target, moduleName)
+	}
+
+	sc := module.Server
+	sc.Address = target
+	return newServerSettings(c, target, sc), http.StatusOK, nil
+}
+
+// target returns the cached server and registry for a target, creating them if it's new or its settings changed on reload
+func (p *prober) target(key probeKey, settings serverSettings) (*probeTarget, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	p.evict(now)
+
+	if t, ok := p.targets[key]; ok {
+		if reflect.DeepEqual(t.server.settings, settings) {
+			t.lastUsed = now
+			return t, nil
+		}
+		t.server.cancel()
+		delete(p.targets, key)
+	}
+
+	s, err := newServer(p.servers.ctx, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	// The collectors are registered once rather than on every probe
+	reg, err := newProbeRegistry(key.target, s)
+	if err != nil {
+		s.cancel()
+		return nil, err
+	}
+
+	if len(p.targets) >= maxProbeTargets {
+		p.evictLeastRecent()
+	}
+	t := &probeTarget{server: s, reg: reg, lastUsed: now}
+	p.targets[key] = t
+	log.WithFields(log.Fields{"target": key.target, "module": key.module}).Info("Created collectors for probe target")
+	return t, nil
+}
+
+// newProbeRegistry registers a server's collectors with a registry of their own, labelled with the target.
+// The histograms of what finished are gathered after the rest, the same as for /metrics, as they're what the rest's scrape observed.
+func newProbeRegistry(target string, s *server) (prometheus.Gatherer, error) {
+	reg, scraped := prometheus.NewRegistry(), prometheus.NewRegistry()
+	labels := prometheus.Labels{"name": target}
+	wrapped, wrappedScraped := prometheus.WrapRegistererWith(labels, reg), prometheus.WrapRegistererWith(labels, scraped)
+	for _, collector := range s.collectors {
+		if err := wrapped.Register(collector); err != nil {
+			return nil, err
+		}
+		if observer, ok := collector.(histogramObserver); ok {
+			if err := wrappedScraped.Register(observer.finishedHistograms().scrapedHistograms()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return prometheus.Gatherers{reg, scraped}, nil
+}
+
+// evictLeastRecent drops the target which was probed least recently. p.mu must be held
+func (p *prober) evictLeastRecent() {
+	var oldest probeKey
+	var oldestTarget *probeTarget
+	for key, t := range p.targets {
+		if oldestTarget == nil || t.lastUsed.Before(oldestTarget.lastUsed) {
+			oldest, oldestTarget = key, t
+		}
+	}
+	if oldestTarget != nil {
+		oldestTarget.server.cancel()
+		delete(p.targets, oldest)
+		log.WithFields(log.Fields{"target": oldest.target, "module": oldest.module}).Debug("Dropped least recently used probe target")
+	}
+}
+
+// evict drops the targets which haven't been probed recently. p.mu must be held
+func (p *prober) evict(now time.Time) {
+	for key, t := range p.targets {
+		if now.Sub(t.lastUsed) > probeTargetTTL {
+			t.server.cancel()
+			delete(p.targets, key)
+			log.WithFields(log.Fields{"target": key.target, "module": key.module}).Debug("Dropped unused probe target")
+		}
+	}
+}
+
+// close cancels the in-flight requests of every target
+func (p *prober) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, t := range p.targets {
+		t.server.cancel()
+		delete(p.targets, key)
+	}
+}
+
+func (p *prober) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+	key := probeKey{target: target, module: r.URL.Query().Get("module")}
+	if key.module == "" {
+		key.module = defaultModule
+	}
+
+	// A server in the config is already scraped for /metrics, so it's served from the shared gather rather than collected again for the probe.
+	// Collecting it would take the jobs which finished from Prometheus' next scrape of /metrics.
+	if _, configured := p.servers.currentConfig().Servers[key.target]; configured {
+		if _, ok := p.servers.configuredServer(key.target); !ok {
+			http.Error(w, fmt.Sprintf("server %q has no collectors", key.target), http.StatusServiceUnavailable)
+			return
+		}
+		gatherer := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			families, err := p.servers.gatherer.recent().Gather()
+			return serverFamilies(families, key.target), err
+		})
+		promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+		return
+	}
+
+	settings, code, err := p.settings(key.target, key.module)
+	if err != nil {
+		log.WithFields(log.Fields{"target": key.target, "module": key.module, "error": err}).Warning("Probe rejected")
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	t, err := p.target(key, settings)
+	if err != nil {
+		log.WithFields(log.Fields{"target": key.target, "module": key.module, "error": err}).Error("Failed to create collectors for probe target")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	promhttp.HandlerFor(t.reg, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
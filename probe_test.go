@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"azdoexporter/azdo"
+	"azdoexporter/config"
+)
+
+// probeServers has a module which may only probe the Azure DevOps server stub, and counts the stub's requests
+func probeServers(t *testing.T) (*prober, *serverManager, *httptest.Server, *int32) {
+	var requests int32
+	azdoServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprint(w, `{"count": 0, "value": []}`)
+	}))
+	t.Cleanup(azdoServer.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	sm := newServerManager(ctx, prometheus.NewRegistry(), "")
+	sm.config = config.Config{
+		Servers: map[string]config.Server{"named": {AzDoClient: azdo.AzDoClient{Address: azdoServer.URL, AccessToken: "token"}}},
+		Modules: map[string]config.Module{
+			defaultModule: {
+				Server:        config.Server{AzDoClient: azdo.AzDoClient{AccessToken: "token"}},
+				TargetPattern: `http://127\.0\.0\.1:\d+`,
+			},
+		},
+	}
+	if err := sm.config.CompileTargetPatterns(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server in the config has registered collectors, as it would once the config is applied
+	named, err := newServer(ctx, newServerSettings(sm.config, "named", sm.config.Servers["named"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.register("named", named); err != nil {
+		t.Fatal(err)
+	}
+	sm.servers["named"] = named
+
+	p := newProber(sm)
+	t.Cleanup(p.close)
+	return p, sm, azdoServer, &requests
+}
+
+func probe(p *prober, query url.Values) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/probe?"+query.Encode(), nil))
+	return w
+}
+
+func TestProbeHandler(t *testing.T) {
+	p, _, azdoServer, requests := probeServers(t)
+
+	tests := []struct {
+		name         string
+		query        url.Values
+		wantCode     int
+		wantRequests bool
+		unlabelled   bool // The server's metrics from /metrics, which have no name label
+	}{
+		{
+			name:         "target allowed by the module",
+			query:        url.Values{"target": {azdoServer.URL}},
+			wantCode:     http.StatusOK,
+			wantRequests: true,
+		},
+		{
+			name:         "target allowed by a named module",
+			query:        url.Values{"target": {azdoServer.URL}, "module": {defaultModule}},
+			wantCode:     http.StatusOK,
+			wantRequests: true,
+		},
+		{
+			name:         "target which is the name of a server",
+			query:        url.Values{"target": {"named"}},
+			wantCode:     http.StatusOK,
+			wantRequests: true,
+			unlabelled:   true,
+		},
+		{
+			name:     "target not allowed by the module",
+			query:    url.Values{"target": {"https://dev.azure.com/someone-else"}},
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "target which only partly matches the pattern",
+			query:    url.Values{"target": {azdoServer.URL + "/collection"}},
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "unknown module",
+			query:    url.Values{"target": {azdoServer.URL}, "module": {"missing"}},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "target which isn't an address",
+			query:    url.Values{"target": {"ftp://127.0.0.1:21"}},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "no target",
+			query:    url.Values{"module": {defaultModule}},
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := atomic.LoadInt32(requests)
+			w := probe(p, test.query)
+
+			if w.Code != test.wantCode {
+				t.Errorf("got status %v, want %v: %v", w.Code, test.wantCode, w.Body.String())
+			}
+			if made := atomic.LoadInt32(requests) > before; made != test.wantRequests {
+				t.Errorf("requests were made to the target: %v, want %v", made, test.wantRequests)
+			}
+			if test.wantCode == http.StatusOK && !test.unlabelled && !strings.Contains(w.Body.String(), fmt.Sprintf("name=%q", test.query.Get("target"))) {
+				t.Errorf("the metrics aren't labelled with the target:\n%v", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestProbeReusesTargets(t *testing.T) {
+	p, sm, azdoServer, _ := probeServers(t)
+	query := url.Values{"target": {azdoServer.URL}}
+	key := probeKey{target: azdoServer.URL, module: defaultModule}
+
+	probe(p, query)
+	first := p.targets[key]
+	if w := probe(p, query); w.Code != http.StatusOK {
+		t.Fatalf("got status %v: %v", w.Code, w.Body.String())
+	}
+	if len(p.targets) != 1 || p.targets[key] != first {
+		t.Error("the collectors of a target weren't reused by the next probe")
+	}
+
+	// Probing the same address with the collectors of another module keeps both
+	sm.mu.Lock()
+	sm.config.Modules["builds"] = config.Module{
+		Server:        config.Server{AzDoClient: azdo.AzDoClient{AccessToken: "token"}, CollectBuilds: true},
+		TargetPattern: `http://127\.0\.0\.1:\d+`,
+	}
+	sm.config.CompileTargetPatterns()
+	sm.mu.Unlock()
+	probe(p, url.Values{"target": {azdoServer.URL}, "module": {"builds"}})
+	if len(p.targets) != 2 || p.targets[key] != first {
+		t.Errorf("got %v targets, want one for each module", len(p.targets))
+	}
+
+	// A reload which changes the module's settings replaces its collectors
+	sm.mu.Lock()
+	sm.config.Modules[defaultModule] = config.Module{
+		Server:        config.Server{AzDoClient: azdo.AzDoClient{AccessToken: "new token"}},
+		TargetPattern: `http://127\.0\.0\.1:\d+`,
+	}
+	sm.config.CompileTargetPatterns()
+	sm.mu.Unlock()
+	probe(p, query)
+	if p.targets[key] == first {
+		t.Error("the collectors of a target were reused after its module's settings changed")
+	}
+	if first.server.client.Context.Err() == nil {
+		t.Error("the replaced target's requests weren't cancelled")
+	}
+
+	body, _ := ioutil.ReadAll(probe(p, query).Body)
+	if !strings.Contains(string(body), "tfs_") {
+		t.Errorf("the probe returned no metrics:\n%s", body)
+	}
+}
+
+func TestProbeReusesConfiguredServers(t *testing.T) {
+	p, sm, _, _ := probeServers(t)
+	named, _ := sm.configuredServer("named")
+
+	if w := probe(p, url.Values{"target": {"named"}}); w.Code != http.StatusOK {
+		t.Fatalf("got status %v: %v", w.Code, w.Body.String())
+	}
+	if len(p.targets) != 0 {
+		t.Errorf("got %v probe targets, want the configured server's collectors used instead", len(p.targets))
+	}
+	if w := probe(p, url.Values{"target": {"named"}}); !strings.Contains(w.Body.String(), "tfs_up 1") {
+		t.Errorf("got\n%v\nwant the configured server's metrics without its name label", w.Body.String())
+	}
+	if named.agents.status.LastScrape.IsZero() {
+		t.Error("the configured server's collectors weren't scraped")
+	}
+
+	// A server in the config which has no collectors, e.g. as they couldn't be registered, isn't created for the probe either
+	sm.mu.Lock()
+	delete(sm.servers, "named")
+	sm.mu.Unlock()
+	if w := probe(p, url.Values{"target": {"named"}}); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %v, want %v", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestProbeLeavesTheFinishedJobsOfConfiguredServersToMetrics(t *testing.T) {
+	p, sm, _, _ := probeServers(t)
+
+	var finished atomic.Int64
+	azdoServer := agentsServer(t, &atomic.Bool{}, &finished)
+	sm.mu.Lock()
+	sm.config.Servers["agents"] = config.Server{AzDoClient: azdo.AzDoClient{Address: azdoServer.URL, AccessToken: "token"}}
+	sm.mu.Unlock()
+	agents, err := newServer(sm.ctx, newServerSettings(sm.config, "agents", sm.config.Servers["agents"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.register("agents", agents); err != nil {
+		t.Fatal(err)
+	}
+	sm.servers["agents"] = agents
+	gatherMetrics(t, sm.gatherer)
+
+	// The job finishes between Prometheus' scrapes of /metrics, and the server is probed in between
+	finished.Store(time.Now().UnixNano())
+	if w := probe(p, url.Values{"target": {"agents"}}); w.Code != http.StatusOK {
+		t.Fatalf("got status %v: %v", w.Code, w.Body.String())
+	}
+
+	var observed uint64
+	for _, total := range gatherMetrics(t, sm.gatherer)["tfs_pool_job_total_length_secs"] {
+		observed += total.GetHistogram().GetSampleCount()
+	}
+	if observed != 1 {
+		t.Errorf("got %v jobs observed by /metrics, want the job which finished", observed)
+	}
+}
+
+func TestProbeTargetsAreCapped(t *testing.T) {
+	p, _, azdoServer, _ := probeServers(t)
+
+	// Fill the cache with targets probed before the stub's
+	past := time.Now().Add(-time.Minute)
+	for i := 0; i < maxProbeTargets; i++ {
+		key := probeKey{target: fmt.Sprintf("http://127.0.0.1:%v", i), module: defaultModule}
+		_, cancel := context.WithCancel(context.Background())
+		p.targets[key] = &probeTarget{server: &server{cancel: cancel}, lastUsed: past.Add(time.Duration(i) * time.Millisecond)}
+	}
+
+	if w := probe(p, url.Values{"target": {azdoServer.URL}}); w.Code != http.StatusOK {
+		t.Fatalf("got status %v: %v", w.Code, w.Body.String())
+	}
+	if len(p.targets) != maxProbeTargets {
+		t.Errorf("got %v targets, want at most %v", len(p.targets), maxProbeTargets)
+	}
+	if _, ok := p.targets[probeKey{target: "http://127.0.0.1:0", module: defaultModule}]; ok {
+		t.Error("the target probed least recently was kept")
+	}
+	if _, ok := p.targets[probeKey{target: azdoServer.URL, module: defaultModule}]; !ok {
+		t.Error("the new target wasn't kept")
+	}
+}
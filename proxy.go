@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/http/httpproxy"
+
+	"azdoexporter/config"
+)
+
+// proxyFunc returns the function a server's transport uses to pick a proxy.
+// With no proxy set it falls back to HTTP_PROXY, HTTPS_PROXY and NO_PROXY from the environment.
+func proxyFunc(p config.Proxy) (func(*http.Request) (*url.URL, error), error) {
+	if p.URL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return nil, err
+	}
+	if p.Username != "" {
+		// The transport sends these as the Proxy-Authorization header
+		u.User = url.UserPassword(p.Username, p.Password)
+	}
+
+	c := httpproxy.Config{HTTPProxy: u.String(), HTTPSProxy: u.String(), NoProxy: p.NoProxy}
+	proxyForURL := c.ProxyFunc()
+
+	return func(req *http.Request) (*url.URL, error) {
+		return proxyForURL(req.URL)
+	}, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"azdoexporter/config"
+)
+
+func TestProxyFunc(t *testing.T) {
+	proxy := config.Proxy{URL: "http://proxy.internal:3128", NoProxy: "localhost,.internal,10.0.0.0/8", Username: "user", Password: "p@ss"}
+	proxyForRequest, err := proxyFunc(proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url       string
+		wantProxy bool
+	}{
+		{"https://dev.azure.com/org/_apis/projects", true},
+		{"http://azdo.example.com/tfs", true},
+		{"https://localhost:8080/tfs", false},
+		{"https://azdo.internal/tfs", false},
+		{"https://tfs.azdo.internal/tfs", false},
+		{"https://10.1.2.3/tfs", false},
+		{"https://11.1.2.3/tfs", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, test.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := proxyForRequest(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !test.wantProxy {
+				if u != nil {
+					t.Errorf("got proxy %v, want the request sent directly", u)
+				}
+				return
+			}
+			if u == nil || u.Host != "proxy.internal:3128" {
+				t.Fatalf("got proxy %v, want proxy.internal:3128", u)
+			}
+			if password, _ := u.User.Password(); u.User.Username() != "user" || password != "p@ss" {
+				t.Errorf("got proxy credentials %v, want the configured username and password", u.User)
+			}
+		})
+	}
+}
+
+func TestProxyFuncWithoutCredentials(t *testing.T) {
+	proxyForRequest, err := proxyFunc(config.Proxy{URL: "http://proxy.internal:3128"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://dev.azure.com/org", nil)
+	u, err := proxyForRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u == nil || u.User != nil {
+		t.Errorf("got proxy %v, want proxy.internal:3128 without credentials", u)
+	}
+}
+
+func TestProxyFuncWithInvalidURL(t *testing.T) {
+	if _, err := proxyFunc(config.Proxy{URL: "http://[proxy.internal"}); err == nil {
+		t.Error("a proxy URL which can't be parsed was used")
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"azdoexporter/config"
+)
+
+// Remote-write requests which failed are queued and sent again on the next push, oldest first, until this many are queued
+const maxQueuedRemoteWrites = 10
+
+// pusher periodically gathers the metrics and pushes them to a remote-write endpoint or a Pushgateway,
+// for when Prometheus can't reach the exporter but the exporter can reach out
+type pusher struct {
+	settings config.Push
+	gatherer prometheus.Gatherer // Reuses a recent scrape, so pushing doesn't scrape Azure DevOps again
+	client   *http.Client
+
+	queued []remoteWriteRequest // Remote writes which failed, oldest first
+}
+
+func newPusher(settings config.Push, gatherer prometheus.Gatherer) (*pusher, error) {
+	tlsConfig, err := settings.TLS.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TLS config - %v", err)
+	}
+
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment, IdleConnTimeout: time.Second * 20, TLSClientConfig: tlsConfig}
+	return &pusher{
+		settings: settings,
+		gatherer: gatherer,
+		client:   &http.Client{Transport: pushAuthTransport{settings: settings, next: transport}, Timeout: settings.Interval.Duration},
+	}, nil
+}
+
+// run pushes every interval until ctx is cancelled
+func (p *pusher) run(ctx context.Context) {
+	log.WithFields(log.Fields{"mode": p.settings.Mode, "url": p.settings.URL, "interval": p.settings.Interval.Duration}).Info("Pushing metrics")
+
+	ticker := time.NewTicker(p.settings.Interval.Duration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.push(ctx); err != nil && ctx.Err() == nil {
+				log.WithFields(log.Fields{"mode": p.settings.Mode, "url": p.settings.URL, "error": err}).Error("Failed to push metrics")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *pusher) push(ctx context.Context) error {
+	// A push has until the next one is due
+	ctx, cancel := context.WithTimeout(ctx, p.settings.Interval.Duration)
+	defer cancel()
+
+	if p.settings.Mode == config.PushModePushgateway {
+		return p.pushToGateway(ctx)
+	}
+	return p.pushRemoteWrite(ctx)
+}
+
+// pushToGateway replaces the metrics of the job on the Pushgateway, retrying until the push is due to be replaced
+func (p *pusher) pushToGateway(ctx context.Context) error {
+	gateway := push.New(p.settings.URL, p.settings.Job).Gatherer(p.gatherer).Client(p.client)
+
+	eb := backoff.NewExponentialBackOff()
+	eb.MaxElapsedTime = p.settings.Interval.Duration
+	return backoff.RetryNotify(func() error {
+		return gateway.PushContext(ctx)
+	}, backoff.WithContext(eb, ctx), func(err error, d time.Duration) {
+		log.WithFields(log.Fields{"url": p.settings.URL, "error": err, "retryIn": d}).Warning("Retrying push to Pushgateway")
+	})
+}
+
+// pushRemoteWrite sends the metrics, and any earlier pushes which failed, to the remote-write endpoint
+func (p *pusher) pushRemoteWrite(ctx context.Context) error {
+	families, err := p.gatherer.Gather()
+	if err != nil {
+		// Whatever could be gathered is still pushed, the same as a scrape
+		log.WithField("error", err).Warning("Errors gathering metrics to push")
+	}
+
+	p.queued = append(p.queued, encodeWriteRequest(families, p.settings.Job, time.Now()))
+	if dropped := len(p.queued) - maxQueuedRemoteWrites; dropped > 0 {
+		log.WithField("dropped", dropped).Warning("Too many remote writes queued. Dropping the oldest")
+		p.queued = p.queued[dropped:]
+	}
+
+	for len(p.queued) > 0 {
+		retryable, err := p.writeRemote(ctx, p.queued[0])
+		if err != nil && retryable {
+			return fmt.Errorf("%v. %v remote writes queued", err, len(p.queued))
+		}
+		p.queued = p.queued[1:]
+		if err != nil {
+			return fmt.Errorf("%v. Dropped the remote write as it won't succeed if retried", err)
+		}
+	}
+	return nil
+}
+
+// writeRemote sends one remote-write request, retrying until the next push is due.
+// It returns whether the request is worth retrying later if it failed.
+func (p *pusher) writeRemote(ctx context.Context, request remoteWriteRequest) (bool, error) {
+	body := snappy.Encode(nil, request)
+	retryable := true
+
+	eb := backoff.NewExponentialBackOff()
+	eb.MaxElapsedTime = p.settings.Interval.Duration
+	err := backoff.RetryNotify(func() error {
+		req, err := http.NewRequest("POST", p.settings.URL, bytes.NewReader(body))
+		if err != nil {
+			retryable = false
+			return backoff.Permanent(err)
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+		resp, err := p.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+			return nil
+		}
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		err = fmt.Errorf("remote write to %v returned %v - %s", p.settings.URL, resp.Status, bytes.TrimSpace(message))
+
+		// Only server errors and rate limiting are retried, the same as Prometheus. Anything else is a problem with the request
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return err
+		}
+		retryable = false
+		return backoff.Permanent(err)
+	}, backoff.WithContext(eb, ctx), func(err error, d time.Duration) {
+		log.WithFields(log.Fields{"url": p.settings.URL, "error": err, "retryIn": d}).Warning("Retrying remote write")
+	})
+
+	return retryable, err
+}
+
+// pushAuthTransport adds basic auth or a bearer token to each push
+type pushAuthTransport struct {
+	settings config.Push
+	next     http.RoundTripper
+}
+
+func (t pushAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch {
+	case t.settings.BearerToken != "":
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+t.settings.BearerToken)
+	case t.settings.Username != "":
+		req = req.Clone(req.Context())
+		req.SetBasicAuth(t.settings.Username, t.settings.Password)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// remoteWriteRequest is an encoded remote-write 1.0 prometheus.WriteRequest, before it's compressed
+type remoteWriteRequest []byte
+
+type remoteLabel struct {
+	name  string
+	value string
+}
+
+// encodeWriteRequest encodes the metric families as a time series per sample.
+// Histograms and summaries are split into their _bucket, _sum and _count series, the same as the text format.
+func encodeWriteRequest(families []*dto.MetricFamily, job string, now time.Time) remoteWriteRequest {
+	var b []byte
+	for _, family := range families {
+		name := family.GetName()
+		for _, m := range family.GetMetric() {
+			labels := []remoteLabel{{"job", job}}
+			for _, l := range m.GetLabel() {
+				labels = append(labels, remoteLabel{l.GetName(), l.GetValue()})
+			}
+
+			timestamp := now.UnixNano() / int64(time.Millisecond)
+			if m.TimestampMs != nil {
+				timestamp = m.GetTimestampMs()
+			}
+
+			series := func(suffix string, value float64, extra ...remoteLabel) {
+				b = appendTimeSeries(b, name+suffix, append(append([]remoteLabel{}, labels...), extra...), value, timestamp)
+			}
+
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				series("", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				series("", m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				series("", m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				for _, q := range m.GetSummary().GetQuantile() {
+					series("", q.GetValue(), remoteLabel{"quantile", formatFloat(q.GetQuantile())})
+				}
+				series("_sum", m.GetSummary().GetSampleSum())
+				series("_count", float64(m.GetSummary().GetSampleCount()))
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				for _, bucket := range m.GetHistogram().GetBucket() {
+					if math.IsInf(bucket.GetUpperBound(), +1) {
+						continue
+					}
+					series("_bucket", float64(bucket.GetCumulativeCount()), remoteLabel{"le", formatFloat(bucket.GetUpperBound())})
+				}
+				series("_bucket", float64(m.GetHistogram().GetSampleCount()), remoteLabel{"le", "+Inf"})
+				series("_sum", m.GetHistogram().GetSampleSum())
+				series("_count", float64(m.GetHistogram().GetSampleCount()))
+			}
+		}
+	}
+	return b
+}
+
+// appendTimeSeries appends a TimeSeries with one sample to an encoded WriteRequest, with its labels sorted by name as remote-write requires
+func appendTimeSeries(b []byte, name string, labels []remoteLabel, value float64, timestamp int64) []byte {
+	labels = append(labels, remoteLabel{"__name__", name})
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+
+	var series []byte
+	for _, l := range labels {
+		var label []byte
+		label = protowire.AppendTag(label, 1, protowire.BytesType)
+		label = protowire.AppendString(label, l.name)
+		label = protowire.AppendTag(label, 2, protowire.BytesType)
+		label = protowire.AppendString(label, l.value)
+
+		series = protowire.AppendTag(series, 1, protowire.BytesType)
+		series = protowire.AppendBytes(series, label)
+	}
+
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(timestamp))
+
+	series = protowire.AppendTag(series, 2, protowire.BytesType)
+	series = protowire.AppendBytes(series, sample)
+
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	return protowire.AppendBytes(b, series)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
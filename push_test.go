@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"azdoexporter/config"
+)
+
+// remoteWriteReceiver decodes each remote write it's sent. It fails them with fail's status while it isn't zero
+type remoteWriteReceiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	fail     int
+	received []writeRequest
+}
+
+// writeRequest is a remote write request as decoded by decodeWriteRequest
+type writeRequest struct {
+	timeseries []timeSeries
+}
+
+type timeSeries struct {
+	labels  []remoteLabel
+	samples []sample
+}
+
+type sample struct {
+	value     float64
+	timestamp int64
+}
+
+// decodeWriteRequest decodes the fields of a WriteRequest which encodeWriteRequest writes, by hand the same as it encodes them
+func decodeWriteRequest(b []byte) (writeRequest, error) {
+	var request writeRequest
+	err := decodeFields(b, func(num protowire.Number, _ uint64, b []byte) error {
+		if num != 1 {
+			return nil
+		}
+
+		var ts timeSeries
+		err := decodeFields(b, func(num protowire.Number, _ uint64, b []byte) error {
+			switch num {
+			case 1:
+				var l remoteLabel
+				err := decodeFields(b, func(num protowire.Number, _ uint64, b []byte) error {
+					switch num {
+					case 1:
+						l.name = string(b)
+					case 2:
+						l.value = string(b)
+					}
+					return nil
+				})
+				ts.labels = append(ts.labels, l)
+				return err
+			case 2:
+				var s sample
+				err := decodeFields(b, func(num protowire.Number, v uint64, _ []byte) error {
+					switch num {
+					case 1:
+						s.value = math.Float64frombits(v)
+					case 2:
+						s.timestamp = int64(v)
+					}
+					return nil
+				})
+				ts.samples = append(ts.samples, s)
+				return err
+			}
+			return nil
+		})
+		request.timeseries = append(request.timeseries, ts)
+		return err
+	})
+	return request, err
+}
+
+// decodeFields calls field with each field of an encoded message, and its value if it's a number or its bytes if it's a length delimited
+func decodeFields(b []byte, field func(num protowire.Number, v uint64, b []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var (
+			v     uint64
+			bytes []byte
+		)
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := field(num, v, bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newRemoteWriteReceiver(t *testing.T) *remoteWriteReceiver {
+	receiver := &remoteWriteReceiver{}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		if receiver.fail != 0 {
+			http.Error(w, "failed", receiver.fail)
+			return
+		}
+
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("got headers %v, want a snappy encoded protobuf", r.Header)
+		}
+		compressed, _ := ioutil.ReadAll(r.Body)
+		body, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Errorf("body isn't snappy encoded - %v", err)
+			return
+		}
+		request, err := decodeWriteRequest(body)
+		if err != nil {
+			t.Errorf("body isn't a WriteRequest - %v", err)
+			return
+		}
+		receiver.received = append(receiver.received, request)
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver
+}
+
+func (r *remoteWriteReceiver) failWith(status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fail = status
+}
+
+func (r *remoteWriteReceiver) requests() []writeRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]writeRequest{}, r.received...)
+}
+
+func testPusher(t *testing.T, mode string, url string, gatherer prometheus.Gatherer) *pusher {
+	p, err := newPusher(config.Push{Mode: mode, URL: url, Job: "azdo_exporter", Interval: config.Duration{Duration: 100 * time.Millisecond}}, gatherer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// seriesValues returns the value of each series keyed by its labels, formatted as name{label="value",...}
+func seriesValues(request writeRequest) map[string]float64 {
+	values := make(map[string]float64)
+	for _, ts := range request.timeseries {
+		var name string
+		var labels []string
+		for _, l := range ts.labels {
+			if l.name == "__name__" {
+				name = l.value
+				continue
+			}
+			labels = append(labels, l.name+"="+`"`+l.value+`"`)
+		}
+		for _, sample := range ts.samples {
+			values[name+"{"+strings.Join(labels, ",")+"}"] = sample.value
+		}
+	}
+	return values
+}
+
+func TestRemoteWriteEncodesSeries(t *testing.T) {
+	receiver := newRemoteWriteReceiver(t)
+
+	reg := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "tfs_pool_queued_jobs", Help: "Queued jobs"}, []string{"name", "pool"})
+	gauge.WithLabelValues("s1", "Default").Set(3)
+	histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "tfs_job_duration_secs", Help: "Job durations", Buckets: []float64{1, 10}}, []string{"name"})
+	histogram.WithLabelValues("s1").Observe(5)
+	reg.MustRegister(gauge, histogram)
+
+	before := time.Now()
+	if err := testPusher(t, config.PushModeRemoteWrite, receiver.URL, reg).push(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := receiver.requests()
+	if len(requests) != 1 {
+		t.Fatalf("got %v remote writes, want 1", len(requests))
+	}
+
+	// The labels of each series are sorted by name, as remote write requires
+	got := seriesValues(requests[0])
+	want := map[string]float64{
+		`tfs_pool_queued_jobs{job="azdo_exporter",name="s1",pool="Default"}`:    3,
+		`tfs_job_duration_secs_bucket{job="azdo_exporter",le="1",name="s1"}`:    0,
+		`tfs_job_duration_secs_bucket{job="azdo_exporter",le="10",name="s1"}`:   1,
+		`tfs_job_duration_secs_bucket{job="azdo_exporter",le="+Inf",name="s1"}`: 1,
+		`tfs_job_duration_secs_sum{job="azdo_exporter",name="s1"}`:              5,
+		`tfs_job_duration_secs_count{job="azdo_exporter",name="s1"}`:            1,
+	}
+	if len(got) != len(want) {
+		t.Errorf("got series %v, want %v", got, want)
+	}
+	for series, value := range want {
+		if v, ok := got[series]; !ok || v != value {
+			t.Errorf("got %v = %v (found %v), want %v", series, v, ok, value)
+		}
+	}
+
+	for _, ts := range requests[0].timeseries {
+		if len(ts.samples) != 1 || ts.samples[0].timestamp < before.UnixNano()/int64(time.Millisecond) {
+			t.Errorf("got samples %v, want one timestamped with the push", ts.samples)
+		}
+	}
+}
+
+func TestRemoteWriteQueuesFailedRequests(t *testing.T) {
+	receiver := newRemoteWriteReceiver(t)
+
+	reg := prometheus.NewRegistry()
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "push_number", Help: "Which push this is"})
+	reg.MustRegister(gauge)
+	p := testPusher(t, config.PushModeRemoteWrite, receiver.URL, reg)
+
+	// Pushes which fail with a server error are queued. Once too many are queued the oldest are dropped
+	receiver.failWith(http.StatusServiceUnavailable)
+	for push := 1; push <= maxQueuedRemoteWrites+2; push++ {
+		gauge.Set(float64(push))
+		if err := p.push(context.Background()); err == nil {
+			t.Fatalf("push %v succeeded while the receiver was failing", push)
+		}
+	}
+	if len(p.queued) != maxQueuedRemoteWrites {
+		t.Errorf("got %v remote writes queued, want %v", len(p.queued), maxQueuedRemoteWrites)
+	}
+
+	// The next push sends those queued, oldest first, then its own. Its own is queued too so the oldest is dropped again
+	receiver.failWith(0)
+	gauge.Set(maxQueuedRemoteWrites + 3)
+	if err := p.push(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	requests := receiver.requests()
+	if len(requests) != maxQueuedRemoteWrites {
+		t.Fatalf("got %v remote writes, want %v", len(requests), maxQueuedRemoteWrites)
+	}
+	for i, request := range requests {
+		if got, want := seriesValues(request)[`push_number{job="azdo_exporter"}`], float64(i+4); got != want {
+			t.Errorf("remote write %v was push %v, want push %v", i, got, want)
+		}
+	}
+	if len(p.queued) != 0 {
+		t.Errorf("got %v remote writes still queued", len(p.queued))
+	}
+
+	// A request the receiver rejects won't succeed if retried, so it isn't queued
+	receiver.failWith(http.StatusBadRequest)
+	if err := p.push(context.Background()); err == nil || len(p.queued) != 0 {
+		t.Errorf("got error %v and %v queued, want the rejected remote write dropped", err, len(p.queued))
+	}
+}
+
+func TestPushgatewayReplacesJob(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		method string
+		path   string
+		body   string
+	)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		method, path, body = r.Method, r.URL.Path, string(b)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	reg := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "tfs_pool_queued_jobs", Help: "Queued jobs"}, []string{"name"})
+	gauge.WithLabelValues("s1").Set(3)
+	reg.MustRegister(gauge)
+
+	if err := testPusher(t, config.PushModePushgateway, gateway.URL, reg).push(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// A PUT replaces every metric of the job's group, so metrics which have gone aren't left behind
+	if method != http.MethodPut || path != "/metrics/job/azdo_exporter" {
+		t.Errorf("got %v %v, want a PUT of the job's group", method, path)
+	}
+	if !strings.Contains(body, "tfs_pool_queued_jobs") {
+		t.Error("the metrics weren't pushed")
+	}
+}
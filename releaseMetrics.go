@@ -0,0 +1,124 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	inProgressDeploymentsDesc = prometheus.NewDesc(
+		"tfs_release_deployments_in_progress",
+		"Total of classic release deployments in progress",
+		[]string{"project", "definition", "environment"},
+		nil,
+	)
+
+	pendingApprovalsDesc = prometheus.NewDesc(
+		"tfs_release_approvals_pending",
+		"Total of classic release approvals waiting on an approver",
+		[]string{"project", "definition", "environment", "type"},
+		nil,
+	)
+
+	pendingApprovalsOldestDesc = prometheus.NewDesc(
+		"tfs_release_approvals_pending_oldest_age_secs",
+		"Age of the oldest classic release approval waiting on an approver",
+		[]string{"project", "definition", "environment"},
+		nil,
+	)
+
+	releasesScrapeDurationDesc = prometheus.NewDesc(
+		"tfs_release_scrape_duration_seconds",
+		"Duration of time it took to scrape classic releases",
+		[]string{},
+		nil,
+	)
+)
+
+// releaseEnvironment identifies an environment (stage) of a release definition
+type releaseEnvironment struct {
+	definition  string
+	environment string
+}
+
+func calculateReleaseMetrics(rc releaseContext, now time.Time) []prometheus.Metric {
+
+	promMetrics := []prometheus.Metric{}
+
+	inProgress := make(map[releaseEnvironment]float64)
+	for _, deployment := range rc.currentDeployments {
+		inProgress[releaseEnvironment{deployment.ReleaseDefinition.Name, deployment.ReleaseEnvironment.Name}]++
+	}
+
+	for env, count := range inProgress {
+		promMetrics = append(promMetrics, prometheus.MustNewConstMetric(
+			inProgressDeploymentsDesc,
+			prometheus.GaugeValue,
+			count,
+			rc.project.Name,
+			env.definition,
+			env.environment,
+		))
+	}
+
+	type approvalKey struct {
+		releaseEnvironment
+		approvalType string
+	}
+
+	pending := make(map[approvalKey]float64)
+	oldest := make(map[releaseEnvironment]float64)
+	for _, approval := range rc.pendingApprovals {
+		env := releaseEnvironment{approval.ReleaseDefinition.Name, approval.ReleaseEnvironment.Name}
+		pending[approvalKey{env, approval.ApprovalType}]++
+
+		if age := now.Sub(approval.CreatedOn).Seconds(); age > oldest[env] {
+			oldest[env] = age
+		}
+	}
+
+	for k, count := range pending {
+		promMetrics = append(promMetrics, prometheus.MustNewConstMetric(
+			pendingApprovalsDesc,
+			prometheus.GaugeValue,
+			count,
+			rc.project.Name,
+			k.definition,
+			k.environment,
+			k.approvalType,
+		))
+	}
+
+	for env, age := range oldest {
+		promMetrics = append(promMetrics, prometheus.MustNewConstMetric(
+			pendingApprovalsOldestDesc,
+			prometheus.GaugeValue,
+			age,
+			rc.project.Name,
+			env.definition,
+			env.environment,
+		))
+	}
+
+	return promMetrics
+}
+
+func newDeploymentLengths() *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tfs_release_deployment_length_secs",
+		Help:    "Length of classic release deployment duration for an environment",
+		Buckets: calculateBuckets(),
+	}, []string{"project", "definition", "environment"})
+}
+
+// observeDeployments adds the deployments which finished since the last scrape to the deployment lengths
+func observeDeployments(lengths *prometheus.HistogramVec, rc releaseContext) {
+	for _, deployment := range rc.finishedDeployments {
+		if deployment.StartedOn.IsZero() { // Never started, e.g. rejected at the pre-deployment approval
+			continue
+		}
+
+		lengths.WithLabelValues(rc.project.Name, deployment.ReleaseDefinition.Name, deployment.ReleaseEnvironment.Name).Observe(deployment.CompletedOn.Sub(deployment.StartedOn).Seconds())
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"azdoexporter/azdo"
+)
+
+// releasesCollector reports classic Release Management deployments and approvals from the vsrm endpoint
+type releasesCollector struct {
+	AzDoClient *azdo.AzDoClient
+
+	collectMu         sync.Mutex                // Scrapes one at a time so each picks up what finished since the one before
+	windows           map[string]finishedWindow // What the last scrape which succeeded saw of each project, keyed by project ID
+	deploymentLengths *prometheus.HistogramVec  // Cumulative, so each deployment is only observed once
+}
+
+func newReleasesCollector(az azdo.AzDoClient) *releasesCollector {
+	return &releasesCollector{AzDoClient: &az, windows: make(map[string]finishedWindow), deploymentLengths: newDeploymentLengths()}
+}
+
+// waitForScrape returns once a scrape in progress has finished
+func (rc *releasesCollector) waitForScrape() {
+	rc.collectMu.Lock()
+	rc.collectMu.Unlock()
+}
+
+func (rc *releasesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- inProgressDeploymentsDesc
+	ch <- pendingApprovalsDesc
+	ch <- pendingApprovalsOldestDesc
+	ch <- releasesScrapeDurationDesc
+	rc.deploymentLengths.Describe(ch)
+}
+
+func (rc *releasesCollector) Collect(publishMetrics chan<- prometheus.Metric) {
+	rc.collectMu.Lock()
+	defer rc.collectMu.Unlock()
+
+	// The deployment lengths hold every deployment seen so far, so they're published even if this scrape fails
+	defer rc.deploymentLengths.Collect(publishMetrics)
+
+	start := time.Now()
+
+	projects, err := rc.AzDoClient.Projects()
+	if err != nil {
+		log.WithFields(log.Fields{"serverName": rc.AzDoClient.Name, "error": err}).Error("Scrape Failed. Could not retrieve projects.")
+		return
+	}
+	log.WithFields(log.Fields{"serverName": rc.AzDoClient.Name, "projectCount": len(projects)}).Debug("Retrieved projects")
+
+	releaseContexts, failedProjects := rc.scrapeReleases(projects, start)
+	if failedProjects > 0 {
+		// Their window isn't moved on so their deployments which finished are picked up by the next scrape
+		log.WithFields(log.Fields{"serverName": rc.AzDoClient.Name, "failedProjectCount": failedProjects}).Error("Release metrics of projects which failed not exposed due to previous error")
+	}
+
+	for _, releaseContext := range releaseContexts {
+		for _, metric := range calculateReleaseMetrics(releaseContext, start) {
+			publishMetrics <- metric
+		}
+		observeDeployments(rc.deploymentLengths, releaseContext)
+	}
+
+	log.WithFields(log.Fields{"serverName": rc.AzDoClient.Name}).Info("Scraped releases")
+
+	// Time it has take to run this scrape
+	publishMetrics <- prometheus.MustNewConstMetric(
+		releasesScrapeDurationDesc,
+		prometheus.GaugeValue,
+		time.Since(start).Seconds(),
+	)
+}
+
+// scrapeReleases retrieves the deployments and pending approvals for every project, up to maxConcurrentRequests at once.
+// The window of the projects which succeeded is moved on to start. Projects which are gone are forgotten.
+func (rc *releasesCollector) scrapeReleases(projects []azdo.Project, start time.Time) ([]releaseContext, int) {
+	var (
+		releaseContexts []releaseContext
+		windows         = make(map[string]finishedWindow, len(projects))
+		failedProjects  int
+		mu              sync.Mutex
+		wg              sync.WaitGroup
+		requests        = make(chan struct{}, maxConcurrentRequests)
+	)
+
+	for _, project := range projects {
+		requests <- struct{}{}
+		wg.Add(1)
+		go func(p azdo.Project, window finishedWindow) {
+			defer wg.Done()
+			defer func() { <-requests }()
+
+			releaseContext, finished, err := rc.scrapeProjectReleases(p, window)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				windows[p.ID] = window
+				failedProjects++
+				return
+			}
+			windows[p.ID] = window.next(start, finished)
+			releaseContexts = append(releaseContexts, releaseContext)
+		}(project, rc.windows[project.ID])
+	}
+	wg.Wait()
+
+	rc.windows = windows
+
+	return releaseContexts, failedProjects
+}
+
+// scrapeProjectReleases retrieves the deployments which finished since the project's last scrape along with those in progress,
+// and its pending approvals. It also returns when every deployment it was given finished, keyed by deployment ID,
+// including those already seen by the last scrape which aren't observed again.
+func (rc *releasesCollector) scrapeProjectReleases(project azdo.Project, window finishedWindow) (releaseContext, map[int]time.Time, error) {
+
+	finishedDeployments, currentDeployments, err := rc.AzDoClient.DeploymentsAfter(project.ID, window.start)
+	if err != nil {
+		log.WithFields(log.Fields{"serverName": rc.AzDoClient.Name, "project": project.Name, "err": err}).Error("Failed to retrieve deployments for project")
+		return releaseContext{}, nil, err
+	}
+
+	approvals, err := rc.AzDoClient.PendingApprovals(project.ID)
+	if err != nil {
+		log.WithFields(log.Fields{"serverName": rc.AzDoClient.Name, "project": project.Name, "err": err}).Error("Failed to retrieve pending approvals for project")
+		return releaseContext{}, nil, err
+	}
+	log.WithFields(log.Fields{"serverName": rc.AzDoClient.Name, "project": project.Name, "currentDeploymentCount": len(currentDeployments), "pendingApprovalCount": len(approvals)}).Debug("Retrieved releases for project")
+
+	finished := make(map[int]time.Time, len(finishedDeployments))
+	var unseenDeployments []azdo.Deployment
+	for _, deployment := range finishedDeployments {
+		finished[deployment.ID] = deployment.CompletedOn
+		if window.unseen(deployment.ID) {
+			unseenDeployments = append(unseenDeployments, deployment)
+		}
+	}
+
+	return releaseContext{
+		project:             project,
+		currentDeployments:  currentDeployments,
+		finishedDeployments: unseenDeployments,
+		pendingApprovals:    approvals,
+	}, finished, nil
+}
+
+// Contains all the information needed to calculate the release metrics for a project
+type releaseContext struct {
+	project             azdo.Project
+	currentDeployments  []azdo.Deployment
+	finishedDeployments []azdo.Deployment
+	pendingApprovals    []azdo.Approval
+}
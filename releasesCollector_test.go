@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"azdoexporter/azdo"
+)
+
+// releasesServer has two projects. The deployments of one can't be read,
+// the other has a deployment in progress and one which has always just finished
+func releasesServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/_apis/projects":
+			fmt.Fprintf(w, `{"count": 2, "value": [{"id": %q, "name": "good"}, {"id": %q, "name": "bad"}]}`, goodProjectID, badProjectID)
+		case r.URL.Path == "/"+badProjectID+"/_apis/release/deployments":
+			http.Error(w, "forbidden", http.StatusForbidden)
+		case r.URL.Path == "/"+goodProjectID+"/_apis/release/deployments" && r.URL.Query().Get("deploymentStatus") == "inProgress":
+			fmt.Fprint(w, `{"count": 1, "value": [{"id": 1, "releaseDefinition": {"name": "app"}, "releaseEnvironment": {"name": "prod"}}]}`)
+		case r.URL.Path == "/"+goodProjectID+"/_apis/release/deployments":
+			completed := time.Now().UTC()
+			fmt.Fprintf(w, `{"count": 1, "value": [{"id": 2, "startedOn": %q, "completedOn": %q, "releaseDefinition": {"name": "app"}, "releaseEnvironment": {"name": "prod"}}]}`,
+				completed.Add(-time.Minute).Format(time.RFC3339Nano), completed.Format(time.RFC3339Nano))
+		case r.URL.Path == "/"+goodProjectID+"/_apis/release/approvals":
+			fmt.Fprint(w, `{"count": 0, "value": []}`)
+		default:
+			t.Errorf("unexpected request to %v", r.URL)
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestReleasesCollectorKeepsScrapingProjectsWhichSucceed(t *testing.T) {
+	server := releasesServer(t)
+	defer server.Close()
+
+	rc := newReleasesCollector(azdo.AzDoClient{Client: server.Client(), Name: "s1", Address: server.URL, ReleaseAddress: server.URL, AccessToken: "token"})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(rc)
+
+	// The first scrape is only the baseline of when deployments finished
+	scraped := gatherMetrics(t, reg)
+	if inProgress := scraped["tfs_release_deployments_in_progress"]; len(inProgress) != 1 || inProgress[0].GetGauge().GetValue() != 1 {
+		t.Errorf("got %v, want the good project's deployment in progress published although the other project failed", inProgress)
+	}
+	firstScrape := rc.windows[badProjectID].start
+
+	for scrape := 2; scrape <= 3; scrape++ {
+		time.Sleep(10 * time.Millisecond)
+		lengths := gatherMetrics(t, reg)["tfs_release_deployment_length_secs"]
+		if len(lengths) != 1 {
+			t.Fatalf("scrape %v: got %v environments with deployment lengths, want the good project's", scrape, len(lengths))
+		}
+		// The deployment finished during the second scrape, after its start, so it's given to the third too
+		if h := lengths[0].GetHistogram(); h.GetSampleCount() != 1 || h.GetSampleSum() != 60 {
+			t.Errorf("scrape %v: got %v deployments totalling %v, want the deployment of 60 seconds observed once", scrape, h.GetSampleCount(), h.GetSampleSum())
+		}
+	}
+
+	if !rc.windows[goodProjectID].start.After(firstScrape) {
+		t.Error("the last scrape of the project which succeeded wasn't moved on")
+	}
+	if !rc.windows[badProjectID].start.IsZero() {
+		t.Error("the last scrape of the project which failed was moved on")
+	}
+}
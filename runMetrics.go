@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	runsScrapeDurationDesc = prometheus.NewDesc(
+		"tfs_pipeline_runs_scrape_duration_seconds",
+		"Duration of time it took to scrape finished pipeline runs",
+		[]string{},
+		nil,
+	)
+)
+
+const (
+	checkpointRecordType         = "Checkpoint"          // Every approval and check for a stage
+	approvalCheckpointRecordType = "Checkpoint.Approval" // Only the manual approvals for a stage
+)
+
+const (
+	checkpointWaitName = "tfs_pipeline_run_checkpoint_wait_secs"
+	approvalWaitName   = "tfs_pipeline_run_approval_wait_secs"
+)
+
+// newRunWaits creates the histograms of how long the stages of each pipeline's runs waited on checkpoints.
+// They're the same histograms of what finished as the pool jobs', so each run is only observed once.
+func newRunWaits() *finishedHistograms {
+	return newFinishedHistograms([]string{"project", "pipeline"},
+		prometheus.HistogramOpts{
+			Name:    checkpointWaitName,
+			Help:    "Length of time stages of a pipeline spent waiting on approvals and checks",
+			Buckets: calculateBuckets(),
+		},
+		prometheus.HistogramOpts{
+			Name:    approvalWaitName,
+			Help:    "Length of time stages of a pipeline spent waiting on manual approvals",
+			Buckets: calculateBuckets(),
+		},
+	)
+}
+
+// observeRunWaits adds the checkpoints of the runs which finished since the last scrape
+func observeRunWaits(h *finishedHistograms, runContexts []runContext) {
+	for _, rc := range runContexts {
+		labels := []string{rc.project.Name, rc.pipeline.Name}
+
+		// Make sure every pipeline with a finished run has a histogram even if it has no checkpoints
+		h.add(labels, checkpointWaitName)
+
+		for _, record := range rc.timeline {
+			if record.StartTime.IsZero() || record.FinishTime.IsZero() {
+				continue
+			}
+
+			switch record.Type {
+			case checkpointRecordType:
+				h.observe(checkpointWaitName, record.FinishTime.Sub(record.StartTime), labels...)
+			case approvalCheckpointRecordType:
+				h.observe(approvalWaitName, record.FinishTime.Sub(record.StartTime), labels...)
+			}
+		}
+	}
+}
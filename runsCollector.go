@@ -0,0 +1,159 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"azdoexporter/azdo"
+)
+
+// runsCollector reports the time pipeline runs spend waiting on approvals and checks, from the pipelines, runs and timeline APIs.
+// A stage waiting on a checkpoint has no job requests so that time isn't part of the pool queue metrics.
+type runsCollector struct {
+	AzDoClient *azdo.AzDoClient
+
+	collectMu sync.Mutex                // Scrapes one at a time so each picks up what finished since the one before
+	windows   map[string]finishedWindow // What the last scrape which succeeded saw of each project, keyed by project ID
+	waits     *finishedHistograms       // Registered apart from the collector, the same as the pool jobs' histograms
+}
+
+func newRunsCollector(az azdo.AzDoClient) *runsCollector {
+	return &runsCollector{AzDoClient: &az, windows: make(map[string]finishedWindow), waits: newRunWaits()}
+}
+
+// waitForScrape returns once a scrape in progress has finished
+func (rc *runsCollector) waitForScrape() {
+	rc.collectMu.Lock()
+	rc.collectMu.Unlock()
+}
+
+func (rc *runsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- runsScrapeDurationDesc
+}
+
+func (rc *runsCollector) finishedHistograms() *finishedHistograms {
+	return rc.waits
+}
+
+func (rc *runsCollector) Collect(publishMetrics chan<- prometheus.Metric) {
+	rc.collectMu.Lock()
+	defer rc.collectMu.Unlock()
+
+	start := time.Now()
+
+	projects, err := rc.AzDoClient.Projects()
+	if err != nil {
+		log.WithFields(log.Fields{"serverName": rc.AzDoClient.Name, "error": err}).Error("Scrape Failed. Could not retrieve projects.")
+		return
+	}
+	log.WithFields(log.Fields{"serverName": rc.AzDoClient.Name, "projectCount": len(projects)}).Debug("Retrieved projects")
+
+	runContexts, failedProjects := rc.scrapeRuns(projects, start)
+	if failedProjects > 0 {
+		// Their window isn't moved on so their runs which finished are picked up by the next scrape
+		log.WithFields(log.Fields{"serverName": rc.AzDoClient.Name, "failedProjectCount": failedProjects}).Error("Pipeline run metrics of projects which failed not exposed due to previous error")
+	}
+
+	observeRunWaits(rc.waits, runContexts)
+
+	log.WithFields(log.Fields{"serverName": rc.AzDoClient.Name, "finishedRunCount": len(runContexts)}).Info("Scraped pipeline runs")
+
+	// Time it has take to run this scrape
+	publishMetrics <- prometheus.MustNewConstMetric(
+		runsScrapeDurationDesc,
+		prometheus.GaugeValue,
+		time.Since(start).Seconds(),
+	)
+}
+
+// scrapeRuns retrieves the timeline of every run which finished since each project's last scrape, up to maxConcurrentRequests projects at once.
+// The window of the projects which succeeded is moved on to start. Projects which are gone are forgotten.
+func (rc *runsCollector) scrapeRuns(projects []azdo.Project, start time.Time) ([]runContext, int) {
+	var (
+		runContexts    []runContext
+		windows        = make(map[string]finishedWindow, len(projects))
+		failedProjects int
+		mu             sync.Mutex
+		wg             sync.WaitGroup
+		requests       = make(chan struct{}, maxConcurrentRequests)
+	)
+
+	for _, project := range projects {
+		requests <- struct{}{}
+		wg.Add(1)
+		go func(p azdo.Project, window finishedWindow) {
+			defer wg.Done()
+			defer func() { <-requests }()
+
+			projectRunContexts, finished, err := rc.scrapeProjectRuns(p, window)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.WithFields(log.Fields{"serverName": rc.AzDoClient.Name, "project": p.Name, "err": err}).Error("Failed to retrieve pipeline runs for project")
+				windows[p.ID] = window
+				failedProjects++
+				return
+			}
+			windows[p.ID] = window.next(start, finished)
+			runContexts = append(runContexts, projectRunContexts...)
+		}(project, rc.windows[project.ID])
+	}
+	wg.Wait()
+
+	rc.windows = windows
+
+	return runContexts, failedProjects
+}
+
+// scrapeProjectRuns finds the runs of the project's pipelines which finished since its last scrape, with a query of each pipeline's runs,
+// then requests the timelines of those runs. It also returns when every run it was given finished, keyed by run ID,
+// including those already seen by the last scrape which aren't scraped again.
+func (rc *runsCollector) scrapeProjectRuns(project azdo.Project, window finishedWindow) ([]runContext, map[int]time.Time, error) {
+	var runContexts []runContext
+
+	// Nothing can have finished since the last scrape if this is the first
+	if window.start.IsZero() {
+		return runContexts, map[int]time.Time{}, nil
+	}
+
+	pipelines, err := rc.AzDoClient.Pipelines(project.ID)
+	if err != nil {
+		return runContexts, nil, err
+	}
+
+	finished := make(map[int]time.Time)
+	for _, pipeline := range pipelines {
+		runs, err := rc.AzDoClient.FinishedRunsAfter(project.ID, pipeline.ID, window.start)
+		if err != nil {
+			return runContexts, nil, err
+		}
+
+		for _, run := range runs {
+			finished[run.ID] = run.FinishedDate
+			if !window.unseen(run.ID) {
+				continue
+			}
+
+			timeline, err := rc.AzDoClient.Timeline(project.ID, run.ID)
+			if err != nil {
+				return runContexts, nil, err
+			}
+			runContexts = append(runContexts, runContext{project: project, pipeline: pipeline, run: run, timeline: timeline})
+		}
+	}
+	log.WithFields(log.Fields{"serverName": rc.AzDoClient.Name, "project": project.Name, "pipelineCount": len(pipelines), "finishedRunCount": len(runContexts)}).Debug("Retrieved pipeline runs for project")
+
+	return runContexts, finished, nil
+}
+
+// Contains all the information needed to calculate the metrics for a finished run
+type runContext struct {
+	project  azdo.Project
+	pipeline azdo.Pipeline
+	run      azdo.Run
+	timeline []azdo.TimelineRecord
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"azdoexporter/azdo"
+)
+
+const (
+	goodProjectID = "11111111-1111-1111-1111-111111111111"
+	badProjectID  = "22222222-2222-2222-2222-222222222222"
+)
+
+// runsServer has two projects. The pipelines of one can't be read, the other has a pipeline with a run which has always just finished
+func runsServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/_apis/projects":
+			fmt.Fprintf(w, `{"count": 2, "value": [{"id": %q, "name": "good"}, {"id": %q, "name": "bad"}]}`, goodProjectID, badProjectID)
+		case r.URL.Path == "/"+badProjectID+"/_apis/pipelines":
+			http.Error(w, "forbidden", http.StatusForbidden)
+		case r.URL.Path == "/"+goodProjectID+"/_apis/pipelines":
+			fmt.Fprint(w, `{"count": 1, "value": [{"id": 1, "name": "pipeline"}]}`)
+		case r.URL.Path == "/"+goodProjectID+"/_apis/pipelines/1/runs":
+			finished := time.Now().UTC().Format(time.RFC3339Nano)
+			fmt.Fprintf(w, `{"count": 1, "value": [{"id": 7, "state": "completed", "finishedDate": %q, "pipeline": {"id": 1, "name": "pipeline"}}]}`, finished)
+		case r.URL.Path == "/"+goodProjectID+"/_apis/build/builds/7/timeline":
+			fmt.Fprint(w, `{"records": [{"type": "Checkpoint", "startTime": "2026-01-01T12:00:00Z", "finishTime": "2026-01-01T12:00:30Z"}]}`)
+		default:
+			t.Errorf("unexpected request to %v", r.URL)
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestRunsCollectorKeepsScrapingProjectsWhichSucceed(t *testing.T) {
+	server := runsServer(t)
+	defer server.Close()
+
+	rc := newRunsCollector(azdo.AzDoClient{Client: server.Client(), Name: "s1", Address: server.URL, AccessToken: "token"})
+	reg := scrapedGatherer(rc)
+
+	// The first scrape is only the baseline of when runs finished
+	if _, err := reg.Gather(); err != nil {
+		t.Fatal(err)
+	}
+	firstScrape := rc.windows[badProjectID].start
+	time.Sleep(10 * time.Millisecond)
+	scraped := gatherMetrics(t, reg)
+	if len(scraped["tfs_pipeline_runs_scrape_duration_seconds"]) != 1 {
+		t.Error("the scrape duration wasn't published")
+	}
+	waits := scraped["tfs_pipeline_run_checkpoint_wait_secs"]
+	if len(waits) != 1 {
+		t.Fatalf("got %v pipelines with waits, want the good project's", len(waits))
+	}
+	if h := waits[0].GetHistogram(); h.GetSampleCount() != 1 || h.GetSampleSum() != 30 {
+		t.Errorf("got %v waits totalling %v, want the run's checkpoint of 30 seconds", h.GetSampleCount(), h.GetSampleSum())
+	}
+
+	if !rc.windows[goodProjectID].start.After(firstScrape) {
+		t.Error("the last scrape of the project which succeeded wasn't moved on")
+	}
+	if !rc.windows[badProjectID].start.Equal(firstScrape) {
+		t.Error("the last scrape of the project which failed was moved on")
+	}
+
+	// The run finished during the last scrape, after its start, so it's given to the next scrape too.
+	// Prometheus is only given what finished since its last scrape, so there's nothing
+	waits = gatherMetrics(t, reg)["tfs_pipeline_run_checkpoint_wait_secs"]
+	if len(waits) != 0 {
+		t.Errorf("got %v, want the run which finished during the last scrape not observed again", waits)
+	}
+}
+
+func gatherMetrics(t *testing.T, reg prometheus.Gatherer) map[string][]*dto.Metric {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scraped := make(map[string][]*dto.Metric)
+	for _, family := range families {
+		scraped[family.GetName()] = family.GetMetric()
+	}
+	return scraped
+}
+
+func TestFinishedWindow(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	window := finishedWindow{}.next(start, map[int]time.Time{
+		1: start.Add(-time.Second), // Finished before the scrape started, so the next won't be given it
+		2: start.Add(time.Second),  // Finished during the scrape
+	})
+	if !window.unseen(1) || window.unseen(2) {
+		t.Errorf("got %v seen, want only what finished during the scrape", window.seen)
+	}
+
+	// What was seen is kept until a scrape starts after it finished
+	if next := window.next(start.Add(time.Millisecond), nil); next.unseen(2) {
+		t.Error("a run which finished after the next scrape's start was forgotten")
+	}
+	if next := window.next(start.Add(time.Minute), nil); len(next.seen) != 0 {
+		t.Errorf("got %v seen, want what finished before the scrape's start forgotten", next.seen)
+	}
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"azdoexporter/config"
+)
+
+// server is the client and collectors created for a server in the config
+type server struct {
+	settings   serverSettings
+	client     config.Server // The settings with the client, authenticator and context set
+	collectors []prometheus.Collector
+	agents     *azDoCollector
+	hooks      *serviceHookCollector // nil unless the server receives service hooks
+	cancel     context.CancelFunc    // Cancels the server's in-flight requests once it's removed
+}
+
+// scraper is a collector which can be waited on to finish a scrape in progress
+type scraper interface {
+	waitForScrape()
+}
+
+// serverSettings is everything in the config which the collectors of a server are created from.
+// If any of it changes on reload the server's collectors are created again.
+type serverSettings struct {
+	config.Server
+	proxy             config.Proxy
+	reconcileInterval time.Duration
+}
+
+// serverManager creates the collectors for each server in the config and registers them with the registry.
+// On reload only the servers which were added, removed or changed are touched, so unchanged servers keep their state, such as the time of their last scrape.
+type serverManager struct {
+	reg      *prometheus.Registry
+	scraped  *prometheus.Registry // The histograms Prometheus is given of what finished since its last scrape, such as jobs
+	pushed   *prometheus.Registry // The cumulative histograms the pushes are given of what finished
+	gatherer *sharedGatherer      // Gathers reg for Prometheus and everything which pushes the metrics
+	ctx      context.Context      // Every server's requests are cancelled when it's done
+
+	reloadMu     sync.Mutex // Only one reload at a time
+	pathToConfig string
+
+	mu      sync.RWMutex
+	loaded  bool // A config has been loaded and applied
+	config  config.Config
+	servers map[string]*server
+
+	otlp  *otlpExporter // nil unless metrics are pushed with OTLP. Created on the first load
+	sinks []*sink       // Also created on the first load
+	jobs  *jobStore     // nil unless jobs are stored. Also created on the first load
+}
+
+func newServerManager(ctx context.Context, reg *prometheus.Registry, pathToConfig string) *serverManager {
+	scraped, pushed := prometheus.NewRegistry(), prometheus.NewRegistry()
+	return &serverManager{
+		ctx:          ctx,
+		reg:          reg,
+		scraped:      scraped,
+		pushed:       pushed,
+		gatherer:     newSharedGatherer(reg, scraped, pushed),
+		pathToConfig: pathToConfig,
+		servers:      make(map[string]*server),
+	}
+}
+
+// apply makes the registered collectors match the config.
+// Nothing is changed if a server can't be created, or fails its preflight checks when failOnPreflightError is set.
+func (sm *serverManager) apply(c config.Config) error {
+	sm.mu.RLock()
+	current := sm.servers
+	sm.mu.RUnlock()
+
+	if !sm.loaded {
+		sm.gatherer.setPushInterval(c)
+		sm.startSinks(c.Sinks)
+	}
+	if sm.otlp == nil && c.OTLP.Endpoint != "" {
+		sm.otlp = newOTLPExporter(c.OTLP, sm.gatherer.recent())
+	}
+	if sm.jobs == nil && c.JobStore.Path != "" {
+		jobs, err := openJobStore(c.JobStore)
+		if err != nil {
+			return fmt.Errorf("could not open job store %v - %v", c.JobStore.Path, err)
+		}
+		sm.jobs = jobs
+		go jobs.run()
+	}
+
+	servers := make(map[string]*server)
+	var created []*server
+	for name, sc := range c.Servers {
+		settings := newServerSettings(c, name, sc)
+
+		if existing, ok := current[name]; ok && reflect.DeepEqual(existing.settings, settings) {
+			servers[name] = existing
+			continue
+		}
+
+		s, err := newServer(sm.ctx, settings)
+		if err != nil {
+			cancelNew(servers, current)
+			return fmt.Errorf("could not create server %v - %v", name, err)
+		}
+		for _, sink := range sm.sinks {
+			s.agents.jobObservers = append(s.agents.jobObservers, sink)
+		}
+		s.agents.jobStore = sm.jobs
+		servers[name] = s
+		created = append(created, s)
+	}
+
+	if !preflightServers(created) {
+		if c.Exporter.FailOnPreflightError {
+			cancelNew(servers, current)
+			return errors.New("preflight checks failed")
+		}
+		log.Warning("Preflight checks failed. Running degraded, metrics will be missing for the failed servers")
+	}
+
+	// Servers which were removed are unregistered first
+	for name, s := range current {
+		if _, ok := servers[name]; !ok {
+			sm.detach(name, s)
+			s.cancel()
+		}
+	}
+
+	for name, s := range servers {
+		previous, changed := current[name]
+		if previous == s {
+			continue
+		}
+
+		// A changed server is unregistered before its replacement is registered so the same descriptors can be registered again.
+		// It keeps pushing with OTLP until its replacement is registered.
+		if changed {
+			sm.unregister(name, previous)
+		}
+		if err := sm.attach(name, s); err != nil {
+			log.WithFields(log.Fields{"server": name, "error": err}).Error("Failed to register collectors")
+			s.cancel()
+			delete(servers, name)
+
+			// Keep the server as it was rather than leave it without collectors.
+			// Only its collectors are registered again as it's still pushing with OTLP, and its tracer may be in use by a scrape
+			if changed {
+				if err := sm.register(name, previous); err != nil {
+					log.WithFields(log.Fields{"server": name, "error": err}).Error("Failed to register previous collectors again")
+					if sm.otlp != nil {
+						sm.otlp.remove(name)
+					}
+					previous.cancel()
+					continue
+				}
+				servers[name] = previous
+			}
+			continue
+		}
+		if changed {
+			previous.cancel()
+		}
+
+		go s.agents.warmUp()
+		if s.hooks != nil {
+			go s.hooks.run(s.client.Context)
+		}
+	}
+
+	sm.mu.Lock()
+	sm.servers = servers
+	sm.mu.Unlock()
+
+	return nil
+}
+
+// attach registers a server's collectors and starts pushing them with OTLP, replacing what was pushed for the server before.
+// If any collector can't be registered, those which were are unregistered again and nothing is pushed for the server.
+func (sm *serverManager) attach(name string, s *server) error {
+	var providers *otlpProviders
+	if sm.otlp != nil {
+		// Created before the collectors are registered as they set the tracer
+		p, err := sm.otlp.newProviders(name, s)
+		if err != nil {
+			log.WithFields(log.Fields{"server": name, "error": err}).Error("Failed to push with OTLP")
+		} else {
+			providers = &p
+		}
+	}
+
+	if err := sm.register(name, s); err != nil {
+		if providers != nil {
+			go providers.shutdown(name)
+		}
+		return err
+	}
+
+	switch {
+	case providers != nil:
+		sm.otlp.set(name, *providers)
+	case sm.otlp != nil:
+		sm.otlp.remove(name)
+	}
+
+	log.WithField("server", name).Info("Collectors registered")
+	return nil
+}
+
+// registration is a collector of a server and the registry it's registered with
+type registration struct {
+	reg       prometheus.Registerer
+	collector prometheus.Collector
+}
+
+// registrations returns a server's collectors with the registries they're registered with.
+// The histograms of what finished are registered apart from the collectors which observe it, so Prometheus and the pushes are each given their own.
+func (sm *serverManager) registrations(name string, s *server) []registration {
+	labels := prometheus.Labels{"name": name}
+	reg := prometheus.WrapRegistererWith(labels, sm.reg)
+	scraped := prometheus.WrapRegistererWith(labels, sm.scraped)
+	pushed := prometheus.WrapRegistererWith(labels, sm.pushed)
+
+	var registrations []registration
+	for _, collector := range s.collectors {
+		registrations = append(registrations, registration{reg: reg, collector: collector})
+		if observer, ok := collector.(histogramObserver); ok {
+			registrations = append(registrations,
+				registration{reg: scraped, collector: observer.finishedHistograms().scrapedHistograms()},
+				registration{reg: pushed, collector: observer.finishedHistograms().cumulativeHistograms()},
+			)
+		}
+	}
+	return registrations
+}
+
+// register registers a server's collectors. If any can't be registered, those which were are unregistered again.
+func (sm *serverManager) register(name string, s *server) error {
+	registrations := sm.registrations(name, s)
+	for i, r := range registrations {
+		if err := r.reg.Register(r.collector); err != nil {
+			for _, registered := range registrations[:i] {
+				registered.reg.Unregister(registered.collector)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// detach unregisters a server's collectors and stops pushing them with OTLP
+func (sm *serverManager) detach(name string, s *server) {
+	sm.unregister(name, s)
+	if sm.otlp != nil {
+		sm.otlp.remove(name)
+	}
+}
+
+// unregister unregisters a server's collectors
+func (sm *serverManager) unregister(name string, s *server) {
+	for _, r := range sm.registrations(name, s) {
+		if !r.reg.Unregister(r.collector) {
+			log.WithFields(log.Fields{"server": name, "collector": fmt.Sprintf("%T", r.collector)}).Warning("Collector was not registered")
+		}
+	}
+
+	log.WithField("server", name).Info("Collectors unregistered")
+}
+
+// startSinks starts sending the metrics to each sink until the exporter shuts down
+func (sm *serverManager) startSinks(sinks map[string]config.Sink) {
+	for name, settings := range sinks {
+		s, err := newSink(name, settings, sm.gatherer.recent())
+		if err != nil {
+			log.WithFields(log.Fields{"sink": name, "error": err}).Error("Failed to create sink")
+			continue
+		}
+		sm.sinks = append(sm.sinks, s)
+		go s.run(sm.ctx)
+	}
+}
+
+// newServerSettings resolves everything a server's collectors are created from
+func newServerSettings(c config.Config, name string, sc config.Server) serverSettings {
+	sc.Name = name
+	settings := serverSettings{Server: sc, reconcileInterval: c.ServiceHooks.ReconcileInterval.Duration}
+
+	// A server's own proxy takes precedence over the global proxy. With neither, the environment is used
+	settings.proxy = sc.Proxy
+	if settings.proxy.URL == "" && sc.UseProxy {
+		settings.proxy = c.Proxy
+	}
+	return settings
+}
+
+// cancelNew cancels the servers created for a config which won't be applied
+func cancelNew(servers map[string]*server, current map[string]*server) {
+	for name, s := range servers {
+		if current[name] != s {
+			s.cancel()
+		}
+	}
+}
+
+// newServer creates the client for a server and the collectors which use it
+func newServer(ctx context.Context, settings serverSettings) (*server, error) {
+	var ignoreHostedPools = true
+
+	sc := settings.Server
+
+	tlsConfig, err := sc.TLS.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TLS config - %v", err)
+	}
+
+	if settings.proxy.URL != "" {
+		log.WithFields(log.Fields{"server": sc.Name, "serverAddress": sc.Address, "proxyAuth": settings.proxy.Username != ""}).Info("Proxy will be used")
+	}
+
+	proxy, err := proxyFunc(settings.proxy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create proxy - %v", err)
+	}
+
+	transport := &http.Transport{Proxy: proxy, IdleConnTimeout: time.Second * 20, TLSClientConfig: tlsConfig}
+	sc.Client = &http.Client{Transport: wrapTransport(sc.Auth, transport)}
+
+	// Only the proxy is shared with the client which requests Entra ID tokens. The server name and client certificate of the server's TLS settings would fail or leak to Entra ID
+	tokenClient := &http.Client{Transport: &http.Transport{Proxy: proxy, IdleConnTimeout: time.Second * 20}}
+	authenticator, err := newAuthenticator(sc, tokenClient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %v authenticator - %v", sc.Auth.Method, err)
+	}
+	sc.Authenticator = authenticator
+
+	// Created first so the preflight checks' requests are counted too
+	requests := newAPIMetrics()
+	sc.Observer = requests
+
+	s := &server{settings: settings, collectors: []prometheus.Collector{requests}}
+	sc.Context, s.cancel = context.WithCancel(ctx)
+	s.client = sc
+
+	s.agents = newAzDoCollector(sc.AzDoClient, ignoreHostedPools)
+	s.collectors = append(s.collectors, s.agents)
+	log.WithFields(log.Fields{"server": sc.Name, "serverAddress": sc.Address}).Info("Metrics collector created")
+
+	if sc.CollectBuilds {
+		s.collectors = append(s.collectors, newBuildsCollector(sc.AzDoClient))
+		log.WithFields(log.Fields{"server": sc.Name, "serverAddress": sc.Address}).Info("Builds collector created")
+	}
+
+	if sc.CollectReleases {
+		s.collectors = append(s.collectors, newReleasesCollector(sc.AzDoClient))
+		log.WithFields(log.Fields{"server": sc.Name, "serverAddress": sc.Address}).Info("Releases collector created")
+	}
+
+	if sc.CollectPipelineRuns {
+		s.collectors = append(s.collectors, newRunsCollector(sc.AzDoClient))
+		log.WithFields(log.Fields{"server": sc.Name, "serverAddress": sc.Address}).Info("Pipeline runs collector created")
+	}
+
+	if sc.ReceiveServiceHooks {
+		s.hooks = newServiceHookCollector(sc.AzDoClient, settings.reconcileInterval)
+		s.collectors = append(s.collectors, s.hooks)
+		log.WithFields(log.Fields{"server": sc.Name, "serverAddress": sc.Address}).Info("Service hook collector created")
+	}
+
+	return s, nil
+}
+
+// configuredServer returns the server created for a server in the config
+func (sm *serverManager) configuredServer(name string) (*server, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	s, ok := sm.servers[name]
+	return s, ok
+}
+
+// serviceHookCollector returns the service hook collector for a server, if it receives service hooks
+func (sm *serverManager) serviceHookCollector(name string) (*serviceHookCollector, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	s, ok := sm.servers[name]
+	if !ok || s.hooks == nil {
+		return nil, false
+	}
+	return s.hooks, true
+}
+
+// load reads and validates the config file then applies it. The config is only kept if it was applied.
+func (sm *serverManager) load() error {
+	sm.reloadMu.Lock()
+	defer sm.reloadMu.Unlock()
+
+	c, err := config.Load(sm.pathToConfig)
+	if err != nil {
+		return err
+	}
+
+	if err := sm.apply(c); err != nil {
+		return err
+	}
+
+	sm.mu.Lock()
+	sm.config = c
+	sm.loaded = true
+	sm.mu.Unlock()
+	return nil
+}
+
+// reload is load for a config which has already been loaded once. Anything which can't change without a restart is logged.
+func (sm *serverManager) reload() error {
+	previous := sm.currentConfig()
+
+	if err := sm.load(); err != nil {
+		logConfigErrors(sm.pathToConfig, err)
+		log.WithField("path", sm.pathToConfig).Error("Failed to reload config. Keeping the previous config")
+		return err
+	}
+
+	c := sm.currentConfig()
+	if c.Exporter.Port != previous.Exporter.Port || c.Exporter.Endpoint != previous.Exporter.Endpoint || c.Exporter.WebConfigFile != previous.Exporter.WebConfigFile || c.ServiceHooks.Endpoint != previous.ServiceHooks.Endpoint || !reflect.DeepEqual(c.OTLP, previous.OTLP) || c.Push != previous.Push || !reflect.DeepEqual(c.Sinks, previous.Sinks) || c.JobStore != previous.JobStore {
+		log.Warning("Changes to the exporter port, endpoint and web config file path, the service hooks endpoint, or the OTLP, push, sink and job store settings, need a restart")
+	}
+
+	log.WithFields(log.Fields{"path": sm.pathToConfig, "serverCount": len(c.Servers)}).Info("Config reloaded")
+	return nil
+}
+
+func (sm *serverManager) currentConfig() config.Config {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.config
+}
+
+// reloadOnSignal reloads the config whenever the process receives SIGHUP, until the exporter shuts down
+func (sm *serverManager) reloadOnSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-hup:
+			log.Info("Received SIGHUP, reloading config")
+			sm.reload()
+		case <-sm.ctx.Done():
+			return
+		}
+	}
+}
+
+// close cancels the in-flight requests of every server, and waits for their scrapes to finish before flushing OTLP and closing the job store.
+// It gives up waiting once ctx is done. Nothing can be reloaded after it's called.
+func (sm *serverManager) close(ctx context.Context) {
+	closed := make(chan struct{})
+	go func() {
+		sm.closeServers()
+		close(closed)
+	}()
+
+	// A scrape can be stuck on something which isn't cancelled, such as a secret command, and the OTLP exporters have their own timeout
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		log.Warning("Grace period ended before scrapes in progress finished and OTLP was flushed. Exiting without them")
+	}
+}
+
+func (sm *serverManager) closeServers() {
+	sm.reloadMu.Lock()
+	defer sm.reloadMu.Unlock()
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	for name, s := range sm.servers {
+		s.cancel()
+		log.WithField("server", name).Debug("Cancelled requests")
+	}
+	// A scrape in progress returns soon once its requests are cancelled, and may still record the jobs it saw or push what it collected
+	for _, s := range sm.servers {
+		for _, collector := range s.collectors {
+			if scraper, ok := collector.(scraper); ok {
+				scraper.waitForScrape()
+			}
+		}
+	}
+	sm.servers = make(map[string]*server)
+
+	if sm.otlp != nil {
+		sm.otlp.shutdown()
+	}
+	if sm.jobs != nil {
+		sm.jobs.close()
+	}
+}
+
+// ServeHTTP reloads the config on a POST or PUT to /-/reload, the same as Prometheus
+func (sm *serverManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := sm.reload(); err != nil {
+		http.Error(w, "Failed to reload config: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// lifecycleHandler is the reload handler when enabled with --web.enable-lifecycle.
+// Otherwise it responds 403 the same as Prometheus, as anyone who can reach the exporter could reload its config.
+func lifecycleHandler(enabled bool, reload http.Handler) http.Handler {
+	if enabled {
+		return reload
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Lifecycle API is not enabled.", http.StatusForbidden)
+	})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"azdoexporter/azdo"
+	"azdoexporter/config"
+)
+
+// azdoStub is an Azure DevOps server with no pools or projects
+func azdoStub(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"count": 0, "value": []}`)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func reloadConfig(address string, servers ...string) config.Config {
+	c := config.Config{Servers: make(map[string]config.Server)}
+	for _, name := range servers {
+		c.Servers[name] = config.Server{AzDoClient: azdo.AzDoClient{Address: address, AccessToken: "token"}}
+	}
+	return c
+}
+
+// registered is whether a server's collectors are registered
+func registered(sm *serverManager, name string, s *server) bool {
+	reg := prometheus.WrapRegistererWith(prometheus.Labels{"name": name}, sm.reg)
+	for _, collector := range s.collectors {
+		if err := reg.Register(collector); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				return false
+			}
+			continue
+		}
+		reg.Unregister(collector)
+		return false
+	}
+	return true
+}
+
+func TestApplyReloadsChangedServers(t *testing.T) {
+	address := azdoStub(t).URL
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sm := newServerManager(ctx, prometheus.NewRegistry(), "")
+
+	if err := sm.apply(reloadConfig(address, "unchanged", "changed", "removed")); err != nil {
+		t.Fatal(err)
+	}
+	before := make(map[string]*server)
+	for name, s := range sm.servers {
+		before[name] = s
+	}
+
+	c := reloadConfig(address, "unchanged", "changed")
+	changed := c.Servers["changed"]
+	changed.CollectBuilds = true
+	c.Servers["changed"] = changed
+	if err := sm.apply(c); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("unchanged server is kept", func(t *testing.T) {
+		if sm.servers["unchanged"] != before["unchanged"] {
+			t.Error("the server was created again")
+		}
+		if before["unchanged"].client.Context.Err() != nil || !registered(sm, "unchanged", before["unchanged"]) {
+			t.Error("the server's requests were cancelled or its collectors unregistered")
+		}
+	})
+
+	t.Run("changed server is swapped", func(t *testing.T) {
+		s := sm.servers["changed"]
+		if s == before["changed"] || len(s.collectors) != len(before["changed"].collectors)+1 {
+			t.Fatal("the server wasn't created again with the builds collector")
+		}
+		if !registered(sm, "changed", s) {
+			t.Error("the replacement's collectors weren't registered")
+		}
+		if before["changed"].client.Context.Err() == nil {
+			t.Error("the previous server's requests weren't cancelled")
+		}
+	})
+
+	t.Run("removed server is unregistered", func(t *testing.T) {
+		if _, ok := sm.servers["removed"]; ok {
+			t.Fatal("the server is still there")
+		}
+		reg := prometheus.WrapRegistererWith(prometheus.Labels{"name": "removed"}, sm.reg)
+		for _, collector := range before["removed"].collectors {
+			if reg.Unregister(collector) {
+				t.Errorf("%T is still registered", collector)
+			}
+		}
+		if before["removed"].client.Context.Err() == nil {
+			t.Error("the server's requests weren't cancelled")
+		}
+	})
+}
+
+func TestApplyKeepsServerWhoseReplacementFailsToRegister(t *testing.T) {
+	address := azdoStub(t).URL
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sm := newServerManager(ctx, prometheus.NewRegistry(), "")
+	sm.otlp = newOTLPExporter(config.OTLP{Endpoint: "127.0.0.1:4318", Insecure: true, Traces: true, Interval: config.Duration{Duration: time.Hour}}, sm.gatherer)
+	defer sm.otlp.shutdown()
+
+	if err := sm.apply(reloadConfig(address, "s1")); err != nil {
+		t.Fatal(err)
+	}
+	previous := sm.servers["s1"]
+	tracer := previous.agents.tracer
+
+	// Something else already has the builds collector's descriptors for s1, so the replacement can't be registered
+	prometheus.WrapRegistererWith(prometheus.Labels{"name": "s1"}, sm.reg).MustRegister(newBuildsCollector(azdo.AzDoClient{Client: http.DefaultClient, Address: address, AccessToken: "token"}))
+
+	c := reloadConfig(address, "s1")
+	s1 := c.Servers["s1"]
+	s1.CollectBuilds = true
+	c.Servers["s1"] = s1
+	if err := sm.apply(c); err != nil {
+		t.Fatal(err)
+	}
+
+	if sm.servers["s1"] != previous {
+		t.Fatal("the previous server wasn't kept")
+	}
+	if previous.client.Context.Err() != nil {
+		t.Error("the previous server's requests were cancelled")
+	}
+	if !registered(sm, "s1", previous) {
+		t.Error("the previous server's collectors weren't registered again")
+	}
+	if previous.agents.tracer != tracer {
+		t.Error("the previous server's tracer was replaced while it may be scraping")
+	}
+	if _, ok := sm.otlp.providers["s1"]; !ok {
+		t.Error("the previous server stopped pushing with OTLP")
+	}
+}
+
+// scrapingServer is a server with every collector which scrapes, each holding its lock as if it were scraping
+func scrapingServer(t *testing.T, sm *serverManager) []*sync.Mutex {
+	c := reloadConfig(azdoStub(t).URL, "s1")
+	s1 := c.Servers["s1"]
+	s1.CollectBuilds, s1.CollectReleases, s1.CollectPipelineRuns = true, true, true
+	c.Servers["s1"] = s1
+	if err := sm.apply(c); err != nil {
+		t.Fatal(err)
+	}
+
+	var scraping []*sync.Mutex
+	for _, collector := range sm.servers["s1"].collectors {
+		switch collector := collector.(type) {
+		case *azDoCollector:
+			scraping = append(scraping, &collector.collectMu)
+		case *buildsCollector:
+			scraping = append(scraping, &collector.collectMu)
+		case *releasesCollector:
+			scraping = append(scraping, &collector.collectMu)
+		case *runsCollector:
+			scraping = append(scraping, &collector.collectMu)
+		}
+	}
+	if len(scraping) != 4 {
+		t.Fatalf("got %v collectors which scrape, want 4", len(scraping))
+	}
+	for _, mu := range scraping {
+		mu.Lock()
+	}
+	return scraping
+}
+
+func TestCloseWaitsForEveryScrape(t *testing.T) {
+	sm := newServerManager(context.Background(), prometheus.NewRegistry(), "")
+	scraping := scrapingServer(t, sm)
+
+	closed := make(chan struct{})
+	go func() {
+		sm.close(context.Background())
+		close(closed)
+	}()
+
+	for _, mu := range scraping {
+		select {
+		case <-closed:
+			t.Fatal("closed while a scrape was in progress")
+		case <-time.After(20 * time.Millisecond):
+		}
+		mu.Unlock()
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("didn't close once the scrapes finished")
+	}
+}
+
+func TestCloseGivesUpWhenTheGracePeriodEnds(t *testing.T) {
+	sm := newServerManager(context.Background(), prometheus.NewRegistry(), "")
+	scraping := scrapingServer(t, sm)
+	defer func() {
+		for _, mu := range scraping {
+			mu.Unlock()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	sm.close(ctx)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("closed after %v, want once the grace period ended", elapsed)
+	}
+}
+
+func TestLifecycleHandler(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprint(enabled), func(t *testing.T) {
+			reloaded := false
+			handler := lifecycleHandler(enabled, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reloaded = true }))
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+
+			if reloaded != enabled {
+				t.Errorf("got reloaded %v, want %v", reloaded, enabled)
+			}
+			if !enabled && w.Code != http.StatusForbidden {
+				t.Errorf("got status %v, want %v", w.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"azdoexporter/azdo"
+)
+
+// serviceHookCollector keeps track of jobs and runs from service hook events so queues can be seen as they change rather than on each scrape.
+// Events can be missed, e.g. while the exporter restarts, so run reconciles the state against the jobrequests and builds APIs every reconcileInterval.
+type serviceHookCollector struct {
+	AzDoClient        *azdo.AzDoClient
+	reconcileInterval time.Duration
+
+	mu            sync.Mutex
+	jobs          map[string]*hookJob  // Queued and running jobs keyed by job ID
+	runs          map[int]*hookRun     // In progress runs keyed by run ID
+	completedJobs map[string]time.Time // Jobs completed by an event, with when it was received, so neither a later event nor a reconcile adds them back
+	completedRuns map[int]time.Time    // Likewise for runs
+
+	events          *prometheus.CounterVec
+	jobQueueTimes   *prometheus.HistogramVec
+	jobRunningTimes *prometheus.HistogramVec
+	runTimes        *prometheus.HistogramVec
+}
+
+type hookJob struct {
+	pipeline   string
+	running    bool
+	queueTime  time.Time
+	startTime  time.Time
+	lastUpdate time.Time
+}
+
+type hookRun struct {
+	pipeline   string
+	lastUpdate time.Time
+}
+
+func newServiceHookCollector(az azdo.AzDoClient, reconcileInterval time.Duration) *serviceHookCollector {
+	return &serviceHookCollector{
+		AzDoClient:        &az,
+		reconcileInterval: reconcileInterval,
+		jobs:              make(map[string]*hookJob),
+		runs:              make(map[int]*hookRun),
+		completedJobs:     make(map[string]time.Time),
+		completedRuns:     make(map[int]time.Time),
+
+		events: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tfs_hook_events_total",
+			Help: "Total of service hook events received",
+		}, []string{"type"}),
+
+		jobQueueTimes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "tfs_hook_job_queue_length_secs",
+			Help:    "Length of the time a job spent queued, from service hook events",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 10), // Same as tfs_pool_job_queue_length_secs
+		}, []string{"pipeline"}),
+
+		jobRunningTimes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "tfs_hook_job_running_length_secs",
+			Help:    "Length of time a job spent running, from service hook events",
+			Buckets: calculateBuckets(),
+		}, []string{"pipeline"}),
+
+		runTimes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "tfs_hook_run_length_secs",
+			Help:    "Total length of a pipeline run, from service hook events",
+			Buckets: calculateBuckets(),
+		}, []string{"pipeline"}),
+	}
+}
+
+func (sc *serviceHookCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- hookJobsDesc
+	ch <- hookRunsDesc
+	sc.events.Describe(ch)
+	sc.jobQueueTimes.Describe(ch)
+	sc.jobRunningTimes.Describe(ch)
+	sc.runTimes.Describe(ch)
+}
+
+// Collect only reports the state kept from the events, so a scrape never waits on Azure DevOps
+func (sc *serviceHookCollector) Collect(publishMetrics chan<- prometheus.Metric) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for _, metric := range calculateHookMetrics(sc.jobs, sc.runs) {
+		publishMetrics <- metric
+	}
+
+	sc.events.Collect(publishMetrics)
+	sc.jobQueueTimes.Collect(publishMetrics)
+	sc.jobRunningTimes.Collect(publishMetrics)
+	sc.runTimes.Collect(publishMetrics)
+}
+
+// errNoJobID is returned for a job event without the job's ID, which can't be matched to the job's other events
+var errNoJobID = errors.New("job state changed event has no job ID")
+
+// handleEvent updates the jobs and runs from a service hook event
+func (sc *serviceHookCollector) handleEvent(event azdo.ServiceHookEvent) error {
+	if event.EventType == azdo.JobStateChangedEvent && event.Resource.Job.ID == "" {
+		return errNoJobID
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	received := time.Now()
+	if event.CreatedDate.IsZero() {
+		event.CreatedDate = received
+	}
+
+	switch event.EventType {
+	case azdo.JobStateChangedEvent:
+		sc.events.WithLabelValues(event.EventType).Inc()
+		sc.handleJobEvent(event, received)
+	case azdo.RunStateChangedEvent:
+		sc.events.WithLabelValues(event.EventType).Inc()
+		sc.handleRunEvent(event, received)
+	default:
+		// The type comes from the request, so only those handled are labels of their own
+		sc.events.WithLabelValues("other").Inc()
+		log.WithFields(log.Fields{"serverName": sc.AzDoClient.Name, "eventType": event.EventType}).Debug("Ignoring service hook event")
+	}
+	return nil
+}
+
+func (sc *serviceHookCollector) handleJobEvent(event azdo.ServiceHookEvent, received time.Time) {
+	hj := event.Resource.Job
+	pipeline := event.Resource.Pipeline.Name
+
+	// Events can arrive out of order, so one received after the job completed is stale
+	if _, completed := sc.completedJobs[hj.ID]; completed && hj.State != "completed" {
+		log.WithFields(log.Fields{"serverName": sc.AzDoClient.Name, "pipeline": pipeline, "jobId": hj.ID, "state": hj.State}).Debug("Ignoring job event received after the job completed")
+		return
+	}
+
+	job, ok := sc.jobs[hj.ID]
+	if !ok {
+		job = &hookJob{pipeline: pipeline, queueTime: event.CreatedDate}
+		sc.jobs[hj.ID] = job
+	}
+	job.lastUpdate = received
+
+	switch hj.State {
+	case "running":
+		if !job.running {
+			job.running = true
+			job.startTime = firstNonZero(hj.StartTime, event.CreatedDate)
+			if ok { // Only known if the waiting event was received
+				sc.jobQueueTimes.WithLabelValues(pipeline).Observe(job.startTime.Sub(job.queueTime).Seconds())
+			}
+		}
+	case "completed":
+		if job.running {
+			finishTime := firstNonZero(hj.FinishTime, event.CreatedDate)
+			sc.jobRunningTimes.WithLabelValues(pipeline).Observe(finishTime.Sub(job.startTime).Seconds())
+		}
+		delete(sc.jobs, hj.ID)
+		sc.completedJobs[hj.ID] = received
+	}
+
+	log.WithFields(log.Fields{"serverName": sc.AzDoClient.Name, "pipeline": pipeline, "jobId": hj.ID, "state": hj.State}).Debug("Job state changed")
+}
+
+func (sc *serviceHookCollector) handleRunEvent(event azdo.ServiceHookEvent, received time.Time) {
+	run := event.Resource.Run
+	pipeline := event.Resource.Pipeline.Name
+
+	switch run.State {
+	case "completed":
+		if !run.CreatedDate.IsZero() {
+			finishTime := firstNonZero(run.FinishedDate, event.CreatedDate)
+			sc.runTimes.WithLabelValues(pipeline).Observe(finishTime.Sub(run.CreatedDate).Seconds())
+		}
+		delete(sc.runs, run.ID)
+		sc.completedRuns[run.ID] = received
+	default:
+		if _, completed := sc.completedRuns[run.ID]; completed {
+			log.WithFields(log.Fields{"serverName": sc.AzDoClient.Name, "pipeline": pipeline, "runId": run.ID, "state": run.State}).Debug("Ignoring run event received after the run completed")
+			return
+		}
+		sc.runs[run.ID] = &hookRun{pipeline: pipeline, lastUpdate: received}
+	}
+
+	log.WithFields(log.Fields{"serverName": sc.AzDoClient.Name, "pipeline": pipeline, "runId": run.ID, "state": run.State}).Debug("Run state changed")
+}
+
+// run reconciles the state now and then every reconcile interval, until ctx is cancelled when the server is removed or the exporter shuts down
+func (sc *serviceHookCollector) run(ctx context.Context) {
+	ticker := time.NewTicker(sc.reconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		sc.reconcile()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reconcile polls the jobrequests and builds APIs to remove jobs and runs whose completed events were missed, and add those whose earlier events were missed.
+// Anything updated by an event while polling, or completed by one, is left alone as the event is newer.
+func (sc *serviceHookCollector) reconcile() {
+	start := time.Now()
+
+	// What's forgotten by age doesn't need the APIs, so the state doesn't grow while they fail
+	sc.forget(start)
+
+	pools, err := sc.AzDoClient.Pools(false)
+	if err != nil {
+		log.WithFields(log.Fields{"serverName": sc.AzDoClient.Name, "error": err}).Error("Reconcile failed. Could not retrieve pools.")
+		return
+	}
+
+	jobs, errOccurred := scrapeCurrentJobs(sc.AzDoClient, pools)
+	if errOccurred {
+		log.WithFields(log.Fields{"serverName": sc.AzDoClient.Name}).Error("Reconcile failed. Could not retrieve current jobs.")
+		return
+	}
+
+	projects, err := sc.AzDoClient.Projects()
+	if err != nil {
+		log.WithFields(log.Fields{"serverName": sc.AzDoClient.Name, "error": err}).Error("Reconcile failed. Could not retrieve projects.")
+		return
+	}
+
+	// Every project's builds are needed, as a run missing from them is removed
+	builds, failedProjects := scrapeActiveBuilds(sc.AzDoClient, projects)
+	if failedProjects > 0 {
+		log.WithFields(log.Fields{"serverName": sc.AzDoClient.Name}).Error("Reconcile failed. Could not retrieve active builds.")
+		return
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	activeJobs := make(map[string]bool)
+	for _, job := range jobs {
+		if job.PlanType != "Build" {
+			continue
+		}
+		activeJobs[job.JobID] = true
+
+		if _, completed := sc.completedJobs[job.JobID]; completed {
+			continue
+		}
+		if existing, ok := sc.jobs[job.JobID]; ok {
+			existing.lastUpdate = latest(existing.lastUpdate, start)
+		} else {
+			sc.jobs[job.JobID] = &hookJob{
+				pipeline:   job.Definition.Name,
+				running:    !job.AssignTime.IsZero(),
+				queueTime:  job.QueueTime,
+				startTime:  job.AssignTime,
+				lastUpdate: start,
+			}
+		}
+	}
+
+	for id, job := range sc.jobs {
+		if !activeJobs[id] && job.lastUpdate.Before(start) {
+			delete(sc.jobs, id)
+		}
+	}
+
+	activeRuns := make(map[int]bool)
+	for _, build := range builds {
+		activeRuns[build.ID] = true
+
+		if _, completed := sc.completedRuns[build.ID]; completed {
+			continue
+		}
+		if existing, ok := sc.runs[build.ID]; ok {
+			existing.lastUpdate = latest(existing.lastUpdate, start)
+		} else {
+			sc.runs[build.ID] = &hookRun{pipeline: build.Definition.Name, lastUpdate: start}
+		}
+	}
+
+	for id, run := range sc.runs {
+		if !activeRuns[id] && run.lastUpdate.Before(start) {
+			delete(sc.runs, id)
+		}
+	}
+
+	log.WithFields(log.Fields{"serverName": sc.AzDoClient.Name, "jobCount": len(sc.jobs), "runCount": len(sc.runs)}).Debug("Reconciled service hook state")
+}
+
+// staleReconciles is how many reconcile intervals a job or run is kept without an event or a reconcile to say it's still active
+const staleReconciles = 3
+
+// forget removes what completed more than a reconcile interval ago, and the jobs and runs which have gone stale
+func (sc *serviceHookCollector) forget(now time.Time) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	// What completed is kept for a reconcile interval, so events which arrive late are ignored, then forgotten.
+	// By then the APIs no longer return it, and a late event adds it back only until the next reconcile.
+	completedBefore := now.Add(-sc.reconcileInterval)
+	for id, completed := range sc.completedJobs {
+		if completed.Before(completedBefore) {
+			delete(sc.completedJobs, id)
+		}
+	}
+	for id, completed := range sc.completedRuns {
+		if completed.Before(completedBefore) {
+			delete(sc.completedRuns, id)
+		}
+	}
+
+	// A reconcile which succeeds removes whatever the APIs no longer return, but while they fail the jobs and runs
+	// whose completed events were missed would be kept forever, so those neither updated nor reconciled for a while are dropped
+	staleBefore := now.Add(-staleReconciles * sc.reconcileInterval)
+	for id, job := range sc.jobs {
+		if job.lastUpdate.Before(staleBefore) {
+			delete(sc.jobs, id)
+		}
+	}
+	for id, run := range sc.runs {
+		if run.lastUpdate.Before(staleBefore) {
+			delete(sc.runs, id)
+		}
+	}
+}
+
+// latest returns the later of two times
+func latest(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func firstNonZero(times ...time.Time) time.Time {
+	for _, t := range times {
+		if !t.IsZero() {
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"azdoexporter/azdo"
+	"azdoexporter/config"
+)
+
+const maxServiceHookBodyBytes = 1 << 20
+
+// serviceHookHandler receives service hook events at <endpoint>/<server name> and passes them to that server's serviceHookCollector.
+// Requests must have either the basic auth credentials or the shared secret header set on the subscription.
+// The credentials and collectors are looked up on each request so they follow config reloads.
+type serviceHookHandler struct {
+	endpoint string
+	servers  *serverManager
+}
+
+func newServiceHookHandler(endpoint string, servers *serverManager) *serviceHookHandler {
+	return &serviceHookHandler{endpoint: endpoint, servers: servers}
+}
+
+func (h *serviceHookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.authorised(r, h.servers.currentConfig().ServiceHooks) {
+		log.WithFields(log.Fields{"path": r.URL.Path, "remoteAddr": r.RemoteAddr}).Warning("Rejected unauthorised service hook request")
+		w.Header().Set("WWW-Authenticate", `Basic realm="service hooks"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, h.endpoint), "/")
+	collector, ok := h.servers.serviceHookCollector(name)
+	if !ok {
+		http.Error(w, "Unknown server "+name, http.StatusNotFound)
+		return
+	}
+
+	var event azdo.ServiceHookEvent
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxServiceHookBodyBytes)).Decode(&event); err != nil {
+		log.WithFields(log.Fields{"serverName": name, "error": err}).Warning("Failed to decode service hook event")
+		http.Error(w, "Could not decode event", http.StatusBadRequest)
+		return
+	}
+
+	if err := collector.handleEvent(event); err != nil {
+		log.WithFields(log.Fields{"serverName": name, "error": err}).Warning("Rejected service hook event")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *serviceHookHandler) authorised(r *http.Request, c config.ServiceHooks) bool {
+	if c.Secret != "" {
+		if secret := r.Header.Get(c.SecretHeader); secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(c.Secret)) == 1 {
+			return true
+		}
+	}
+
+	if c.Username != "" {
+		if username, password, ok := r.BasicAuth(); ok &&
+			subtle.ConstantTimeCompare([]byte(username), []byte(c.Username)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(c.Password)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+
+	"azdoexporter/azdo"
+	"azdoexporter/config"
+)
+
+// hookServers has a server s1 receiving service hooks and a server s2 which doesn't
+func hookServers(t *testing.T) (*serverManager, *serviceHookCollector) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	sm := newServerManager(ctx, prometheus.NewRegistry(), "")
+	sm.config = config.Config{ServiceHooks: config.ServiceHooks{
+		Endpoint:     "/hooks",
+		Secret:       "shared secret",
+		SecretHeader: "X-AzDoExporter-Secret",
+		Username:     "azdo",
+		Password:     "password",
+	}}
+
+	hooks := newServiceHookCollector(azdo.AzDoClient{Name: "s1"}, time.Minute)
+	sm.servers["s1"] = &server{hooks: hooks}
+	sm.servers["s2"] = &server{}
+	return sm, hooks
+}
+
+func jobEvent(state string, time string) string {
+	return `{
+		"id": "event",
+		"eventType": "ms.vss-pipelines.job-state-changed-event",
+		"createdDate": "` + time + `",
+		"resource": {
+			"job": {"id": "job1", "name": "Build", "state": "` + state + `"},
+			"pipeline": {"id": 3, "name": "ci"},
+			"runId": 7
+		}
+	}`
+}
+
+func histogramOf(t *testing.T, vec *prometheus.HistogramVec, labelValues ...string) *dto.Histogram {
+	var m dto.Metric
+	if err := vec.WithLabelValues(labelValues...).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram()
+}
+
+func TestServiceHookHandlerAuthorisesAndRoutes(t *testing.T) {
+	sm, _ := hookServers(t)
+	handler := newServiceHookHandler("/hooks", sm)
+	event := jobEvent("waiting", "2026-01-01T12:00:00Z")
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		setAuth  func(r *http.Request)
+		wantCode int
+	}{
+		{
+			name:     "shared secret",
+			method:   http.MethodPost,
+			path:     "/hooks/s1",
+			body:     event,
+			setAuth:  func(r *http.Request) { r.Header.Set("X-AzDoExporter-Secret", "shared secret") },
+			wantCode: http.StatusNoContent,
+		},
+		{
+			name:     "basic auth",
+			method:   http.MethodPost,
+			path:     "/hooks/s1/",
+			body:     event,
+			setAuth:  func(r *http.Request) { r.SetBasicAuth("azdo", "password") },
+			wantCode: http.StatusNoContent,
+		},
+		{
+			name:     "wrong secret",
+			method:   http.MethodPost,
+			path:     "/hooks/s1",
+			body:     event,
+			setAuth:  func(r *http.Request) { r.Header.Set("X-AzDoExporter-Secret", "guess") },
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "wrong password",
+			method:   http.MethodPost,
+			path:     "/hooks/s1",
+			body:     event,
+			setAuth:  func(r *http.Request) { r.SetBasicAuth("azdo", "guess") },
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "no credentials",
+			method:   http.MethodPost,
+			path:     "/hooks/s1",
+			body:     event,
+			setAuth:  func(r *http.Request) {},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "unknown server",
+			method:   http.MethodPost,
+			path:     "/hooks/s3",
+			body:     event,
+			setAuth:  func(r *http.Request) { r.Header.Set("X-AzDoExporter-Secret", "shared secret") },
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "server which doesn't receive service hooks",
+			method:   http.MethodPost,
+			path:     "/hooks/s2",
+			body:     event,
+			setAuth:  func(r *http.Request) { r.Header.Set("X-AzDoExporter-Secret", "shared secret") },
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "invalid event",
+			method:   http.MethodPost,
+			path:     "/hooks/s1",
+			body:     "{",
+			setAuth:  func(r *http.Request) { r.Header.Set("X-AzDoExporter-Secret", "shared secret") },
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "not a post",
+			method:   http.MethodGet,
+			path:     "/hooks/s1",
+			setAuth:  func(r *http.Request) { r.Header.Set("X-AzDoExporter-Secret", "shared secret") },
+			wantCode: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+			test.setAuth(r)
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.wantCode {
+				t.Errorf("got status %v, want %v", w.Code, test.wantCode)
+			}
+		})
+	}
+}
+
+func TestServiceHookHandlerParsesEvents(t *testing.T) {
+	sm, hooks := hookServers(t)
+	handler := newServiceHookHandler("/hooks", sm)
+
+	send := func(event string) {
+		r := httptest.NewRequest(http.MethodPost, "/hooks/s1", strings.NewReader(event))
+		r.Header.Set("X-AzDoExporter-Secret", "shared secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("got status %v for event %v", w.Code, event)
+		}
+	}
+
+	send(jobEvent("waiting", "2026-01-01T12:00:00Z"))
+	send(jobEvent("running", "2026-01-01T12:00:40Z"))
+
+	hooks.mu.Lock()
+	job, ok := hooks.jobs["job1"]
+	if !ok || !job.running || job.pipeline != "ci" {
+		t.Errorf("got job %+v, want job1 of ci running", job)
+	}
+	hooks.mu.Unlock()
+
+	send(jobEvent("completed", "2026-01-01T12:01:40Z"))
+	send(`{
+		"eventType": "ms.vss-pipelines.run-state-changed-event",
+		"createdDate": "2026-01-01T12:02:00Z",
+		"resource": {
+			"run": {"id": 7, "state": "completed", "result": "succeeded", "createdDate": "2026-01-01T11:59:00Z", "finishedDate": "2026-01-01T12:01:50Z"},
+			"pipeline": {"id": 3, "name": "ci"}
+		}
+	}`)
+
+	if h := histogramOf(t, hooks.jobQueueTimes, "ci"); h.GetSampleCount() != 1 || h.GetSampleSum() != 40 {
+		t.Errorf("queued %v times for %v seconds, want once for 40", h.GetSampleCount(), h.GetSampleSum())
+	}
+	if h := histogramOf(t, hooks.jobRunningTimes, "ci"); h.GetSampleCount() != 1 || h.GetSampleSum() != 60 {
+		t.Errorf("ran %v times for %v seconds, want once for 60", h.GetSampleCount(), h.GetSampleSum())
+	}
+	if h := histogramOf(t, hooks.runTimes, "ci"); h.GetSampleCount() != 1 || h.GetSampleSum() != 170 {
+		t.Errorf("run took %v times for %v seconds, want once for 170", h.GetSampleCount(), h.GetSampleSum())
+	}
+
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	if len(hooks.jobs) != 0 || len(hooks.runs) != 0 {
+		t.Errorf("got %v jobs and %v runs in progress, want the completed ones removed", len(hooks.jobs), len(hooks.runs))
+	}
+}
+
+func TestServiceHookHandlerIgnoresEventsReceivedAfterCompleted(t *testing.T) {
+	sm, hooks := hookServers(t)
+	handler := newServiceHookHandler("/hooks", sm)
+
+	send := func(event string) {
+		r := httptest.NewRequest(http.MethodPost, "/hooks/s1", strings.NewReader(event))
+		r.Header.Set("X-AzDoExporter-Secret", "shared secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("got status %v for event %v", w.Code, event)
+		}
+	}
+	runEvent := func(state string) string {
+		return `{
+			"eventType": "ms.vss-pipelines.run-state-changed-event",
+			"resource": {"run": {"id": 7, "state": "` + state + `"}, "pipeline": {"id": 3, "name": "ci"}}
+		}`
+	}
+
+	// The hooks' deliveries can overtake each other, so the completed events arrive first
+	send(jobEvent("completed", "2026-01-01T12:01:40Z"))
+	send(jobEvent("running", "2026-01-01T12:00:40Z"))
+	send(jobEvent("waiting", "2026-01-01T12:00:00Z"))
+	send(runEvent("completed"))
+	send(runEvent("inProgress"))
+
+	hooks.mu.Lock()
+	if len(hooks.jobs) != 0 || len(hooks.runs) != 0 {
+		t.Errorf("got jobs %v and runs %v, want the completed ones left out", hooks.jobs, hooks.runs)
+	}
+	hooks.mu.Unlock()
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(hooks)
+	scraped := gatherMetrics(t, reg)
+	if jobs, runs := scraped["tfs_hook_jobs"], scraped["tfs_hook_runs_in_progress"]; len(jobs) != 0 || len(runs) != 0 {
+		t.Errorf("got jobs %v and runs %v, want none queued, running or in progress", jobs, runs)
+	}
+	if h := histogramOf(t, hooks.jobQueueTimes, "ci"); h.GetSampleCount() != 0 {
+		t.Errorf("queued %v times, want the late events not observed", h.GetSampleCount())
+	}
+}
+
+func TestServiceHookCollectDoesNotReconcile(t *testing.T) {
+	azdoServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("a scrape requested %v", r.URL)
+	}))
+	defer azdoServer.Close()
+
+	hooks := newServiceHookCollector(azdo.AzDoClient{Client: azdoServer.Client(), Name: "s1", Address: azdoServer.URL, AccessToken: "token"}, time.Minute)
+	// Reconciling is left to run, so a scrape makes no requests
+	testutil.CollectAndCount(hooks)
+}
+
+func TestServiceHookHandlerRejectsJobEventsWithoutAnID(t *testing.T) {
+	sm, hooks := hookServers(t)
+	handler := newServiceHookHandler("/hooks", sm)
+
+	tests := []struct {
+		name     string
+		event    string
+		wantCode int
+		wantType string
+	}{
+		{name: "job without an ID", event: strings.Replace(jobEvent("waiting", "2026-01-01T12:00:00Z"), `"id": "job1"`, `"id": ""`, 1), wantCode: http.StatusBadRequest},
+		{name: "job", event: jobEvent("waiting", "2026-01-01T12:00:00Z"), wantCode: http.StatusNoContent, wantType: azdo.JobStateChangedEvent},
+		{name: "unhandled type", event: `{"eventType": "git.push", "resource": {}}`, wantCode: http.StatusNoContent, wantType: "other"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/hooks/s1", strings.NewReader(test.event))
+			r.Header.Set("X-AzDoExporter-Secret", "shared secret")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.wantCode {
+				t.Fatalf("got status %v, want %v", w.Code, test.wantCode)
+			}
+			if test.wantType != "" && testutil.ToFloat64(hooks.events.WithLabelValues(test.wantType)) != 1 {
+				t.Errorf("the event wasn't counted as %v", test.wantType)
+			}
+		})
+	}
+
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	if _, ok := hooks.jobs[""]; ok || len(hooks.jobs) != 1 {
+		t.Errorf("got jobs %v, want only job1", hooks.jobs)
+	}
+	if n := testutil.CollectAndCount(hooks.events); n != 2 {
+		t.Errorf("got %v event types, want the job's and other", n)
+	}
+}
+
+func TestReconcileDoesNotAddBackWhatCompletedWhilePolling(t *testing.T) {
+	var hooks *serviceHookCollector
+	azdoServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_apis/distributedtask/pools":
+			fmt.Fprint(w, `{"count": 1, "value": [{"id": 1, "name": "Default"}]}`)
+		case "/_apis/distributedtask/pools/1/jobrequests/":
+			// The job and run complete while the reconcile polls, but it's given them as they were before
+			hooks.handleEvent(azdo.ServiceHookEvent{EventType: azdo.JobStateChangedEvent, Resource: azdo.ServiceHookResource{Job: azdo.ServiceHookJob{ID: "job1", State: "completed"}}})
+			hooks.handleEvent(azdo.ServiceHookEvent{EventType: azdo.RunStateChangedEvent, Resource: azdo.ServiceHookResource{Run: azdo.Run{ID: 7, State: "completed"}}})
+			fmt.Fprint(w, `{"count": 2, "value": [{"requestId": 1, "jobId": "job1", "planType": "Build", "definition": {"name": "ci"}},
+				{"requestId": 2, "jobId": "job2", "planType": "Build", "definition": {"name": "ci"}}]}`)
+		case "/_apis/projects":
+			fmt.Fprint(w, `{"count": 1, "value": [{"id": "p1", "name": "project"}]}`)
+		case "/p1/_apis/build/builds":
+			fmt.Fprint(w, `{"count": 2, "value": [{"id": 7, "definition": {"name": "ci"}}, {"id": 8, "definition": {"name": "ci"}}]}`)
+		default:
+			t.Errorf("unexpected request to %v", r.URL)
+			http.NotFound(w, r)
+		}
+	}))
+	defer azdoServer.Close()
+
+	hooks = newServiceHookCollector(azdo.AzDoClient{Client: azdoServer.Client(), Name: "s1", Address: azdoServer.URL, AccessToken: "token"}, time.Minute)
+	hooks.reconcile()
+
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	if _, ok := hooks.jobs["job1"]; ok || len(hooks.jobs) != 1 {
+		t.Errorf("got jobs %v, want only job2 as job1 completed while polling", hooks.jobs)
+	}
+	if _, ok := hooks.runs[7]; ok || len(hooks.runs) != 1 {
+		t.Errorf("got runs %v, want only run 8 as run 7 completed while polling", hooks.runs)
+	}
+}
+
+func TestReconcileForgetsOldStateWhenTheAPIFails(t *testing.T) {
+	azdoServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer azdoServer.Close()
+
+	hooks := newServiceHookCollector(azdo.AzDoClient{Client: azdoServer.Client(), Name: "s1", Address: azdoServer.URL, AccessToken: "token"}, time.Minute)
+	now := time.Now()
+	hooks.completedJobs["old"] = now.Add(-2 * time.Minute)
+	hooks.completedJobs["recent"] = now
+	hooks.completedRuns[1] = now.Add(-2 * time.Minute)
+	hooks.jobs["stale"] = &hookJob{pipeline: "ci", lastUpdate: now.Add(-4 * time.Minute)}
+	hooks.jobs["updated"] = &hookJob{pipeline: "ci", lastUpdate: now.Add(-2 * time.Minute)}
+	hooks.runs[2] = &hookRun{pipeline: "ci", lastUpdate: now.Add(-4 * time.Minute)}
+
+	hooks.reconcile()
+
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	if _, ok := hooks.completedJobs["recent"]; !ok || len(hooks.completedJobs) != 1 {
+		t.Errorf("got completed jobs %v, want only the one completed within the reconcile interval", hooks.completedJobs)
+	}
+	if len(hooks.completedRuns) != 0 {
+		t.Errorf("got completed runs %v, want none", hooks.completedRuns)
+	}
+	if _, ok := hooks.jobs["updated"]; !ok || len(hooks.jobs) != 1 {
+		t.Errorf("got jobs %v, want only the one updated within %v reconcile intervals", hooks.jobs, staleReconciles)
+	}
+	if len(hooks.runs) != 0 {
+		t.Errorf("got runs %v, want the stale run dropped", hooks.runs)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+
+	"azdoexporter/azdo"
+	"azdoexporter/config"
+)
+
+// Lines sent over UDP are split into packets of at most this size, so they aren't fragmented on a typical network
+const maxUDPPacketSize = 1432
+
+// sinkFormat formats metrics for a system other than Prometheus, one line per metric
+type sinkFormat interface {
+	formatMetrics(families []*dto.MetricFamily, now time.Time) []string
+	formatJobs(server string, pool azdo.Pool, jobs []azdo.Job) []string
+}
+
+// sink periodically gathers the metrics and sends them in its format, along with observations of the jobs which finished since
+type sink struct {
+	name     string
+	settings config.Sink
+	format   sinkFormat
+	write    func(ctx context.Context, lines []string) error
+	gatherer prometheus.Gatherer
+
+	mu   sync.Mutex
+	jobs []string // Formatted jobs waiting for the next send
+}
+
+func newSink(name string, settings config.Sink, gatherer prometheus.Gatherer) (*sink, error) {
+	s := &sink{name: name, settings: settings, gatherer: gatherer}
+
+	switch settings.Format {
+	case config.SinkFormatDogStatsD:
+		s.format = newDogStatsDFormat(settings)
+	case config.SinkFormatInflux:
+		s.format = newInfluxFormat(settings)
+	default:
+		return nil, fmt.Errorf("unknown format %v", settings.Format)
+	}
+
+	u, err := url.Parse(settings.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "udp" {
+		conn, err := net.Dial("udp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		s.write = func(_ context.Context, lines []string) error {
+			return writeUDP(conn, lines)
+		}
+	} else {
+		client := &http.Client{Timeout: settings.Interval.Duration}
+		s.write = func(ctx context.Context, lines []string) error {
+			return writeHTTP(ctx, client, settings, lines)
+		}
+	}
+
+	return s, nil
+}
+
+// observeJobs formats the jobs which finished on a pool to be sent with the next metrics
+func (s *sink) observeJobs(server string, pool azdo.Pool, jobs []azdo.Job) {
+	lines := s.format.formatJobs(server, pool, jobs)
+
+	s.mu.Lock()
+	s.jobs = append(s.jobs, lines...)
+	s.mu.Unlock()
+}
+
+// run sends the metrics every interval until ctx is cancelled
+func (s *sink) run(ctx context.Context) {
+	log.WithFields(log.Fields{"sink": s.name, "format": s.settings.Format, "url": s.settings.URL, "interval": s.settings.Interval.Duration}).Info("Sending metrics to sink")
+
+	ticker := time.NewTicker(s.settings.Interval.Duration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.send(ctx); err != nil && ctx.Err() == nil {
+				log.WithFields(log.Fields{"sink": s.name, "url": s.settings.URL, "error": err}).Error("Failed to send metrics to sink")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *sink) send(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s.settings.Interval.Duration)
+	defer cancel()
+
+	// A recent scrape is reused if there was one. The jobs which finished before it were observed for this send or an earlier one
+	families, err := s.gatherer.Gather()
+	if err != nil {
+		log.WithFields(log.Fields{"sink": s.name, "error": err}).Warning("Errors gathering metrics to send to sink")
+	}
+	lines := s.format.formatMetrics(families, time.Now())
+
+	s.mu.Lock()
+	lines = append(lines, s.jobs...)
+	s.jobs = nil
+	s.mu.Unlock()
+
+	if len(lines) == 0 {
+		return nil
+	}
+	return s.write(ctx, lines)
+}
+
+// writeUDP sends the lines in as few packets as possible. A line longer than a packet is sent on its own
+func writeUDP(conn net.Conn, lines []string) error {
+	var packet bytes.Buffer
+	flush := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := conn.Write(packet.Bytes())
+		packet.Reset()
+		return err
+	}
+
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxUDPPacketSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	return flush()
+}
+
+// writeHTTP posts the lines to InfluxDB's write API
+func writeHTTP(ctx context.Context, client *http.Client, settings config.Sink, lines []string) error {
+	req, err := http.NewRequest("POST", settings.URL, strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if settings.Token != "" {
+		req.Header.Set("Authorization", "Token "+settings.Token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("write to %v returned %v - %s", settings.URL, resp.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// jobDurations are the same durations the job histograms observe. queue and running are only set once an agent received the job
+func jobDurations(job azdo.Job) (total, queue, running time.Duration, received bool) {
+	total = job.FinishTime.Sub(job.QueueTime)
+	if job.ReceiveTime.IsZero() {
+		return total, 0, 0, false
+	}
+	return total, job.ReceiveTime.Sub(job.QueueTime), job.FinishTime.Sub(job.ReceiveTime), true
+}
+
+// sinkTag is a label or tag of a metric sent to a sink
+type sinkTag struct {
+	name  string
+	value string
+}
+
+// sortedTags merges the labels of a metric with the sink's tags, sorted by name. A label wins over a tag of the same name
+func sortedTags(labels []*dto.LabelPair, tags map[string]string) []sinkTag {
+	merged := make(map[string]string, len(labels)+len(tags))
+	for name, value := range tags {
+		merged[name] = value
+	}
+	for _, l := range labels {
+		merged[l.GetName()] = l.GetValue()
+	}
+
+	sorted := make([]sinkTag, 0, len(merged))
+	for name, value := range merged {
+		sorted = append(sorted, sinkTag{name, value})
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+	return sorted
+}
+
+// jobTags are the tags of a job's observations
+func jobTags(server string, pool azdo.Pool, job azdo.Job, tags map[string]string) []sinkTag {
+	labels := []*dto.LabelPair{
+		{Name: proto.String("name"), Value: proto.String(server)},
+		{Name: proto.String("pool"), Value: proto.String(pool.Name)},
+		{Name: proto.String("agent"), Value: proto.String(job.ReservedAgent.Name)},
+		{Name: proto.String("definition"), Value: proto.String(job.Definition.Name)},
+		{Name: proto.String("result"), Value: proto.String(job.Result)},
+	}
+	return sortedTags(labels, tags)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"azdoexporter/azdo"
+)
+
+// udpListener receives the packets sent to it until it's closed
+func udpListener(t *testing.T) (*net.UDPConn, <-chan string) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packets := make(chan string, 100)
+	go func() {
+		defer close(packets)
+		buf := make([]byte, 65536)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			packets <- string(buf[:n])
+		}
+	}()
+	return conn, packets
+}
+
+// receivePackets waits for the packets sent so far
+func receivePackets(t *testing.T, packets <-chan string) []string {
+	var received []string
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case packet := <-packets:
+			received = append(received, packet)
+		case <-time.After(200 * time.Millisecond):
+			if len(received) > 0 {
+				return received
+			}
+		case <-timeout:
+			t.Fatal("no packets were received")
+		}
+	}
+}
+
+// testRegistry has a gauge and a counter of server s1, with the pool label value given, and s1's job histograms
+func testRegistry(t *testing.T, pool string) (*prometheus.Registry, prometheus.Counter, *finishedHistograms) {
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "tfs_test_gauge", Help: "Test gauge"}, []string{"pool"})
+	gauge.WithLabelValues(pool).Set(3)
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "tfs_test_total", Help: "Test counter"})
+	histograms := newJobHistograms()
+
+	reg := prometheus.NewRegistry()
+	wrapped := prometheus.WrapRegistererWith(prometheus.Labels{"name": "s1"}, reg)
+	for _, collector := range []prometheus.Collector{gauge, counter, histograms.cumulativeHistograms()} {
+		if err := wrapped.Register(collector); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return reg, counter, histograms
+}
+
+// testJob was queued 100 seconds before it finished, and waited 40 of them for an agent
+func testJob() (azdo.Pool, azdo.Job) {
+	finished := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	return azdo.Pool{ID: 1, Name: "Default pool"}, azdo.Job{
+		QueueTime:     finished.Add(-100 * time.Second),
+		ReceiveTime:   finished.Add(-60 * time.Second),
+		FinishTime:    finished,
+		Result:        "succeeded",
+		Definition:    azdo.JobReference{ID: 3, Name: "ci|build#2"},
+		ReservedAgent: azdo.Agent{ID: 5, Name: "agent,1"},
+	}
+}
+
+func TestWriteUDPSplitsPackets(t *testing.T) {
+	listener, packets := udpListener(t)
+	defer listener.Close()
+
+	var lines []string
+	for i := 0; i < 100; i++ {
+		lines = append(lines, strings.Repeat("a", 49))
+	}
+	lines = append(lines, strings.Repeat("b", 2*maxUDPPacketSize), "c:1|g")
+
+	conn, err := net.Dial("udp", listener.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := writeUDP(conn, lines); err != nil {
+		t.Fatal(err)
+	}
+
+	var received []string
+	for len(received) < len(lines) {
+		for _, packet := range receivePackets(t, packets) {
+			if len(packet) > maxUDPPacketSize && strings.Contains(packet, "\n") {
+				t.Errorf("packet of %v bytes is larger than %v but has more than one line", len(packet), maxUDPPacketSize)
+			}
+			received = append(received, strings.Split(packet, "\n")...)
+		}
+	}
+
+	if strings.Join(received, "\n") != strings.Join(lines, "\n") {
+		t.Errorf("lines were split, reordered or lost: got %v lines, want %v", len(received), len(lines))
+	}
+}
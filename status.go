@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"azdoexporter/config"
+)
+
+// scrapeStatus is the outcome of the last scrape of a server's agents, shown on /status and used by /readyz
+type scrapeStatus struct {
+	LastScrape      time.Time `json:"lastScrape"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	Error           string    `json:"error,omitempty"`
+	PoolCount       int       `json:"poolCount"`
+	LastSuccess     time.Time `json:"lastSuccess"`
+}
+
+func (azc *azDoCollector) recordScrape(start time.Time, poolCount int, err error) {
+	azc.statusMu.Lock()
+	defer azc.statusMu.Unlock()
+
+	azc.status.LastScrape = start
+	azc.status.DurationSeconds = time.Since(start).Seconds()
+	azc.status.PoolCount = poolCount
+	azc.status.Error = ""
+	if err != nil {
+		azc.status.Error = err.Error()
+		return
+	}
+	azc.status.LastSuccess = start
+}
+
+func (azc *azDoCollector) scrapeStatus() scrapeStatus {
+	azc.statusMu.Lock()
+	defer azc.statusMu.Unlock()
+	return azc.status
+}
+
+// warmUp scrapes a new server once, without publishing the metrics, so /readyz doesn't have to wait for Prometheus to scrape.
+// Describing the collectors doesn't scrape, so this is the only scrape before Prometheus', which waits for it to finish.
+func (azc *azDoCollector) warmUp() {
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		for range metrics {
+		}
+	}()
+	azc.Collect(metrics)
+	close(metrics)
+}
+
+// ready is true once the config has been loaded and every server has been scraped successfully at least once.
+// The servers which haven't are returned. Every server has the agents collector, whatever else it collects, so that's the scrape which is checked.
+// With no servers, e.g. when only probing, it's ready once the config has been loaded.
+func (sm *serverManager) ready() (bool, []string) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	if !sm.loaded {
+		return false, nil
+	}
+
+	var notReady []string
+	for name, s := range sm.servers {
+		if s.agents.scrapeStatus().LastSuccess.IsZero() {
+			notReady = append(notReady, name)
+		}
+	}
+	sort.Strings(notReady)
+	return len(notReady) == 0, notReady
+}
+
+// healthz is the liveness probe. The process is alive if it can respond
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("OK"))
+}
+
+// readyz is the readiness probe. It responds 503 until every server has been scraped successfully
+func (sm *serverManager) readyz(w http.ResponseWriter, r *http.Request) {
+	if ready, notReady := sm.ready(); !ready {
+		http.Error(w, fmt.Sprintf("Not ready. Servers not scraped yet: %v", strings.Join(notReady, ", ")), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+type statusPage struct {
+	Ready   bool                    `json:"ready"`
+	Servers map[string]scrapeStatus `json:"servers"`
+	Config  config.Config           `json:"config"`
+}
+
+// status shows the last scrape of each server and the config, with secrets redacted, as JSON
+func (sm *serverManager) status(w http.ResponseWriter, r *http.Request) {
+	page := statusPage{Servers: make(map[string]scrapeStatus)}
+	page.Ready, _ = sm.ready()
+
+	sm.mu.RLock()
+	for name, s := range sm.servers {
+		page.Servers[name] = s.agents.scrapeStatus()
+	}
+	page.Config = sm.config.Redacted()
+	sm.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(page); err != nil {
+		log.WithField("error", err).Error("Failed to write status page")
+	}
+}
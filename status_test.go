@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"azdoexporter/azdo"
+	"azdoexporter/config"
+)
+
+func TestHealthz(t *testing.T) {
+	w := httptest.NewRecorder()
+	healthz(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	if w.Code != http.StatusOK || w.Body.String() != "OK" {
+		t.Errorf("got %v %q, want 200 OK", w.Code, w.Body.String())
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	sm := newServerManager(t.Context(), prometheus.NewRegistry(), "")
+	readyz := func() (int, string) {
+		w := httptest.NewRecorder()
+		sm.readyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return w.Code, w.Body.String()
+	}
+
+	if code, _ := readyz(); code != http.StatusServiceUnavailable {
+		t.Errorf("got %v before the config was loaded, want 503", code)
+	}
+
+	sm.loaded = true
+	if code, _ := readyz(); code != http.StatusOK {
+		t.Errorf("got %v with no servers, want 200", code)
+	}
+
+	// s2 only collects builds, but is ready once its agents have been scraped like any other server
+	s1 := newAzDoCollector(azdo.AzDoClient{Name: "s1"}, true)
+	s2 := newAzDoCollector(azdo.AzDoClient{Name: "s2"}, true)
+	sm.servers["s1"] = &server{agents: s1}
+	sm.servers["s2"] = &server{agents: s2, collectors: []prometheus.Collector{s2, newBuildsCollector(azdo.AzDoClient{Name: "s2"})}}
+
+	s1.recordScrape(time.Now(), 0, errors.New("could not retrieve pools"))
+	if code, body := readyz(); code != http.StatusServiceUnavailable || !strings.Contains(body, "s1, s2") {
+		t.Errorf("got %v %q, want 503 with both servers", code, body)
+	}
+
+	s1.recordScrape(time.Now(), 1, nil)
+	if code, body := readyz(); code != http.StatusServiceUnavailable || strings.Contains(body, "s1") || !strings.Contains(body, "s2") {
+		t.Errorf("got %v %q, want 503 with only s2", code, body)
+	}
+
+	s2.recordScrape(time.Now(), 1, nil)
+	if code, _ := readyz(); code != http.StatusOK {
+		t.Errorf("got %v once every server was scraped, want 200", code)
+	}
+
+	// A server stays ready once it has been scraped successfully
+	s1.recordScrape(time.Now(), 0, errors.New("could not retrieve pools"))
+	if code, _ := readyz(); code != http.StatusOK {
+		t.Errorf("got %v after a scrape failed, want 200", code)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	sm := newServerManager(t.Context(), prometheus.NewRegistry(), "")
+	sm.loaded = true
+	sm.config = config.Config{Servers: map[string]config.Server{
+		"s1": {AzDoClient: azdo.AzDoClient{Address: "https://dev.azure.com/org"}, Auth: config.Auth{Method: config.AuthMethodClientSecret, ClientSecret: "secret"}},
+	}}
+	s1 := newAzDoCollector(azdo.AzDoClient{Name: "s1"}, true)
+	s1.recordScrape(time.Now(), 3, errors.New("could not retrieve pools"))
+	sm.servers["s1"] = &server{agents: s1}
+
+	w := httptest.NewRecorder()
+	sm.status(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("got Content-Type %q, want JSON", contentType)
+	}
+	if strings.Contains(w.Body.String(), `"secret"`) {
+		t.Errorf("got a secret in the status: %v", w.Body.String())
+	}
+
+	var page statusPage
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Ready {
+		t.Error("got ready, want not ready as s1 hasn't been scraped successfully")
+	}
+	if status := page.Servers["s1"]; status.Error != "could not retrieve pools" || status.PoolCount != 3 || status.LastScrape.IsZero() || !status.LastSuccess.IsZero() {
+		t.Errorf("got status %+v, want the failed scrape", status)
+	}
+	if server := page.Config.Servers["s1"]; server.Address != "https://dev.azure.com/org" || server.Auth.ClientSecret != "REDACTED" {
+		t.Errorf("got server config %+v, want it with its secrets redacted", server)
+	}
+}
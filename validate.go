@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"azdoexporter/config"
+)
+
+// validateCommand is `azdoexporter validate --config <path>`. It checks the config the same way the exporter does on start up,
+// without contacting any servers, and prints every problem found. Returns the exit code, which is 1 if the config isn't valid.
+func validateCommand(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	pathToConfig := flags.String("config", "config.toml", "Path to config file, TOML or YAML")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	*pathToConfig = configPath(flags, *pathToConfig)
+
+	// Only problems should be printed, not which environment variables were used
+	log.SetLevel(log.WarnLevel)
+
+	if _, err := config.Load(*pathToConfig); err != nil {
+		printConfigErrors(os.Stderr, *pathToConfig, err)
+		return 1
+	}
+
+	if *pathToConfig == "" {
+		fmt.Println("Config from environment variables is valid")
+		return 0
+	}
+	fmt.Printf("%v is valid\n", *pathToConfig)
+	return 0
+}
+
+func printConfigErrors(w io.Writer, pathToConfig string, err error) {
+	if pathToConfig == "" {
+		pathToConfig = "Config from environment variables"
+	}
+
+	errs, ok := err.(config.Errors)
+	if !ok {
+		fmt.Fprintf(w, "%v is not valid: %v\n", pathToConfig, err)
+		return
+	}
+
+	fmt.Fprintf(w, "%v is not valid, %v errors found:\n", pathToConfig, len(errs))
+	for _, err := range errs {
+		fmt.Fprintf(w, "  - %v\n", err)
+	}
+}
+
+// logConfigErrors logs each problem found in a config on its own line
+func logConfigErrors(pathToConfig string, err error) {
+	configLogger := log.WithField("path", pathToConfig)
+
+	errs, ok := err.(config.Errors)
+	if !ok {
+		configLogger.WithField("error", err).Error("Failed to load config")
+		return
+	}
+
+	for _, err := range errs {
+		configLogger.WithField("error", err).Error("Config is not valid")
+	}
+}